@@ -0,0 +1,255 @@
+// Package audit writes a tamper-evident record of every issuance decision made by the signer.
+// Each record carries the SHA-256 hash of the record before it, so removing or editing a record
+// breaks the chain and is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditLog = logger.Register("Audit")
+)
+
+// Outcomes recorded for a decision.
+const (
+	OutcomeIssued  = "Issued"
+	OutcomeFailed  = "Failed"
+	OutcomeError   = "Error"
+	OutcomeDryRun  = "DryRun"
+	OutcomePending = "Pending"
+	OutcomeRevoked = "Revoked"
+)
+
+// genesisHash is the previous hash of the first record in a chain.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// Condition is an approval or denial condition present on the CSR when the decision was made.
+type Condition struct {
+	Type           string    `json:"type"`
+	Reason         string    `json:"reason,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	LastUpdateTime time.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// Record describes a single issuance decision.
+type Record struct {
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+
+	CSRName    string              `json:"csrName"`
+	CSRUID     string              `json:"csrUID"`
+	SignerName string              `json:"signerName"`
+	Requester  string              `json:"requester"`
+	Groups     []string            `json:"groups,omitempty"`
+	Extra      map[string][]string `json:"extra,omitempty"`
+	Conditions []Condition         `json:"approverConditions,omitempty"`
+
+	Subject                  string   `json:"subject,omitempty"`
+	DNSNames                 []string `json:"dnsNames,omitempty"`
+	Method                   string   `json:"method,omitempty"`
+	Issuer                   string   `json:"issuer,omitempty"`
+	CertificateAuthorityName string   `json:"certificateAuthorityName,omitempty"`
+	CertificateProfileName   string   `json:"certificateProfileName,omitempty"`
+	EndEntityProfileName     string   `json:"endEntityProfileName,omitempty"`
+	ESTAlias                 string   `json:"estAlias,omitempty"`
+	EndEntityUsername        string   `json:"endEntityUsername,omitempty"`
+
+	SerialNumber string     `json:"serialNumber,omitempty"`
+	IssuerDN     string     `json:"issuerDN,omitempty"`
+	NotBefore    *time.Time `json:"notBefore,omitempty"`
+	NotAfter     *time.Time `json:"notAfter,omitempty"`
+
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the record with its Hash field cleared.
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Sink is a destination for audit records. Write receives one JSON encoded record without a
+// trailing newline.
+type Sink interface {
+	Write(rec *Record, line []byte) error
+	Close() error
+}
+
+// resumableSink is implemented by sinks that persist records and can tell the logger where the
+// chain left off before a restart.
+type resumableSink interface {
+	lastRecord() (*Record, error)
+}
+
+// Logger chains records together and writes them to every sink.
+type Logger struct {
+	lock     sync.Mutex
+	sinks    []Sink
+	sequence uint64
+	lastHash string
+}
+
+// NewLogger creates a Logger that writes to the given sinks. If a sink already holds records,
+// for example a file from a previous run, the chain continues from its last record.
+func NewLogger(sinks ...Sink) (*Logger, error) {
+	l := &Logger{sinks: sinks, lastHash: genesisHash}
+	for _, sink := range sinks {
+		resumable, ok := sink.(resumableSink)
+		if !ok {
+			continue
+		}
+		last, err := resumable.lastRecord()
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			l.sequence = last.Sequence
+			l.lastHash = last.Hash
+			auditLog.Infof("Continuing audit chain from record %d", last.Sequence)
+			break
+		}
+	}
+	return l, nil
+}
+
+// Record assigns the next sequence number, links rec to the previous record and writes it to
+// every sink. Errors from individual sinks are returned together, after every sink was tried.
+// A nil Logger discards records.
+func (l *Logger) Record(rec *Record) error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rec.Sequence = l.sequence + 1
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	rec.PrevHash = l.lastHash
+	hash, err := rec.computeHash()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, sink := range l.sinks {
+		if err = sink.Write(rec, line); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// The chain advances even if a sink failed, so that the remaining sinks stay consistent.
+	l.sequence = rec.Sequence
+	l.lastHash = rec.Hash
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to write audit record %d: %s", rec.Sequence, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close closes every sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var errs []string
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close audit sinks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Verify reads newline delimited audit records from r and checks that every record's hash is
+// correct and links to the record before it. It returns the number of records verified. The
+// first record may continue a chain from a rotated file, so its previous hash is trusted.
+func Verify(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	count := 0
+	var prev *Record
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return count, fmt.Errorf("record %d is not valid JSON: %v", count+1, err)
+		}
+
+		hash, err := rec.computeHash()
+		if err != nil {
+			return count, err
+		}
+		if hash != rec.Hash {
+			return count, fmt.Errorf("record with sequence %d has been modified: hash %s does not match its contents", rec.Sequence, rec.Hash)
+		}
+		if prev != nil {
+			if rec.PrevHash != prev.Hash {
+				return count, fmt.Errorf("chain is broken before sequence %d: previous hash %s does not match record %d", rec.Sequence, rec.PrevHash, prev.Sequence)
+			}
+			if rec.Sequence != prev.Sequence+1 {
+				return count, fmt.Errorf("chain is broken before sequence %d: expected sequence %d", rec.Sequence, prev.Sequence+1)
+			}
+		}
+		prev = rec
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// StdoutSink writes each record as a line of JSON to standard output.
+type StdoutSink struct {
+	lock sync.Mutex
+}
+
+// Write writes a record to standard output.
+func (s *StdoutSink) Write(_ *Record, line []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := os.Stdout.Write(append(line, '\n'))
+	return err
+}
+
+// Close is a no-op; standard output is left open.
+func (s *StdoutSink) Close() error {
+	return nil
+}
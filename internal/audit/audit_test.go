@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memorySink keeps the lines written to it.
+type memorySink struct {
+	lines [][]byte
+}
+
+func (s *memorySink) Write(_ *Record, line []byte) error {
+	s.lines = append(s.lines, append([]byte(nil), line...))
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+// writeRecords records n decisions with logger.
+func writeRecords(t *testing.T, logger *Logger, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := logger.Record(&Record{CSRName: "csr", Outcome: OutcomeIssued, SerialNumber: strings.Repeat("A", i+1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines [][]byte) [][]byte
+		wantErr bool
+	}{
+		{name: "intact chain", tamper: func(lines [][]byte) [][]byte { return lines }},
+		{
+			name:   "chain continued from a rotated file",
+			tamper: func(lines [][]byte) [][]byte { return lines[2:] },
+		},
+		{
+			name: "edited record",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(OutcomeIssued), []byte(OutcomeFailed), 1)
+				return lines
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed record",
+			tamper: func(lines [][]byte) [][]byte {
+				return append(lines[:1:1], lines[2:]...)
+			},
+			wantErr: true,
+		},
+		{
+			name: "reordered records",
+			tamper: func(lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memorySink{}
+			logger, err := NewLogger(sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeRecords(t, logger, 4)
+
+			lines := tt.tamper(sink.lines)
+			_, err = Verify(bytes.NewReader(append(bytes.Join(lines, []byte("\n")), '\n')))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify returned %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoggerContinuesChainAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for run := 0; run < 2; run++ {
+		sink, err := NewFileSink(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger, err := NewLogger(sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeRecords(t, logger, 3)
+		if err = logger.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	count, err := Verify(file)
+	if err != nil {
+		t.Fatalf("Verify returned %v", err)
+	}
+	if count != 6 {
+		t.Fatalf("Verify verified %d records, want 6", count)
+	}
+}
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink appends records to a file and rotates it once it grows past MaxSize bytes. Rotated
+// files are renamed to <path>.1, <path>.2 and so on, and at most MaxBackups of them are kept.
+// The hash chain continues across rotations.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens path for appending, creating it if needed. A maxSize of zero disables rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Write appends a record to the file, rotating it first if the record would exceed the size limit.
+func (s *FileSink) Write(_ *Record, line []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	// Drop the oldest backup and shift the others up by one.
+	if s.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate audit log %s: %v", s.path, err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("failed to rotate audit log %s: %v", s.path, err)
+	}
+
+	auditLog.Infof("Rotated audit log %s", s.path)
+	return s.open()
+}
+
+// lastRecord returns the last record in the current file, or the most recent backup if the
+// current file is empty, so that the chain survives restarts.
+func (s *FileSink) lastRecord() (*Record, error) {
+	for _, path := range []string{s.path, s.path + ".1"} {
+		rec, err := readLastRecord(path)
+		if err != nil || rec != nil {
+			return rec, err
+		}
+	}
+	return nil, nil
+}
+
+func readLastRecord(path string) (*Record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var last []byte
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+
+	rec := &Record{}
+	if err = json.Unmarshal(last, rec); err != nil {
+		return nil, fmt.Errorf("last record of audit log %s is corrupt: %v", path, err)
+	}
+	return rec, nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Syslog facility and severities used for audit records. Facility 13 is "log audit".
+const (
+	syslogFacilityLogAudit = 13
+	syslogSeverityWarning  = 4
+	syslogSeverityInfo     = 6
+)
+
+// SyslogSink sends each record to a syslog server as an RFC 5424 message whose MSG part is the
+// JSON encoded record. Over TCP messages are framed with octet counting as per RFC 6587.
+type SyslogSink struct {
+	network string
+	address string
+	appName string
+
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogSink creates a sink that sends to address over network, which is one of "udp",
+// "tcp" or "unix". The connection is opened lazily and re-established after errors.
+func NewSyslogSink(network string, address string, appName string) (*SyslogSink, error) {
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{network: network, address: address, appName: appName, hostname: hostname}, nil
+}
+
+// Write sends a record to the syslog server.
+func (s *SyslogSink) Write(rec *Record, line []byte) error {
+	severity := syslogSeverityInfo
+	if rec.Outcome != OutcomeIssued && rec.Outcome != OutcomeDryRun {
+		severity = syslogSeverityWarning
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	// The sequence number and hash are part of the JSON message, so no structured data is sent.
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogFacilityLogAudit*8+severity,
+		rec.Timestamp.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		os.Getpid(),
+		rec.Outcome,
+		line,
+	)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog server %s: %v", s.address, err)
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed to write to syslog server %s: %v", s.address, err)
+	}
+	return nil
+}
+
+// Close closes the connection to the syslog server.
+func (s *SyslogSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,218 @@
+// Package circuit implements a circuit breaker that stops the signer from calling an EJBCA
+// endpoint that keeps failing, and lets a single probe through once it may have recovered.
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
+	"sync"
+	"time"
+)
+
+var (
+	circuitLog = logger.Register("CircuitBreaker")
+
+	stateGauge = metrics.NewGaugeVec(
+		"ejbca_signer_circuit_breaker_state",
+		"State of the circuit breaker for an EJBCA endpoint: 0 closed, 1 half-open, 2 open.",
+		"endpoint",
+	)
+	transitions = metrics.NewCounterVec(
+		"ejbca_signer_circuit_breaker_transitions_total",
+		"Number of times the circuit breaker for an EJBCA endpoint changed state.",
+		"endpoint", "state",
+	)
+	rejected = metrics.NewCounterVec(
+		"ejbca_signer_circuit_breaker_rejected_total",
+		"Number of EJBCA calls rejected because the circuit breaker was open.",
+		"endpoint",
+	)
+)
+
+// ErrOpen is returned by Call when the breaker is open, or half-open with a probe in flight.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// HalfOpen lets a single probe through; its result closes or re-opens the breaker.
+	HalfOpen
+	// Open rejects every call until the open timeout has passed.
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Defaults used when a Breaker is created with a zero threshold or timeout.
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+)
+
+// Breaker opens after FailureThreshold consecutive failed calls to an endpoint. After
+// OpenTimeout it becomes half-open and lets a single probe through. A nil Breaker lets
+// every call through.
+type Breaker struct {
+	endpoint         string
+	failureThreshold int
+	openTimeout      time.Duration
+
+	// IsFailure decides whether an error returned by a call counts against the endpoint.
+	// Errors that it rejects, such as a request EJBCA refused, count as a success.
+	IsFailure func(error) bool
+
+	lock     sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker creates a closed Breaker for endpoint. Every error counts as a failure until
+// IsFailure is set.
+func NewBreaker(endpoint string, failureThreshold int, openTimeout time.Duration) *Breaker {
+	if failureThreshold <= 0 {
+		failureThreshold = DefaultFailureThreshold
+	}
+	if openTimeout <= 0 {
+		openTimeout = DefaultOpenTimeout
+	}
+	stateGauge.Set(float64(Closed), endpoint)
+	return &Breaker{
+		endpoint:         endpoint,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		IsFailure:        func(error) bool { return true },
+	}
+}
+
+// Endpoint returns the endpoint guarded by the breaker.
+func (b *Breaker) Endpoint() string {
+	if b == nil {
+		return ""
+	}
+	return b.endpoint
+}
+
+// State returns the current state, moving from Open to HalfOpen if the open timeout has passed.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.maybeHalfOpen()
+	return b.state
+}
+
+// Ready returns an error while the breaker is open, for use as a readiness check.
+func (b *Breaker) Ready() error {
+	if state := b.State(); state == Open {
+		return fmt.Errorf("circuit breaker for EJBCA endpoint %s is %s", b.endpoint, state)
+	}
+	return nil
+}
+
+// Call runs fn if the breaker allows it and records the result. ErrOpen is returned without
+// calling fn if the breaker is open or a half-open probe is already in flight. A panic in fn
+// is recorded as a failure, so a half-open probe can't leave the breaker stuck, and re-raised.
+func (b *Breaker) Call(fn func() error) (err error) {
+	if b == nil {
+		return fn()
+	}
+	if err = b.allow(); err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			b.record(true)
+		}
+	}()
+	err = fn()
+	completed = true
+	b.record(err != nil && b.IsFailure(err))
+	return err
+}
+
+func (b *Breaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.maybeHalfOpen()
+	switch b.state {
+	case Open:
+		rejected.Inc(b.endpoint)
+		return fmt.Errorf("%w for EJBCA endpoint %s; retrying after %v", ErrOpen, b.endpoint, time.Until(b.openedAt.Add(b.openTimeout)).Round(time.Second))
+	case HalfOpen:
+		if b.probing {
+			rejected.Inc(b.endpoint)
+			return fmt.Errorf("%w for EJBCA endpoint %s; waiting for a probe to finish", ErrOpen, b.endpoint)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *Breaker) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == HalfOpen {
+		b.probing = false
+		if failed {
+			b.transition(Open)
+		} else {
+			b.transition(Closed)
+		}
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == Closed && b.failures >= b.failureThreshold {
+		b.transition(Open)
+	}
+}
+
+// maybeHalfOpen moves an open breaker to half-open once its timeout has passed. b.lock must be held.
+func (b *Breaker) maybeHalfOpen() {
+	if b.state == Open && time.Since(b.openedAt) >= b.openTimeout {
+		b.transition(HalfOpen)
+	}
+}
+
+// transition changes state and updates metrics. b.lock must be held.
+func (b *Breaker) transition(state State) {
+	switch state {
+	case Open:
+		circuitLog.Warnf("Opening circuit breaker for EJBCA endpoint %s for %v", b.endpoint, b.openTimeout)
+		b.openedAt = time.Now()
+	case HalfOpen:
+		circuitLog.Infof("Circuit breaker for EJBCA endpoint %s is half-open; letting a probe through", b.endpoint)
+	case Closed:
+		circuitLog.Infof("Closing circuit breaker for EJBCA endpoint %s", b.endpoint)
+	}
+	b.state = state
+	b.failures = 0
+	stateGauge.Set(float64(state), b.endpoint)
+	transitions.Inc(b.endpoint, state.String())
+}
@@ -0,0 +1,168 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testOpenTimeout = 20 * time.Millisecond
+
+var errCall = errors.New("call failed")
+
+// step is a call through the breaker, or a wait for the open timeout if wait is set.
+type step struct {
+	fail      bool
+	wait      bool
+	wantErr   error
+	wantState State
+}
+
+func TestBreakerStateMachine(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		isFailure func(error) bool
+		steps     []step
+	}{
+		{
+			name:      "stays closed below the threshold",
+			threshold: 3,
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Closed},
+				{fail: true, wantErr: errCall, wantState: Closed},
+			},
+		},
+		{
+			name:      "opens after consecutive failures",
+			threshold: 2,
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Closed},
+				{fail: true, wantErr: errCall, wantState: Open},
+				{wantErr: ErrOpen, wantState: Open},
+			},
+		},
+		{
+			name:      "a success resets the failure count",
+			threshold: 2,
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Closed},
+				{wantState: Closed},
+				{fail: true, wantErr: errCall, wantState: Closed},
+			},
+		},
+		{
+			name:      "errors that aren't failures don't open it",
+			threshold: 1,
+			isFailure: func(error) bool { return false },
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Closed},
+				{fail: true, wantErr: errCall, wantState: Closed},
+			},
+		},
+		{
+			name:      "a successful probe closes it",
+			threshold: 1,
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Open},
+				{wait: true, wantState: HalfOpen},
+				{wantState: Closed},
+				{wantState: Closed},
+			},
+		},
+		{
+			name:      "a failed probe opens it again",
+			threshold: 1,
+			steps: []step{
+				{fail: true, wantErr: errCall, wantState: Open},
+				{wait: true, wantState: HalfOpen},
+				{fail: true, wantErr: errCall, wantState: Open},
+				{wantErr: ErrOpen, wantState: Open},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker("test", tt.threshold, testOpenTimeout)
+			if tt.isFailure != nil {
+				b.IsFailure = tt.isFailure
+			}
+			for i, s := range tt.steps {
+				if s.wait {
+					time.Sleep(testOpenTimeout)
+				} else {
+					err := b.Call(func() error {
+						if s.fail {
+							return errCall
+						}
+						return nil
+					})
+					if !errors.Is(err, s.wantErr) || (err != nil && s.wantErr == nil) {
+						t.Fatalf("step %d: Call returned %v, want %v", i, err, s.wantErr)
+					}
+				}
+				if state := b.State(); state != s.wantState {
+					t.Fatalf("step %d: state is %s, want %s", i, state, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerAllowsOneProbe(t *testing.T) {
+	b := NewBreaker("test", 1, testOpenTimeout)
+	_ = b.Call(func() error { return errCall })
+	time.Sleep(testOpenTimeout)
+
+	probing := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Call(func() error {
+			close(probing)
+			<-finish
+			return nil
+		})
+	}()
+	<-probing
+
+	if err := b.Call(func() error { return nil }); !errors.Is(err, ErrOpen) {
+		t.Fatalf("second call during the probe returned %v, want ErrOpen", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("probe returned %v", err)
+	}
+	if state := b.State(); state != Closed {
+		t.Fatalf("state after the probe is %s, want closed", state)
+	}
+}
+
+func TestBreakerPanickingProbeReopens(t *testing.T) {
+	b := NewBreaker("test", 1, testOpenTimeout)
+	_ = b.Call(func() error { return errCall })
+	time.Sleep(testOpenTimeout)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("the panic wasn't re-raised")
+			}
+		}()
+		_ = b.Call(func() error { panic("probe panicked") })
+	}()
+
+	if state := b.State(); state != Open {
+		t.Fatalf("state after the panicking probe is %s, want open", state)
+	}
+}
+
+func TestNilBreakerCallsThrough(t *testing.T) {
+	var b *Breaker
+	if err := b.Call(func() error { return errCall }); !errors.Is(err, errCall) {
+		t.Fatalf("Call returned %v, want the call's error", err)
+	}
+	if state := b.State(); state != Closed {
+		t.Fatalf("state is %s, want closed", state)
+	}
+}
@@ -2,8 +2,10 @@ package health
 
 import (
 	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
 	"github.com/valyala/fasthttp"
+	"sync"
 )
 
 var (
@@ -13,20 +15,51 @@ var (
 // ServiceHealthCheck create a health check service
 type ServiceHealthCheck struct {
 	Addr string
+
+	// Ready is called for /readyz. The signer is reported as not ready while it returns an
+	// error. A nil Ready is always ready.
+	Ready func() error
+
+	once   sync.Once
+	server *fasthttp.Server
+}
+
+func (s *ServiceHealthCheck) httpServer() *fasthttp.Server {
+	s.once.Do(func() {
+		s.server = &fasthttp.Server{
+			Handler: fasthttp.CompressHandler(s.requestHandler),
+		}
+	})
+	return s.server
 }
 
 // Serve start listen health check
 func (s *ServiceHealthCheck) Serve() error {
 	address := fmt.Sprintf("[::]:%s", s.Addr)
 	healthLog.Infof("Starting health check service at: %v", address)
-	if err := fasthttp.ListenAndServe(address, fasthttp.CompressHandler(s.requestHandler)); err != nil {
-		healthLog.Fatalf("Error in ListenAndServe: %s", err)
+	if err := s.httpServer().ListenAndServe(address); err != nil {
+		healthLog.Errorf("Error in ListenAndServe: %s", err)
 		return fmt.Errorf("Error in ListenAndServe: %s", err)
 	}
 	return nil
 }
 
+// Shutdown stops the health check service, waiting for open connections to be closed.
+func (s *ServiceHealthCheck) Shutdown() error {
+	healthLog.Infoln("Shutting down health check service")
+	return s.httpServer().Shutdown()
+}
+
 func (s *ServiceHealthCheck) requestHandler(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/metrics":
+		s.metricsHandler(ctx)
+		return
+	case "/readyz":
+		s.readinessHandler(ctx)
+		return
+	}
+
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	_, err := fmt.Fprintf(ctx, "OK!")
 	if err != nil {
@@ -34,3 +67,26 @@ func (s *ServiceHealthCheck) requestHandler(ctx *fasthttp.RequestCtx) {
 	}
 	ctx.SetContentType("text/plain; charset=utf8")
 }
+
+func (s *ServiceHealthCheck) readinessHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; charset=utf8")
+	if s.Ready != nil {
+		if err := s.Ready(); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			fmt.Fprintf(ctx, "Not ready: %s", err)
+			return
+		}
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	fmt.Fprintf(ctx, "OK!")
+}
+
+func (s *ServiceHealthCheck) metricsHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteText(ctx); err != nil {
+		healthLog.Errorf("Failed to write metrics: %s", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
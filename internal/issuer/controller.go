@@ -0,0 +1,393 @@
+// Package issuer maintains the EJBCA connections of EJBCAIssuer and ClusterEJBCAIssuer resources
+// and reports whether they can be used in their Ready condition.
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/circuit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/signer"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	issuerLog = logger.Register("Issuer")
+)
+
+// Options configures the issuer controller.
+type Options struct {
+	// ClusterResourceNamespace holds the Secrets referenced by ClusterEJBCAIssuers.
+	ClusterResourceNamespace string
+
+	// CheckInterval is how often the connection of every issuer is checked and its Ready
+	// condition updated. Changes to referenced Secrets are also picked up at this interval.
+	CheckInterval time.Duration
+
+	// FailureThreshold and OpenTimeout configure the circuit breaker of each issuer.
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	// SecretDir is where client certificates and CA bundles are written for the EJBCA client,
+	// which only reads them from files.
+	SecretDir string
+}
+
+// Controller watches EJBCAIssuer and ClusterEJBCAIssuer resources and resolves them to EJBCA
+// connections for the certificate controller.
+type Controller struct {
+	kubeClient    clientset.Interface
+	dynamicClient dynamic.Interface
+
+	factory               dynamicinformer.DynamicSharedInformerFactory
+	issuerInformer        cache.SharedIndexInformer
+	clusterIssuerInformer cache.SharedIndexInformer
+
+	queue workqueue.RateLimitingInterface
+	opts  Options
+
+	lock        sync.RWMutex
+	connections map[signer.IssuerRef]*connection
+}
+
+// connection is the EJBCA connection built for an issuer.
+type connection struct {
+	issuer *signer.Issuer
+	// generation and secretVersions identify the spec and Secrets the connection was built from.
+	generation     int64
+	secretVersions string
+}
+
+// NewController creates an issuer controller. Run must be called to start it.
+func NewController(kubeClient clientset.Interface, dynamicClient dynamic.Interface, opts Options) *Controller {
+	c := &Controller{
+		kubeClient:    kubeClient,
+		dynamicClient: dynamicClient,
+		factory:       dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, opts.CheckInterval),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "issuer"),
+		opts:          opts,
+		connections:   make(map[signer.IssuerRef]*connection),
+	}
+	c.issuerInformer = c.factory.ForResource(v1alpha1.EJBCAIssuerResource).Informer()
+	c.clusterIssuerInformer = c.factory.ForResource(v1alpha1.ClusterEJBCAIssuerResource).Informer()
+
+	// Resyncs arrive as updates, so every issuer is checked again each CheckInterval
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+		DeleteFunc: c.enqueue,
+	}
+	c.issuerInformer.AddEventHandler(handler)
+	c.clusterIssuerInformer.AddEventHandler(handler)
+	return c
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get issuer from %+v: %v", obj, err))
+		return
+	}
+	c.queue.Add(signer.IssuerRef{Namespace: object.GetNamespace(), Name: object.GetName()})
+}
+
+// Run starts the informers and workers and blocks until ctx is cancelled.
+func (c *Controller) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	issuerLog.Infoln("Starting issuer controller")
+	defer issuerLog.Infoln("Shutting down issuer controller")
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForNamedCacheSync("issuer", ctx.Done(), c.HasSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	<-ctx.Done()
+}
+
+// HasSynced returns true once both informers have listed their issuers.
+func (c *Controller) HasSynced() bool {
+	return c.issuerInformer.HasSynced() && c.clusterIssuerInformer.HasSynced()
+}
+
+func (c *Controller) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(signer.IssuerRef)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("sync %v failed with: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// get returns the issuer named by ref from the informer cache, or nil if it doesn't exist.
+func (c *Controller) get(ref signer.IssuerRef) (*unstructured.Unstructured, error) {
+	informer, key := c.issuerInformer, ref.Namespace+"/"+ref.Name
+	if ref.Namespace == "" {
+		informer, key = c.clusterIssuerInformer, ref.Name
+	}
+	obj, exists, err := informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return obj.(*unstructured.Unstructured), nil
+}
+
+// Issuer returns the connection of the issuer named by ref, nil if the issuer doesn't exist, or an
+// error if no connection could be built for it yet.
+func (c *Controller) Issuer(ref signer.IssuerRef) (*signer.Issuer, error) {
+	obj, err := c.get(ref)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	conn, ok := c.connections[ref]
+	if !ok || conn.generation != obj.GetGeneration() {
+		return nil, fmt.Errorf("%s is not ready; see its Ready condition", ref)
+	}
+	return conn.issuer, nil
+}
+
+// Issuers returns the connections of every issuer that has one, including issuers whose last
+// check failed.
+func (c *Controller) Issuers() []*signer.Issuer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	issuers := make([]*signer.Issuer, 0, len(c.connections))
+	for _, conn := range c.connections {
+		issuers = append(issuers, conn.issuer)
+	}
+	return issuers
+}
+
+// sync builds or refreshes the connection of an issuer, checks it and records the result in the
+// issuer's Ready condition.
+func (c *Controller) sync(ctx context.Context, ref signer.IssuerRef) error {
+	obj, err := c.get(ref)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		issuerLog.Infof("%s was deleted", ref)
+		c.lock.Lock()
+		delete(c.connections, ref)
+		c.lock.Unlock()
+		return os.RemoveAll(c.secretDir(ref))
+	}
+
+	issuer := &v1alpha1.EJBCAIssuer{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, issuer); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", ref, err)
+	}
+
+	checkErr := c.connect(ctx, ref, issuer)
+	if checkErr == nil {
+		c.lock.RLock()
+		conn := c.connections[ref]
+		c.lock.RUnlock()
+		checkErr = conn.issuer.Endpoints.Check()
+	}
+
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: issuer.Generation,
+		Reason:             "Connected",
+		Message:            fmt.Sprintf("Connected to EJBCA at %s", issuer.Spec.Hostname),
+	}
+	if checkErr != nil {
+		issuerLog.Warnf("%s is not ready: %v", ref, checkErr)
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConnectionFailed"
+		condition.Message = checkErr.Error()
+	}
+	return c.updateReadyCondition(ctx, ref, obj, issuer, condition)
+}
+
+// connect builds a new connection for the issuer unless its spec and Secrets are unchanged since
+// the current one was built.
+func (c *Controller) connect(ctx context.Context, ref signer.IssuerRef, issuer *v1alpha1.EJBCAIssuer) error {
+	spec := issuer.Spec
+	if spec.Hostname == "" {
+		return fmt.Errorf("spec.hostname is required")
+	}
+	secretNamespace := ref.Namespace
+	if secretNamespace == "" {
+		secretNamespace = c.opts.ClusterResourceNamespace
+	}
+
+	var clientCert, estCredentials *corev1.Secret
+	var versions []string
+	var err error
+	if spec.ClientCertSecretName != "" {
+		if clientCert, err = c.kubeClient.CoreV1().Secrets(secretNamespace).Get(ctx, spec.ClientCertSecretName, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("failed to get client certificate Secret %s/%s: %v", secretNamespace, spec.ClientCertSecretName, err)
+		}
+		versions = append(versions, clientCert.ResourceVersion)
+	} else if !spec.UseEST {
+		return fmt.Errorf("spec.clientCertSecretName is required for the EJBCA REST API")
+	}
+	if spec.UseEST {
+		if spec.ESTCredentialsSecretName == "" {
+			return fmt.Errorf("spec.estCredentialsSecretName is required for EST")
+		}
+		if estCredentials, err = c.kubeClient.CoreV1().Secrets(secretNamespace).Get(ctx, spec.ESTCredentialsSecretName, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("failed to get EST credentials Secret %s/%s: %v", secretNamespace, spec.ESTCredentialsSecretName, err)
+		}
+		versions = append(versions, estCredentials.ResourceVersion)
+	}
+
+	secretVersions := strings.Join(versions, ",")
+	c.lock.RLock()
+	conn, ok := c.connections[ref]
+	c.lock.RUnlock()
+	if ok && conn.generation == issuer.Generation && conn.secretVersions == secretVersions {
+		return nil
+	}
+
+	issuerLog.Infof("Connecting %s to EJBCA at %s", ref, spec.Hostname)
+	dir := c.secretDir(ref)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	ejbcaConfig := &ejbca.Config{
+		DefaultCertificateProfileName:   spec.CertificateProfileName,
+		DefaultEndEntityProfileName:     spec.EndEntityProfileName,
+		DefaultCertificateAuthorityName: spec.CertificateAuthorityName,
+		DefaultESTAlias:                 spec.ESTAlias,
+	}
+	if clientCert != nil {
+		if ejbcaConfig.CertificateFile, err = writeSecretFile(dir, "tls.crt", clientCert.Data[corev1.TLSCertKey]); err != nil {
+			return err
+		}
+		if ejbcaConfig.KeyFile, err = writeSecretFile(dir, "tls.key", clientCert.Data[corev1.TLSPrivateKeyKey]); err != nil {
+			return err
+		}
+	}
+	if spec.CABundle != "" {
+		if ejbcaConfig.CAFile, err = writeSecretFile(dir, "ca.crt", []byte(spec.CABundle)); err != nil {
+			return err
+		}
+	}
+
+	factory := ejbca.ClientFactory(spec.Hostname, ejbcaConfig)
+	var client *ejbca.Client
+	if spec.UseEST {
+		client, err = factory.NewESTClient(string(estCredentials.Data["username"]), string(estCredentials.Data["password"]))
+	} else {
+		client, err = factory.NewEJBCAClient()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create EJBCA client for %s: %v", spec.Hostname, err)
+	}
+
+	breaker := circuit.NewBreaker(spec.Hostname, c.opts.FailureThreshold, c.opts.OpenTimeout)
+	breaker.IsFailure = signer.IsEndpointFailure
+	endpoints := []*signer.Endpoint{{Hostname: spec.Hostname, Client: client, Breaker: breaker}}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connections[ref] = &connection{
+		issuer: &signer.Issuer{
+			Ref:       ref,
+			Endpoints: signer.NewEndpointPool(endpoints, spec.UseEST, spec.ESTAlias, 0),
+			UseEST:    spec.UseEST,
+			Defaults: signer.EnrollmentDefaults{
+				CertificateAuthorityName: spec.CertificateAuthorityName,
+				CertificateProfileName:   spec.CertificateProfileName,
+				EndEntityProfileName:     spec.EndEntityProfileName,
+				ESTAlias:                 spec.ESTAlias,
+			},
+		},
+		generation:     issuer.Generation,
+		secretVersions: secretVersions,
+	}
+	return nil
+}
+
+// updateReadyCondition sets the Ready condition of the issuer, unless it already has it.
+func (c *Controller) updateReadyCondition(ctx context.Context, ref signer.IssuerRef, obj *unstructured.Unstructured, issuer *v1alpha1.EJBCAIssuer, condition metav1.Condition) error {
+	if existing := meta.FindStatusCondition(issuer.Status.Conditions, condition.Type); existing != nil &&
+		existing.Status == condition.Status && existing.Reason == condition.Reason &&
+		existing.Message == condition.Message && existing.ObservedGeneration == condition.ObservedGeneration {
+		return nil
+	}
+	meta.SetStatusCondition(&issuer.Status.Conditions, condition)
+
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&issuer.Status)
+	if err != nil {
+		return err
+	}
+	obj = obj.DeepCopy()
+	obj.Object["status"] = status
+
+	resource := c.dynamicClient.Resource(v1alpha1.EJBCAIssuerResource).Namespace(ref.Namespace)
+	if ref.Namespace == "" {
+		resource = c.dynamicClient.Resource(v1alpha1.ClusterEJBCAIssuerResource)
+	}
+	if _, err = resource.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update the status of %s: %v", ref, err)
+	}
+	issuerLog.Infof("Set the Ready condition of %s to %s: %s", ref, condition.Status, condition.Message)
+	return nil
+}
+
+// secretDir returns the directory the files of an issuer are written to.
+func (c *Controller) secretDir(ref signer.IssuerRef) string {
+	if ref.Namespace == "" {
+		return filepath.Join(c.opts.SecretDir, "cluster", ref.Name)
+	}
+	return filepath.Join(c.opts.SecretDir, "namespaced", ref.Namespace, ref.Name)
+}
+
+// writeSecretFile writes data to name in dir, readable only by the signer, and returns its path.
+func writeSecretFile(dir string, name string, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,163 @@
+// Package metrics is a minimal registry of counters and gauges that are exposed in the
+// Prometheus text exposition format by the health check service.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	registryLock sync.Mutex
+	registry     []*metricVec
+)
+
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+
+	lock   sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// CounterVec is a monotonically increasing value partitioned by labels.
+type CounterVec struct {
+	vec *metricVec
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels.
+type GaugeVec struct {
+	vec *metricVec
+}
+
+// NewCounterVec registers a new counter. The name must be unique.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: register(name, help, "counter", labels)}
+}
+
+// NewGaugeVec registers a new gauge. The name must be unique.
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: register(name, help, "gauge", labels)}
+}
+
+func register(name string, help string, metricType string, labels []string) *metricVec {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, m := range registry {
+		if m.name == name {
+			panic(fmt.Sprintf("metric %s registered twice", name))
+		}
+	}
+	m := &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		values:     make(map[string]*sample),
+	}
+	registry = append(registry, m)
+	return m
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by v, which must not be negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.vec.update(labelValues, func(s *sample) { s.value += v })
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.vec.update(labelValues, func(s *sample) { s.value = v })
+}
+
+// Add adds v, which may be negative, to the gauge for the given label values.
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.vec.update(labelValues, func(s *sample) { s.value += v })
+}
+
+// Delete removes the series for the given label values, for example once the object it
+// describes no longer exists.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.vec.lock.Lock()
+	defer g.vec.lock.Unlock()
+	delete(g.vec.values, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metricVec) update(labelValues []string, fn func(*sample)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		m.values[key] = s
+	}
+	fn(s)
+}
+
+// WriteText writes every registered metric to w in the Prometheus text exposition format.
+func WriteText(w io.Writer) error {
+	registryLock.Lock()
+	metrics := append([]*metricVec{}, registry...)
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.metricType); err != nil {
+			return err
+		}
+
+		m.lock.Lock()
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var lines []string
+		for _, key := range keys {
+			s := m.values[key]
+			lines = append(lines, fmt.Sprintf("%s%s %v\n", m.name, formatLabels(m.labels, s.labelValues), s.value))
+		}
+		m.lock.Unlock()
+
+		for _, line := range lines {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,116 @@
+package signer
+
+import (
+	"fmt"
+	certificates "k8s.io/api/certificates/v1"
+	"strings"
+	"time"
+)
+
+// Usages a kube-apiserver client certificate may request. Client auth is required.
+var apiServerClientAllowedUsages = map[certificates.KeyUsage]bool{
+	certificates.UsageDigitalSignature: true,
+	certificates.UsageKeyEncipherment:  true,
+	certificates.UsageClientAuth:       true,
+}
+
+// ClientGroupRule lets the members of a group request kube-apiserver client certificates.
+type ClientGroupRule struct {
+	// Group is the group the requester must be a member of.
+	Group string
+	// Organizations are the O values, that is the Kubernetes groups, members may request.
+	Organizations []string
+	// MaxDuration limits the lifetime of the certificate. The lifetime is decided by the certificate
+	// profile, so a certificate that exceeds it is revoked and the CSR failed. Zero leaves the
+	// lifetime to the certificate profile.
+	MaxDuration time.Duration
+}
+
+// isPrivilegedGroup returns true for the groups reserved by Kubernetes, such as system:masters and
+// system:nodes. They can only be requested if the policy explicitly allows them.
+func isPrivilegedGroup(group string) bool {
+	return strings.HasPrefix(group, "system:")
+}
+
+// checkAPIServerClient verifies a kube-apiserver client CSR against the identity of the requester:
+// the common name must be the requester's username, every organization must be granted by a rule
+// for one of the requester's groups, and privileged organizations must be allowed by the policy.
+// The longest MaxDuration of the matching rules limits the lifetime of the issued certificate.
+func checkAPIServerClient(policy *SignerPolicy, enrollment *enrollmentRequest) error {
+	csr := enrollment.csr
+	request := enrollment.request
+	username := csr.Spec.Username
+
+	if strings.HasPrefix(username, "system:") {
+		return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("%s is not a user; client certificates are only issued to users", username)}
+	}
+	if request.Subject.CommonName != username {
+		return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("common name %q must be the requester's username %q", request.Subject.CommonName, username)}
+	}
+	if len(request.DNSNames) > 0 || len(request.IPAddresses) > 0 || len(request.URIs) > 0 || len(request.EmailAddresses) > 0 {
+		return &policyError{reason: "InvalidClientIdentity", message: "a client certificate must not have SANs"}
+	}
+
+	var rules []ClientGroupRule
+	for _, rule := range policy.ClientGroups {
+		if containsString(csr.Spec.Groups, rule.Group) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("none of the groups of %s may request client certificates", username)}
+	}
+
+	for _, organization := range request.Subject.Organization {
+		if isPrivilegedGroup(organization) && !containsString(policy.AllowedPrivilegedGroups, organization) {
+			return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("privileged group %q can't be requested", organization)}
+		}
+		granted := false
+		for _, rule := range rules {
+			if containsString(rule.Organizations, organization) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("%s may not request group %q", username, organization)}
+		}
+	}
+
+	hasClientAuth := false
+	for _, usage := range csr.Spec.Usages {
+		if !apiServerClientAllowedUsages[usage] {
+			return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("usage %q is not allowed for a client certificate", usage)}
+		}
+		if usage == certificates.UsageClientAuth {
+			hasClientAuth = true
+		}
+	}
+	if !hasClientAuth {
+		return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("a client certificate must request the %q usage", certificates.UsageClientAuth)}
+	}
+
+	// The most permissive rule wins; a rule without a limit lifts it.
+	var maxDuration time.Duration
+	for _, rule := range rules {
+		if rule.MaxDuration == 0 {
+			maxDuration = 0
+			break
+		}
+		if rule.MaxDuration > maxDuration {
+			maxDuration = rule.MaxDuration
+		}
+	}
+	if maxDuration > 0 {
+		if seconds := csr.Spec.ExpirationSeconds; seconds != nil {
+			if requested := time.Duration(*seconds) * time.Second; requested > maxDuration {
+				return &policyError{reason: "InvalidClientIdentity", message: fmt.Sprintf("requested lifetime %s exceeds the maximum of %s", requested, maxDuration)}
+			}
+		}
+		// EJBCA doesn't receive the requested lifetime, so the issued certificate is checked
+		enrollment.limitLifetime(maxDuration)
+	}
+
+	enrollment.username = username
+	return nil
+}
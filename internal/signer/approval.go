@@ -0,0 +1,254 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"net/http"
+	"strconv"
+	"strings"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotations that track an enrollment waiting for approval by a CA administrator in EJBCA.
+const (
+	annotationApprovalRequestID = "ejbca.keyfactor.com/approval-request-id"
+	annotationApprovalStatus    = "ejbca.keyfactor.com/approval-status"
+)
+
+// Values of the approval status annotation.
+const (
+	approvalStatusAwaiting = "AwaitingCAApproval"
+	approvalStatusApproved = "Approved"
+)
+
+// Approval Secrets keep the end entity passwords of enrollments waiting for approval across
+// restarts. They're named by CSR UID and owned by the CSR, so they're deleted with it.
+const (
+	approvalSecretPrefix        = "ejbca-approval-"
+	approvalSecretPasswordKey   = "password"
+	annotationApprovalSecretCSR = "ejbca.keyfactor.com/certificate-signing-request"
+)
+
+// finalizeResponseFormat is the format certificates of approved enrollments are collected in.
+const finalizeResponseFormat = "DER"
+
+// approvalPendingError is returned by a REST enrollment that EJBCA accepted, but that a CA
+// administrator must approve before the certificate is issued.
+type approvalPendingError struct {
+	// requestID is the ID of the approval request, or empty if EJBCA didn't name it.
+	requestID string
+	// password is the end entity password the enrollment was submitted with, which is needed to
+	// finalize it.
+	password string
+	message  string
+}
+
+func (e *approvalPendingError) Error() string {
+	return fmt.Sprintf("enrollment is waiting for approval by a CA administrator: %s", e.message)
+}
+
+// asApprovalPending returns the approvalPendingError for err if EJBCA answered that the request is
+// waiting for approval, which it does with an error_code of 202.
+func asApprovalPending(err error, password string) (*approvalPendingError, bool) {
+	var statusErr *StatusError
+	if !errors.As(asStatusError(err), &statusErr) || statusErr.StatusCode != http.StatusAccepted {
+		return nil, false
+	}
+	pending := &approvalPendingError{password: password, message: statusErr.Message}
+	if statusErr.RequestID != nil {
+		pending.requestID = strconv.Itoa(*statusErr.RequestID)
+	}
+	return pending, true
+}
+
+// awaitApproval records that the enrollment of a CSR is waiting for approval in EJBCA, and
+// schedules the CSR to be polled. The annotations are written, and the Event emitted, before the
+// password is stored, so a CSR is never enrolled again once EJBCA accepted it; until both are
+// written the pending enrollment is kept in memory and recording it is retried. An enrollment
+// whose approval request EJBCA didn't name can't be collected, so its CSR is failed.
+func (cc *CertificateController) awaitApproval(ctx context.Context, enrollment *enrollmentRequest, pending *approvalPendingError) error {
+	csr := enrollment.csr
+	if pending.requestID == "" {
+		policyErr := &policyError{reason: "CAApprovalUntracked", message: "EJBCA is waiting for a CA administrator to approve the enrollment, but named no approval request, so the certificate can't be collected; finalize the request in EJBCA and create a new CSR"}
+		if err := cc.failCertificateRequest(ctx, csr, policyErr); err != nil {
+			return err
+		}
+		cc.pendingApprovals.Delete(csr.UID)
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		return nil
+	}
+
+	cc.pendingApprovals.Store(csr.UID, pending)
+	if csr.Annotations[annotationApprovalStatus] != approvalStatusAwaiting || csr.Annotations[annotationApprovalRequestID] != pending.requestID {
+		err := cc.updateCSRMetadata(ctx, csr, func(current *certificates.CertificateSigningRequest) {
+			current.Annotations[annotationApprovalStatus] = approvalStatusAwaiting
+			current.Annotations[annotationApprovalRequestID] = pending.requestID
+		})
+		if err != nil {
+			return err
+		}
+
+		message := fmt.Sprintf("EJBCA is waiting for a CA administrator to approve the enrollment; approval request ID %s", pending.requestID)
+		handlerLog.Infof("Certificate request %s: %s", csr.Name, message)
+		cc.recorder.Event(csr, corev1.EventTypeNormal, approvalStatusAwaiting, message)
+		cc.recordAudit(csr, enrollment, audit.OutcomePending, approvalStatusAwaiting, message, nil)
+	}
+	if err := cc.storeApprovalPassword(ctx, csr, pending.password); err != nil {
+		return err
+	}
+	cc.pendingApprovals.Delete(csr.UID)
+	cc.queue.AddAfter(csr.Name, cc.approvalPollInterval)
+	return nil
+}
+
+// finalizeApproval collects the certificate of a CSR whose enrollment is waiting for approval. It
+// returns the chain once the request is approved, and nil while the request is still waiting or
+// once the CSR failed because the request was rejected, expired or can't be finalized. The CSR
+// is never enrolled again.
+func (cc *CertificateController) finalizeApproval(ctx context.Context, enrollment *enrollmentRequest) ([]byte, error) {
+	csr := enrollment.csr
+	requestID, err := strconv.Atoi(csr.Annotations[annotationApprovalRequestID])
+	if err != nil {
+		return nil, cc.failApproval(ctx, enrollment, &policyError{reason: "CAApprovalUntracked", message: "The CSR is waiting for approval in EJBCA, but has no valid approval request ID, so the certificate can't be collected; finalize the request in EJBCA and create a new CSR"})
+	}
+	password, err := cc.loadApprovalPassword(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, cc.failApproval(ctx, enrollment, &policyError{reason: "CAApprovalUntracked", message: fmt.Sprintf("The password of approval request %d was lost, so the certificate can't be collected; finalize the request in EJBCA and create a new CSR", requestID)})
+	}
+
+	var chain []byte
+	err = cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+		var err error
+		err, chain = restFinalizeEnrollment(client, requestID, password)
+		return err
+	})
+	if err == nil {
+		handlerLog.Infof("Approval request %d of %s was approved", requestID, csr.Name)
+		if err = cc.updateCSRMetadata(ctx, csr, func(current *certificates.CertificateSigningRequest) {
+			current.Annotations[annotationApprovalStatus] = approvalStatusApproved
+		}); err != nil {
+			handlerLog.Error(err)
+		}
+		cc.deleteApprovalPassword(ctx, csr)
+		return chain, nil
+	}
+	if _, ok := asApprovalPending(err, ""); ok {
+		handlerLog.Debugf("Approval request %d of %s is still waiting for approval", requestID, csr.Name)
+		cc.queue.AddAfter(csr.Name, cc.approvalPollInterval)
+		return nil, nil
+	}
+
+	// EJBCA answers the finalization of a rejected or expired request with a client error.
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode < 400 || statusErr.StatusCode >= 500 {
+		cc.recordAudit(csr, enrollment, audit.OutcomeError, "FinalizeFailed", err.Error(), nil)
+		return nil, fmt.Errorf("failed to finalize approval request %d of %s: %v", requestID, csr.Name, err)
+	}
+	policyErr := &policyError{reason: "CAApprovalRejected", message: fmt.Sprintf("Approval request %d can't be finalized in EJBCA: %s", requestID, statusErr.Message)}
+	if strings.Contains(strings.ToLower(statusErr.Message), "expired") {
+		policyErr.reason = "CAApprovalExpired"
+	}
+	return nil, cc.failApproval(ctx, enrollment, policyErr)
+}
+
+// failApproval fails a CSR whose approval request won't produce a certificate, and deletes the
+// password it was waiting with.
+func (cc *CertificateController) failApproval(ctx context.Context, enrollment *enrollmentRequest, policyErr *policyError) error {
+	csr := enrollment.csr
+	if err := cc.failCertificateRequest(ctx, csr, policyErr); err != nil {
+		return err
+	}
+	cc.deleteApprovalPassword(ctx, csr)
+	cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+	return nil
+}
+
+func approvalSecretName(uid types.UID) string {
+	return approvalSecretPrefix + string(uid)
+}
+
+// storeApprovalPassword writes the password of the pending enrollment of csr to its approval
+// Secret in the signer's namespace.
+func (cc *CertificateController) storeApprovalPassword(ctx context.Context, csr *certificates.CertificateSigningRequest, password string) error {
+	if cc.approvalNamespace == "" {
+		return fmt.Errorf("can't store the password of the pending enrollment of %s: the signer's namespace is unknown; set POD_NAMESPACE", csr.Name)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        approvalSecretName(csr.UID),
+			Namespace:   cc.approvalNamespace,
+			Annotations: map[string]string{annotationApprovalSecretCSR: csr.Name},
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: certificates.SchemeGroupVersion.String(),
+				Kind:       "CertificateSigningRequest",
+				Name:       csr.Name,
+				UID:        csr.UID,
+			}},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{approvalSecretPasswordKey: password},
+	}
+	secrets := cc.kubeClient.CoreV1().Secrets(cc.approvalNamespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store the password of the pending enrollment of %s: %v", csr.Name, err)
+	}
+	return nil
+}
+
+// loadApprovalPassword returns the password of the pending enrollment of csr, or "" if it has no
+// approval Secret.
+func (cc *CertificateController) loadApprovalPassword(ctx context.Context, csr *certificates.CertificateSigningRequest) (string, error) {
+	if cc.approvalNamespace == "" {
+		return "", nil
+	}
+	secret, err := cc.kubeClient.CoreV1().Secrets(cc.approvalNamespace).Get(ctx, approvalSecretName(csr.UID), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the password of the pending enrollment of %s: %v", csr.Name, err)
+	}
+	return string(secret.Data[approvalSecretPasswordKey]), nil
+}
+
+// deleteApprovalPassword deletes the approval Secret of csr once its enrollment is finalized. A
+// Secret that can't be deleted is left to be garbage collected with the CSR.
+func (cc *CertificateController) deleteApprovalPassword(ctx context.Context, csr *certificates.CertificateSigningRequest) {
+	if cc.approvalNamespace == "" {
+		return
+	}
+	err := cc.kubeClient.CoreV1().Secrets(cc.approvalNamespace).Delete(ctx, approvalSecretName(csr.UID), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		handlerLog.Warnf("Failed to delete the approval Secret of %s: %v", csr.Name, err)
+	}
+}
+
+// restFinalizeEnrollment collects the certificate of an approved enrollment.
+func restFinalizeEnrollment(client *ejbca.Client, requestID int, password string) (error, []byte) {
+	handlerLog.Debugf("Finalizing approval request %d with REST client", requestID)
+	resp, err := client.FinalizeCertificateEnrollment(&ejbca.FinalizeCertificateEnrollment{
+		RequestId:      requestID,
+		ResponseFormat: finalizeResponseFormat,
+		Password:       password,
+	})
+	if err != nil {
+		return err, nil
+	}
+	chain, err := encodeRESTChain(resp.Certificate, resp.CertificateChain)
+	return err, chain
+}
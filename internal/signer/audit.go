@@ -0,0 +1,83 @@
+package signer
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	certificates "k8s.io/api/certificates/v1"
+)
+
+// recordAudit writes an audit record for a decision about csr. enrollment may be nil if the CSR
+// could not be resolved, and chain is the issued PEM chain, if any.
+func (cc *CertificateController) recordAudit(csr *certificates.CertificateSigningRequest, enrollment *enrollmentRequest, outcome string, reason string, message string, chain []byte) {
+	rec := &audit.Record{
+		CSRName:    csr.Name,
+		CSRUID:     string(csr.UID),
+		SignerName: csr.Spec.SignerName,
+		Requester:  csr.Spec.Username,
+		Groups:     csr.Spec.Groups,
+		Outcome:    outcome,
+		Reason:     reason,
+		Message:    message,
+	}
+	if len(csr.Spec.Extra) > 0 {
+		rec.Extra = make(map[string][]string, len(csr.Spec.Extra))
+		for key, value := range csr.Spec.Extra {
+			rec.Extra[key] = value
+		}
+	}
+	for _, c := range csr.Status.Conditions {
+		if c.Type != certificates.CertificateApproved && c.Type != certificates.CertificateDenied {
+			continue
+		}
+		rec.Conditions = append(rec.Conditions, audit.Condition{
+			Type:           string(c.Type),
+			Reason:         c.Reason,
+			Message:        c.Message,
+			LastUpdateTime: c.LastUpdateTime.Time,
+		})
+	}
+
+	if enrollment != nil {
+		// revocations have a connection but no request
+		if enrollment.request != nil {
+			rec.Subject = enrollment.request.Subject.String()
+			rec.DNSNames = enrollment.request.DNSNames
+		}
+		rec.EndEntityUsername = enrollment.username
+		if enrollment.issuer != nil {
+			rec.Issuer = enrollment.issuer.Ref.String()
+		}
+		if enrollment.useEST {
+			rec.Method = "EST"
+			rec.ESTAlias = enrollment.estAlias
+		} else {
+			rec.Method = "REST"
+			rec.CertificateAuthorityName = enrollment.certificateAuthorityName
+			rec.CertificateProfileName = enrollment.certificateProfileName
+			rec.EndEntityProfileName = enrollment.endEntityProfileName
+		}
+	}
+
+	if leaf, err := parseLeafCertificate(chain); err == nil && leaf != nil {
+		rec.SerialNumber = fmt.Sprintf("%X", leaf.SerialNumber)
+		rec.IssuerDN = leaf.Issuer.String()
+		rec.NotBefore = &leaf.NotBefore
+		rec.NotAfter = &leaf.NotAfter
+	}
+
+	if err := cc.auditor.Record(rec); err != nil {
+		handlerLog.Errorf("Failed to write audit record for certificate request %s: %s", csr.Name, err)
+	}
+}
+
+// parseLeafCertificate returns the first certificate in a PEM encoded chain, or nil if the
+// chain is empty.
+func parseLeafCertificate(chain []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(chain)
+	if block == nil {
+		return nil, nil
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,103 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Virtual resources that requesters must be allowed to "use" for an enrollment to proceed when
+// authorization is enabled. They don't exist in the API server and only serve as RBAC targets.
+const (
+	authorizationGroup = "ejbca.keyfactor.com"
+	authorizationVerb  = "use"
+
+	resourceCertificateAuthorities = "ejbcacas"
+	resourceCertificateProfiles    = "ejbcaprofiles"
+	resourceEndEntityProfiles      = "ejbcaendentityprofiles"
+	resourceESTAliases             = "ejbcaestaliases"
+)
+
+// authorizationDefaultName is the resource name checked when the enrollment leaves a CA, profile
+// or EST alias to the default EJBCA applies, so that the default has to be granted too.
+const authorizationDefaultName = "default"
+
+// authorizationCheck is a single resource the requester must be allowed to use.
+type authorizationCheck struct {
+	namespace string
+	resource  string
+	name      string
+}
+
+// authorizeEnrollment runs a SubjectAccessReview for the CSR's requester against the issuer the
+// CSR selected and every CA, profile or EST alias the enrollment would use. Names left empty are
+// checked as authorizationDefaultName. A requester that isn't allowed to use one of them gets a
+// *policyError.
+func (cc *CertificateController) authorizeEnrollment(ctx context.Context, enrollment *enrollmentRequest) error {
+	if !cc.authorizeProfiles {
+		return nil
+	}
+
+	var checks []authorizationCheck
+	if issuer := enrollment.issuer; issuer != nil {
+		resource := v1alpha1.ClusterEJBCAIssuerResource.Resource
+		if issuer.Ref.Namespace != "" {
+			resource = v1alpha1.EJBCAIssuerResource.Resource
+		}
+		checks = append(checks, authorizationCheck{namespace: issuer.Ref.Namespace, resource: resource, name: issuer.Ref.Name})
+	}
+	if enrollment.useEST {
+		checks = append(checks, authorizationCheck{resource: resourceESTAliases, name: enrollment.estAlias})
+	} else {
+		checks = append(checks,
+			authorizationCheck{resource: resourceCertificateAuthorities, name: enrollment.certificateAuthorityName},
+			authorizationCheck{resource: resourceCertificateProfiles, name: enrollment.certificateProfileName},
+			authorizationCheck{resource: resourceEndEntityProfiles, name: enrollment.endEntityProfileName},
+		)
+	}
+
+	csr := enrollment.csr
+	extra := make(map[string]authorizationv1.ExtraValue, len(csr.Spec.Extra))
+	for key, value := range csr.Spec.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+
+	for _, check := range checks {
+		resource, name := check.resource, check.name
+		if name == "" {
+			name = authorizationDefaultName
+		}
+
+		review := &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   csr.Spec.Username,
+				Groups: csr.Spec.Groups,
+				UID:    csr.Spec.UID,
+				Extra:  extra,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: check.namespace,
+					Group:     authorizationGroup,
+					Resource:  resource,
+					Name:      name,
+					Verb:      authorizationVerb,
+				},
+			},
+		}
+		result, err := cc.kubeClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, v1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to authorize %s to use %s %q: %v", csr.Spec.Username, resource, name, err)
+		}
+		if !result.Status.Allowed {
+			message := fmt.Sprintf("%s is not allowed to %s %s/%s", csr.Spec.Username, authorizationVerb, resource, name)
+			if result.Status.Reason != "" {
+				message = fmt.Sprintf("%s: %s", message, result.Status.Reason)
+			}
+			return &policyError{reason: "Unauthorized", message: message}
+		}
+		handlerLog.Tracef("%s is allowed to %s %s/%s", csr.Spec.Username, authorizationVerb, resource, name)
+	}
+	return nil
+}
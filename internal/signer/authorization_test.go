@@ -0,0 +1,109 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	certificates "k8s.io/api/certificates/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAuthorizeEnrollment(t *testing.T) {
+	tests := []struct {
+		name       string
+		enrollment *enrollmentRequest
+		denied     string
+		want       []authorizationv1.ResourceAttributes
+		wantErr    bool
+	}{
+		{
+			name: "REST enrollment",
+			enrollment: &enrollmentRequest{
+				certificateAuthorityName: "ManagementCA",
+				certificateProfileName:   "Server",
+				endEntityProfileName:     "Server",
+			},
+			want: []authorizationv1.ResourceAttributes{
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcacas", Name: "ManagementCA", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaprofiles", Name: "Server", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaendentityprofiles", Name: "Server", Verb: "use"},
+			},
+		},
+		{
+			name:       "EJBCA defaults",
+			enrollment: &enrollmentRequest{},
+			want: []authorizationv1.ResourceAttributes{
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcacas", Name: "default", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaprofiles", Name: "default", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaendentityprofiles", Name: "default", Verb: "use"},
+			},
+		},
+		{
+			name:       "EST enrollment with a namespaced issuer",
+			enrollment: &enrollmentRequest{useEST: true, estAlias: "servers", issuer: &Issuer{Ref: IssuerRef{Namespace: "payments", Name: "ejbca"}}},
+			want: []authorizationv1.ResourceAttributes{
+				{Namespace: "payments", Group: "ejbca.keyfactor.com", Resource: "ejbcaissuers", Name: "ejbca", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaestaliases", Name: "servers", Verb: "use"},
+			},
+		},
+		{
+			name:       "cluster issuer",
+			enrollment: &enrollmentRequest{useEST: true, estAlias: "servers", issuer: &Issuer{Ref: IssuerRef{Name: "ejbca"}}},
+			want: []authorizationv1.ResourceAttributes{
+				{Group: "ejbca.keyfactor.com", Resource: "clusterejbcaissuers", Name: "ejbca", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaestaliases", Name: "servers", Verb: "use"},
+			},
+		},
+		{
+			name: "denied profile",
+			enrollment: &enrollmentRequest{
+				certificateAuthorityName: "ManagementCA",
+				certificateProfileName:   "Server",
+				endEntityProfileName:     "Server",
+			},
+			denied: "ejbcaprofiles",
+			want: []authorizationv1.ResourceAttributes{
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcacas", Name: "ManagementCA", Verb: "use"},
+				{Group: "ejbca.keyfactor.com", Resource: "ejbcaprofiles", Name: "Server", Verb: "use"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			var reviewed []authorizationv1.ResourceAttributes
+			client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+				if review.Spec.User != "system:serviceaccount:payments:api" {
+					t.Errorf("reviewed user %q, want the requester", review.Spec.User)
+				}
+				attributes := *review.Spec.ResourceAttributes
+				reviewed = append(reviewed, attributes)
+				review.Status.Allowed = attributes.Resource != tt.denied
+				return true, review, nil
+			})
+			cc := &CertificateController{kubeClient: client, authorizeProfiles: true}
+			tt.enrollment.csr = &certificates.CertificateSigningRequest{
+				Spec: certificates.CertificateSigningRequestSpec{Username: "system:serviceaccount:payments:api"},
+			}
+
+			err := cc.authorizeEnrollment(context.Background(), tt.enrollment)
+			var policyErr *policyError
+			switch {
+			case tt.wantErr && !errors.As(err, &policyErr):
+				t.Fatalf("authorizeEnrollment returned %v, want a policy error", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("authorizeEnrollment returned %v", err)
+			}
+			if !reflect.DeepEqual(reviewed, tt.want) {
+				t.Fatalf("reviewed %+v, want %+v", reviewed, tt.want)
+			}
+		})
+	}
+}
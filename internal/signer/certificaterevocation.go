@@ -0,0 +1,347 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"math/big"
+	"strings"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// defaultManualRevocationReason is the reason of CertificateRevocations that don't set one.
+const defaultManualRevocationReason = "UNSPECIFIED"
+
+// CertificateRevocationController reconciles CertificateRevocation resources: it revokes the
+// named certificate in EJBCA, confirms the revocation and reports it in the status.
+type CertificateRevocationController struct {
+	cc            *CertificateController
+	dynamicClient dynamic.Interface
+
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// revocationTarget is the certificate a CertificateRevocation revokes and the EJBCA connection it's
+// revoked through.
+type revocationTarget struct {
+	issuerDN     string
+	serialNumber string
+	// certificate is the PEM encoded certificate, if it's known.
+	certificate []byte
+	enrollment  *enrollmentRequest
+}
+
+// NewCertificateRevocationController creates a controller for CertificateRevocation resources
+// that revokes through the connections of cc. Run must be called to start it.
+func NewCertificateRevocationController(cc *CertificateController, dynamicClient dynamic.Interface, resyncPeriod time.Duration) *CertificateRevocationController {
+	c := &CertificateRevocationController{
+		cc:            cc,
+		dynamicClient: dynamicClient,
+		factory:       dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, resyncPeriod),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "certificaterevocation"),
+	}
+	c.informer = c.factory.ForResource(v1alpha1.CertificateRevocationResource).Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+	})
+	return c
+}
+
+func (c *CertificateRevocationController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %+v: %v", obj, err))
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers and blocks until ctx is cancelled.
+func (c *CertificateRevocationController) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	signerLog.Infoln("Starting CertificateRevocation controller")
+	defer signerLog.Infoln("Shutting down CertificateRevocation controller")
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForNamedCacheSync("certificaterevocation", ctx.Done(), c.informer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	<-ctx.Done()
+}
+
+func (c *CertificateRevocationController) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *CertificateRevocationController) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("sync %v failed with: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync revokes the certificate of a CertificateRevocation and confirms the revocation with
+// CheckRevocationStatus. Revocations can't be undone, so a revoked CertificateRevocation is done.
+func (c *CertificateRevocationController) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	object := obj.(*unstructured.Unstructured)
+	revocation := &v1alpha1.CertificateRevocation{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, revocation); err != nil {
+		return fmt.Errorf("failed to decode CertificateRevocation %s: %v", key, err)
+	}
+	if meta.IsStatusConditionTrue(revocation.Status.Conditions, v1alpha1.ConditionRevoked) {
+		return nil
+	}
+
+	cc := c.cc
+	reason := revocation.Spec.Reason
+	if reason == "" {
+		reason = defaultManualRevocationReason
+	}
+	auditCSR := revocationAuditCSR(revocation)
+	target, err := c.resolveTarget(ctx, revocation, auditCSR)
+	if err == nil && !RevocationReasons[reason] {
+		err = &policyError{reason: "InvalidRevocationReason", message: fmt.Sprintf("%q is not an RFC 5280 revocation reason", reason)}
+	}
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		if cc.dryRun {
+			if !cc.firstDryRun(object.GetUID(), "failed/"+policyErr.reason) {
+				return nil
+			}
+			cc.recorder.Event(object, corev1.EventTypeWarning, "DryRunFailed", fmt.Sprintf("Dry run: the signer would fail this revocation: %s: %s", policyErr.reason, policyErr.message))
+			cc.recordAudit(auditCSR, nil, audit.OutcomeDryRun, policyErr.reason, policyErr.message, nil)
+			return nil
+		}
+		cc.recordAudit(auditCSR, nil, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		cc.recorder.Event(object, corev1.EventTypeWarning, policyErr.reason, policyErr.message)
+		return c.setRevoked(ctx, object, revocation, metav1.ConditionFalse, policyErr.reason, policyErr.message)
+	}
+	if err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("certificate %s issued by %s", target.serialNumber, target.issuerDN)
+	if cc.dryRun {
+		if !cc.firstDryRun(object.GetUID(), "revoked") {
+			return nil
+		}
+		cc.recorder.Event(object, corev1.EventTypeNormal, "DryRun", fmt.Sprintf("Dry run: the signer would revoke %s with reason %s", description, reason))
+		cc.recordAudit(auditCSR, target.enrollment, audit.OutcomeDryRun, reason, "", target.certificate)
+		return nil
+	}
+
+	var date string
+	if revocation.Spec.RevocationDate != nil {
+		date = revocation.Spec.RevocationDate.UTC().Format(time.RFC3339)
+	}
+	var status *ejbca.GetRevocationStatusResponse
+	err = cc.callEJBCA(ctx, target.enrollment, func(client *ejbca.Client) error {
+		if err := restRevokeCertificate(client, target.issuerDN, target.serialNumber, reason, date); err != nil {
+			return err
+		}
+		var err error
+		status, err = client.CheckRevocationStatus(target.issuerDN, target.serialNumber)
+		return err
+	})
+	if err == nil && !status.Revoked {
+		err = fmt.Errorf("EJBCA reports the certificate as not revoked: %s", status.Message)
+	}
+	if err != nil {
+		message := fmt.Sprintf("Failed to revoke %s: %v", description, err)
+		cc.recordAudit(auditCSR, target.enrollment, audit.OutcomeError, "RevocationFailed", message, target.certificate)
+		cc.recorder.Event(object, corev1.EventTypeWarning, "RevocationFailed", message)
+		if statusErr := c.setRevoked(ctx, object, revocation, metav1.ConditionFalse, "Pending", message+"; it will be retried"); statusErr != nil {
+			handlerLog.Errorf("Failed to update the status of CertificateRevocation %s: %v", key, statusErr)
+		}
+		return err
+	}
+
+	revocation.Status.SerialNumber = target.serialNumber
+	revocation.Status.IssuerDN = target.issuerDN
+	revocation.Status.Reason = status.RevocationReason
+	revokedAt, err := time.Parse(time.RFC3339, status.RevocationDate)
+	if err == nil {
+		revocation.Status.RevocationDate = &metav1.Time{Time: revokedAt}
+	} else {
+		revokedAt = time.Now()
+	}
+	cc.markIssuedCertificateRevoked(ctx, target.issuerDN, target.serialNumber, status.RevocationReason, revokedAt)
+	message := fmt.Sprintf("EJBCA revoked %s with reason %s", description, status.RevocationReason)
+	cc.recordAudit(auditCSR, target.enrollment, audit.OutcomeRevoked, status.RevocationReason, message, target.certificate)
+	cc.recorder.Event(object, corev1.EventTypeNormal, "Revoked", message)
+	return c.setRevoked(ctx, object, revocation, metav1.ConditionTrue, "Revoked", message)
+}
+
+// resolveTarget finds the certificate that a CertificateRevocation names and the connection it's
+// revoked through. Specs that can't be resolved are reported as a policyError.
+func (c *CertificateRevocationController) resolveTarget(ctx context.Context, revocation *v1alpha1.CertificateRevocation, auditCSR *certificates.CertificateSigningRequest) (*revocationTarget, error) {
+	spec := &revocation.Spec
+	set := 0
+	for _, present := range []bool{spec.CertificateSigningRequestName != "", spec.SerialNumber != "" || spec.IssuerDN != "", spec.Certificate != ""} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, &policyError{reason: "InvalidSpec", message: "exactly one of certificateSigningRequestName, serialNumber and issuerDN, or certificate must be set"}
+	}
+
+	target := &revocationTarget{enrollment: &enrollmentRequest{csr: auditCSR}}
+	switch {
+	case spec.CertificateSigningRequestName != "":
+		csr, err := c.cc.kubeClient.CertificatesV1().CertificateSigningRequests().Get(ctx, spec.CertificateSigningRequestName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, &policyError{reason: "CertificateNotFound", message: fmt.Sprintf("CSR %s doesn't exist; name the certificate by serial number and issuer DN instead", spec.CertificateSigningRequestName)}
+		} else if err != nil {
+			return nil, err
+		}
+		leaf, err := parseLeafCertificate(csr.Status.Certificate)
+		if err != nil || leaf == nil {
+			return nil, &policyError{reason: "CertificateNotFound", message: fmt.Sprintf("CSR %s has no issued certificate", csr.Name)}
+		}
+		target.issuerDN = leaf.Issuer.String()
+		target.serialNumber = fmt.Sprintf("%X", leaf.SerialNumber)
+		target.certificate = csr.Status.Certificate
+		if spec.IssuerRef == nil {
+			// the certificate is revoked through the connection the CSR was enrolled with
+			target.enrollment = &enrollmentRequest{csr: csr, namespace: csrNamespace(csr)}
+			if err = c.cc.resolveIssuer(target.enrollment); err != nil {
+				return nil, err
+			}
+			auditCSR.Spec.SignerName = csr.Spec.SignerName
+		}
+	case spec.Certificate != "":
+		block, _ := pem.Decode([]byte(spec.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, &policyError{reason: "InvalidSpec", message: "certificate must be a PEM encoded certificate"}
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, &policyError{reason: "InvalidSpec", message: fmt.Sprintf("failed to parse the certificate: %v", err)}
+		}
+		target.issuerDN = leaf.Issuer.String()
+		target.serialNumber = fmt.Sprintf("%X", leaf.SerialNumber)
+		target.certificate = pem.EncodeToMemory(block)
+	default:
+		serialNumber, ok := new(big.Int).SetString(strings.NewReplacer(":", "", " ", "").Replace(spec.SerialNumber), 16)
+		if !ok || spec.IssuerDN == "" {
+			return nil, &policyError{reason: "InvalidSpec", message: "serialNumber must be a hex serial number and requires issuerDN"}
+		}
+		target.issuerDN = spec.IssuerDN
+		target.serialNumber = fmt.Sprintf("%X", serialNumber)
+	}
+
+	if ref := spec.IssuerRef; ref != nil {
+		issuerRef := IssuerRef{Namespace: ref.Namespace, Name: ref.Name}
+		switch ref.Kind {
+		case "", v1alpha1.ClusterEJBCAIssuerKind:
+			issuerRef.Namespace = ""
+		case v1alpha1.EJBCAIssuerKind:
+			if ref.Namespace == "" {
+				return nil, &policyError{reason: "InvalidSpec", message: "issuerRef.namespace is required for an EJBCAIssuer"}
+			}
+		default:
+			return nil, &policyError{reason: "InvalidSpec", message: fmt.Sprintf("issuerRef.kind must be %s or %s", v1alpha1.EJBCAIssuerKind, v1alpha1.ClusterEJBCAIssuerKind)}
+		}
+		if c.cc.issuers == nil {
+			return nil, &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("the revocation selects %s, but issuer resources are not enabled", issuerRef)}
+		}
+		issuer, err := c.cc.issuers.Issuer(issuerRef)
+		if err != nil {
+			return nil, err
+		}
+		if issuer == nil {
+			return nil, &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("%s doesn't exist", issuerRef)}
+		}
+		target.enrollment.issuer = issuer
+		auditCSR.Spec.SignerName = issuerRef.SignerName()
+	}
+
+	if target.enrollment.issuer == nil && c.cc.endpoints == nil {
+		return nil, &policyError{reason: "IssuerNotFound", message: "the signer has no default EJBCA connection; select an EJBCAIssuer or ClusterEJBCAIssuer"}
+	}
+	return target, nil
+}
+
+// revocationAuditCSR expresses a CertificateRevocation as a CSR for the audit log. The signer name
+// is set once the connection is known.
+func revocationAuditCSR(revocation *v1alpha1.CertificateRevocation) *certificates.CertificateSigningRequest {
+	return &certificates.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        v1alpha1.CertificateRevocationKind + "/" + revocation.Name,
+			UID:         revocation.UID,
+			Annotations: revocation.Annotations,
+		},
+	}
+}
+
+// setRevoked sets the Revoked condition and writes the status if it changed.
+func (c *CertificateRevocationController) setRevoked(ctx context.Context, object *unstructured.Unstructured, revocation *v1alpha1.CertificateRevocation, status metav1.ConditionStatus, reason string, message string) error {
+	meta.SetStatusCondition(&revocation.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionRevoked,
+		Status:             status,
+		ObservedGeneration: revocation.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&revocation.Status)
+	if err != nil {
+		return err
+	}
+	if current, _, _ := unstructured.NestedMap(object.Object, "status"); equality.Semantic.DeepEqual(current, updated) {
+		return nil
+	}
+	object = object.DeepCopy()
+	object.Object["status"] = updated
+
+	resource := c.dynamicClient.Resource(v1alpha1.CertificateRevocationResource)
+	if _, err = resource.UpdateStatus(ctx, object, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update the status of CertificateRevocation %s: %v", revocation.Name, err)
+	}
+	handlerLog.Infof("Set the Revoked condition of CertificateRevocation %s to %s: %s", revocation.Name, status, message)
+	return nil
+}
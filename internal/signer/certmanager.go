@@ -0,0 +1,471 @@
+package signer
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var certificateRequestResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificaterequests"}
+
+// Condition types and Ready reasons of cert-manager CertificateRequests.
+const (
+	certificateRequestReady    = "Ready"
+	certificateRequestApproved = "Approved"
+	certificateRequestDenied   = "Denied"
+
+	reasonPending = "Pending"
+	reasonFailed  = "Failed"
+	reasonIssued  = "Issued"
+	reasonDenied  = "Denied"
+)
+
+// certificateRequest holds the fields of a cert-manager.io/v1 CertificateRequest that the signer uses.
+type certificateRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   certificateRequestSpec   `json:"spec"`
+	Status certificateRequestStatus `json:"status,omitempty"`
+}
+
+type certificateRequestSpec struct {
+	Request   []byte               `json:"request"`
+	IssuerRef certificateIssuerRef `json:"issuerRef"`
+	Duration  *metav1.Duration     `json:"duration,omitempty"`
+	Usages    []string             `json:"usages,omitempty"`
+
+	Username string              `json:"username,omitempty"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+type certificateIssuerRef struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+type certificateRequestStatus struct {
+	Conditions  []certificateRequestCondition `json:"conditions,omitempty"`
+	Certificate []byte                        `json:"certificate,omitempty"`
+	CA          []byte                        `json:"ca,omitempty"`
+	FailureTime *metav1.Time                  `json:"failureTime,omitempty"`
+}
+
+type certificateRequestCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime *metav1.Time           `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	ObservedGeneration int64                  `json:"observedGeneration,omitempty"`
+}
+
+// condition returns the condition of type conditionType, or nil if the request doesn't have it.
+func (cr *certificateRequest) condition(conditionType string) *certificateRequestCondition {
+	for i := range cr.Status.Conditions {
+		if cr.Status.Conditions[i].Type == conditionType {
+			return &cr.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// hasCondition returns true if the request has the condition with status True.
+func (cr *certificateRequest) hasCondition(conditionType string) bool {
+	c := cr.condition(conditionType)
+	return c != nil && c.Status == corev1.ConditionTrue
+}
+
+// setReady sets the Ready condition, keeping its transition time if the status doesn't change.
+func (cr *certificateRequest) setReady(status corev1.ConditionStatus, reason string, message string) {
+	now := metav1.Now()
+	ready := certificateRequestCondition{
+		Type:               certificateRequestReady,
+		Status:             status,
+		LastTransitionTime: &now,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: cr.Generation,
+	}
+	if existing := cr.condition(certificateRequestReady); existing != nil {
+		if existing.Status == status {
+			ready.LastTransitionTime = existing.LastTransitionTime
+		}
+		*existing = ready
+		return
+	}
+	cr.Status.Conditions = append(cr.Status.Conditions, ready)
+}
+
+// issuerRef returns the EJBCA issuer the request is for, or nil if it's for another issuer.
+func (cr *certificateRequest) issuerRef() *IssuerRef {
+	ref := cr.Spec.IssuerRef
+	if ref.Group != v1alpha1.GroupName {
+		return nil
+	}
+	switch ref.Kind {
+	case v1alpha1.EJBCAIssuerKind:
+		return &IssuerRef{Namespace: cr.Namespace, Name: ref.Name}
+	case v1alpha1.ClusterEJBCAIssuerKind:
+		return &IssuerRef{Name: ref.Name}
+	}
+	return nil
+}
+
+// toCSR expresses the request as a CSR for the issuer's signer name, so that it's resolved,
+// checked and enrolled exactly like a CSR.
+func (cr *certificateRequest) toCSR(ref *IssuerRef) *certificates.CertificateSigningRequest {
+	csr := &certificates.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cr.Namespace + "/" + cr.Name,
+			UID:         cr.UID,
+			Annotations: cr.Annotations,
+		},
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request:    cr.Spec.Request,
+			SignerName: ref.SignerName(),
+			Username:   cr.Spec.Username,
+			UID:        cr.Spec.UID,
+			Groups:     cr.Spec.Groups,
+		},
+	}
+	for _, usage := range cr.Spec.Usages {
+		// cert-manager and the CSR API name key usages the same way
+		csr.Spec.Usages = append(csr.Spec.Usages, certificates.KeyUsage(usage))
+	}
+	if len(cr.Spec.Extra) > 0 {
+		csr.Spec.Extra = make(map[string]certificates.ExtraValue, len(cr.Spec.Extra))
+		for key, value := range cr.Spec.Extra {
+			csr.Spec.Extra[key] = value
+		}
+	}
+	if cr.Spec.Duration != nil {
+		seconds := int32(cr.Spec.Duration.Duration / time.Second)
+		csr.Spec.ExpirationSeconds = &seconds
+	}
+	return csr
+}
+
+// CertificateRequestController signs cert-manager CertificateRequests whose issuerRef is an
+// EJBCAIssuer or ClusterEJBCAIssuer. Requests are resolved, checked and enrolled by the same code
+// as CSRs of the certificate controller, and share its throttle and audit log.
+type CertificateRequestController struct {
+	cc            *CertificateController
+	dynamicClient dynamic.Interface
+
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// NewCertificateRequestController creates a controller for cert-manager CertificateRequests that
+// enrolls them through cc. Run must be called to start it.
+func NewCertificateRequestController(cc *CertificateController, dynamicClient dynamic.Interface, resyncPeriod time.Duration) *CertificateRequestController {
+	c := &CertificateRequestController{
+		cc:            cc,
+		dynamicClient: dynamicClient,
+		factory:       dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, resyncPeriod),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "certificaterequest"),
+	}
+	c.informer = c.factory.ForResource(certificateRequestResource).Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+	})
+	return c
+}
+
+func (c *CertificateRequestController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %+v: %v", obj, err))
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers and blocks until ctx is cancelled.
+func (c *CertificateRequestController) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	signerLog.Infoln("Starting cert-manager CertificateRequest controller")
+	defer signerLog.Infoln("Shutting down cert-manager CertificateRequest controller")
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForNamedCacheSync("certificaterequest", ctx.Done(), c.informer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	<-ctx.Done()
+}
+
+func (c *CertificateRequestController) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *CertificateRequestController) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("sync %v failed with: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync signs a single CertificateRequest once cert-manager has approved it.
+func (c *CertificateRequestController) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	object := obj.(*unstructured.Unstructured)
+	cr := &certificateRequest{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, cr); err != nil {
+		return fmt.Errorf("failed to decode CertificateRequest %s: %v", key, err)
+	}
+
+	ref := cr.issuerRef()
+	if ref == nil {
+		return nil
+	}
+	if ready := cr.condition(certificateRequestReady); ready != nil &&
+		(ready.Status == corev1.ConditionTrue || ready.Reason == reasonFailed || ready.Reason == reasonDenied) {
+		c.cc.issued.Delete(cr.UID)
+		c.cc.enrollmentAttempts.Delete(cr.UID)
+		return nil
+	}
+
+	if cr.hasCondition(certificateRequestDenied) {
+		handlerLog.Infof("CertificateRequest %s was denied", key)
+		return c.fail(ctx, object, cr, reasonDenied, "The CertificateRequest was denied by an approval controller")
+	}
+	if !cr.hasCondition(certificateRequestApproved) {
+		handlerLog.Debugf("CertificateRequest %s is not approved yet", key)
+		return nil
+	}
+
+	cc := c.cc
+	csr := cr.toCSR(ref)
+	enrollment, err := cc.resolveEnrollment(csr, cr.Namespace)
+	if err == nil {
+		enrollment.limitToRequestedLifetime()
+		err = cc.checkPolicy(ctx, enrollment)
+	}
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		if cc.dryRun {
+			if !cc.firstDryRun(object.GetUID(), "failed/"+policyErr.reason) {
+				return nil
+			}
+			cc.recorder.Event(object, corev1.EventTypeWarning, "DryRunFailed", fmt.Sprintf("Dry run: the signer would fail this request: %s: %s", policyErr.reason, policyErr.message))
+			cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, policyErr.reason, policyErr.message, nil)
+			return nil
+		}
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		return c.fail(ctx, object, cr, reasonFailed, fmt.Sprintf("%s: %s", policyErr.reason, policyErr.message))
+	}
+	if err != nil {
+		if statusErr := c.pending(ctx, object, cr, err.Error()); statusErr != nil {
+			handlerLog.Errorf("Failed to update the status of CertificateRequest %s: %v", key, statusErr)
+		}
+		return err
+	}
+
+	if cc.dryRun {
+		if !cc.firstDryRun(object.GetUID(), "enrolled") {
+			return nil
+		}
+		cc.recorder.Event(object, corev1.EventTypeNormal, "DryRun", "Dry run: the signer would enroll this request with "+enrollment.describe())
+		cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, "", enrollment.describe(), nil)
+		return nil
+	}
+
+	// Like CSRs, a request whose earlier attempt may have been issued is looked up rather than
+	// enrolled again, since cert-manager doesn't expect the issuer to run a request twice
+	chain, err := cc.findIssuedCertificate(ctx, enrollment)
+	if errors.As(err, &policyErr) {
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		return c.fail(ctx, object, cr, reasonFailed, fmt.Sprintf("%s: %s", policyErr.reason, policyErr.message))
+	}
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		// Record the attempt before calling EJBCA, so a retry can find what EJBCA issued even if
+		// this process dies before the status update below completes.
+		if object, err = c.recordEnrollmentAttempt(ctx, object, enrollment); err != nil {
+			return err
+		}
+		csr.Annotations = object.GetAnnotations()
+
+		err = cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+			var err error
+			if enrollment.useEST {
+				err, chain = estEnrollCSR(client.EST, enrollment)
+			} else {
+				err, chain = restEnrollCSR(client, enrollment)
+			}
+			return err
+		})
+		var pending *approvalPendingError
+		if errors.As(err, &pending) {
+			// approval requests are only tracked for CSRs; enrolling again would create another
+			policyErr = &policyError{
+				reason:  "CAApprovalRequired",
+				message: fmt.Sprintf("EJBCA is waiting for a CA administrator to approve the enrollment (approval request %q), which isn't supported for CertificateRequests; reject the approval request in EJBCA, or issue the certificate through a CSR", pending.requestID),
+			}
+			cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+			return c.fail(ctx, object, cr, reasonFailed, fmt.Sprintf("%s: %s", policyErr.reason, policyErr.message))
+		}
+		if err != nil {
+			cc.recordAudit(csr, enrollment, audit.OutcomeError, "EnrollmentFailed", err.Error(), nil)
+			if statusErr := c.pending(ctx, object, cr, fmt.Sprintf("Enrollment with EJBCA failed and will be retried: %v", err)); statusErr != nil {
+				handlerLog.Errorf("Failed to update the status of CertificateRequest %s: %v", key, statusErr)
+			}
+			return err
+		}
+		cc.issued.Store(cr.UID, chain)
+		cc.recordAudit(csr, enrollment, audit.OutcomeIssued, "", "", chain)
+	}
+	if err = cc.verifyIssued(ctx, enrollment, chain); errors.As(err, &policyErr) {
+		if err = c.fail(ctx, object, cr, reasonFailed, fmt.Sprintf("%s: %s", policyErr.reason, policyErr.message)); err != nil {
+			return err
+		}
+		cc.issued.Delete(cr.UID)
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, chain)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cc.recordIssuedCertificate(ctx, v1alpha1.IssuedCertificateSource{Kind: sourceCertificateRequest, Namespace: cr.Namespace, Name: cr.Name, UID: string(cr.UID)}, csr, enrollment, chain)
+
+	cr.Status.Certificate = chain
+	cr.Status.CA = lastCertificate(chain)
+	cr.setReady(corev1.ConditionTrue, reasonIssued, "Certificate issued by "+enrollment.describe())
+	if err = c.updateStatus(ctx, object, cr); err != nil {
+		return err
+	}
+	cc.issued.Delete(cr.UID)
+	cc.recorder.Event(object, corev1.EventTypeNormal, reasonIssued, "Certificate issued by EJBCA")
+	handlerLog.Infof("Issued the certificate of CertificateRequest %s", key)
+	return nil
+}
+
+// recordEnrollmentAttempt annotates the CertificateRequest with the time and end entity of the
+// enrollment that is about to be sent to EJBCA, as is done for CSRs. EJBCA must not be called if
+// this fails. The updated object is returned.
+func (c *CertificateRequestController) recordEnrollmentAttempt(ctx context.Context, object *unstructured.Unstructured, enrollment *enrollmentRequest) (*unstructured.Unstructured, error) {
+	client := c.dynamicClient.Resource(certificateRequestResource).Namespace(object.GetNamespace())
+	var updated *unstructured.Unstructured
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := client.Get(ctx, object.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.GetUID() != object.GetUID() {
+			return fmt.Errorf("CertificateRequest %s/%s was replaced", object.GetNamespace(), object.GetName())
+		}
+		annotations := current.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		setEnrollmentAttempt(annotations, current.GetUID(), enrollment)
+		current.SetAnnotations(annotations)
+		updated, err = client.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record enrollment attempt on CertificateRequest %s/%s: %v", object.GetNamespace(), object.GetName(), err)
+	}
+	c.cc.enrollmentAttempts.Store(object.GetUID(), struct{}{})
+	return updated, nil
+}
+
+// fail sets the Ready condition to False with a final reason, after which cert-manager doesn't
+// expect the issuer to act on the request again.
+func (c *CertificateRequestController) fail(ctx context.Context, object *unstructured.Unstructured, cr *certificateRequest, reason string, message string) error {
+	now := metav1.Now()
+	cr.Status.FailureTime = &now
+	cr.setReady(corev1.ConditionFalse, reason, message)
+	if err := c.updateStatus(ctx, object, cr); err != nil {
+		return err
+	}
+	c.cc.recorder.Event(object, corev1.EventTypeWarning, reason, message)
+	return nil
+}
+
+// pending reports a problem that will be retried in the Ready condition.
+func (c *CertificateRequestController) pending(ctx context.Context, object *unstructured.Unstructured, cr *certificateRequest, message string) error {
+	if ready := cr.condition(certificateRequestReady); ready != nil && ready.Reason == reasonPending && ready.Message == message {
+		return nil
+	}
+	cr.setReady(corev1.ConditionFalse, reasonPending, message)
+	return c.updateStatus(ctx, object, cr)
+}
+
+// updateStatus writes the status of cr to the CertificateRequest.
+func (c *CertificateRequestController) updateStatus(ctx context.Context, object *unstructured.Unstructured, cr *certificateRequest) error {
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&cr.Status)
+	if err != nil {
+		return err
+	}
+	object = object.DeepCopy()
+	object.Object["status"] = status
+	_, err = c.dynamicClient.Resource(certificateRequestResource).Namespace(cr.Namespace).UpdateStatus(ctx, object, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update the status of CertificateRequest %s/%s: %v", cr.Namespace, cr.Name, err)
+	}
+	return nil
+}
+
+// lastCertificate returns the last certificate of a PEM chain, which is the CA closest to the root
+// that EJBCA returned, or nil if the chain only holds the leaf.
+func lastCertificate(chain []byte) []byte {
+	var last *pem.Block
+	count := 0
+	for rest := chain; ; count++ {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		last = block
+	}
+	if count < 2 {
+		return nil
+	}
+	return pem.EncodeToMemory(last)
+}
@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestCertificateRequestRecordEnrollmentAttempt(t *testing.T) {
+	object := &unstructured.Unstructured{}
+	object.SetAPIVersion("cert-manager.io/v1")
+	object.SetKind("CertificateRequest")
+	object.SetNamespace("team-a")
+	object.SetName("web-1")
+	object.SetUID("uid")
+	object.SetAnnotations(map[string]string{"cert-manager.io/certificate-name": "web"})
+
+	scheme := runtime.NewScheme()
+	listKinds := map[schema.GroupVersionResource]string{certificateRequestResource: "CertificateRequestList"}
+	c := &CertificateRequestController{
+		cc:            &CertificateController{},
+		dynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme, listKinds, object.DeepCopy()),
+	}
+
+	updated, err := c.recordEnrollmentAttempt(context.Background(), object, &enrollmentRequest{username: "web.team-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := updated.GetAnnotations()
+	if annotations["cert-manager.io/certificate-name"] != "web" {
+		t.Errorf("annotations of the request were not kept: %v", annotations)
+	}
+	if annotations[annotationEndEntityUsername] != "web.team-a" {
+		t.Errorf("end entity username = %q, want %q", annotations[annotationEndEntityUsername], "web.team-a")
+	}
+
+	// the attempt is found on the CSR the request is enrolled as
+	cr := &certificateRequest{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, cr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := enrollmentStarted(cr.toCSR(&IssuerRef{Namespace: "team-a", Name: "team-a"})); !ok {
+		t.Errorf("the enrollment attempt recorded on the request isn't found")
+	}
+	if _, ok := c.cc.enrollmentAttempts.Load(object.GetUID()); !ok {
+		t.Errorf("the enrollment attempt isn't remembered")
+	}
+}
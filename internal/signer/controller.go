@@ -3,20 +3,27 @@ package signer
 import (
 	"context"
 	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
 	"golang.org/x/time/rate"
 
 	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	certificatesinformers "k8s.io/client-go/informers/certificates/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	certificateslisters "k8s.io/client-go/listers/certificates/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -35,18 +42,147 @@ type CertificateController struct {
 	csrLister  certificateslisters.CertificateSigningRequestLister
 	csrsSynced cache.InformerSynced
 
+	namespaceLister  corelisters.NamespaceLister
+	namespacesSynced cache.InformerSynced
+	issuersSynced    cache.InformerSynced
+
 	handler func(context.Context, *certificates.CertificateSigningRequest) error
 
 	queue workqueue.RateLimitingInterface
 
-	ejbcaClient *ejbca.Client
+	endpoints *EndpointPool
+	throttle  *enrollmentThrottle
+	issuers   IssuerResolver
+
+	recorder  record.EventRecorder
+	auditor   *audit.Logger
+	inventory dynamic.Interface
+	// inventoryRetention is how long IssuedCertificates are kept after their certificate expired.
+	inventoryRetention time.Duration
+	// inventoryQueue retries IssuedCertificates that couldn't be created, whose contents are held
+	// in pendingInventory by name.
+	inventoryQueue   workqueue.RateLimitingInterface
+	pendingInventory sync.Map
+
+	cacheSyncTimeout  time.Duration
+	signerNames       []string
+	policies          map[string]*SignerPolicy
+	defaults          EnrollmentDefaults
+	useEST            bool
+	dryRun            bool
+	authorizeProfiles bool
+
+	verifySANOwnership bool
+	clusterDomain      string
+
+	// issued holds chains issued by EJBCA, keyed by CSR UID, until they are written to the CSR
+	// status, so that a failed status update is retried without enrolling again.
+	issued sync.Map
+	// pendingApprovals holds the enrollments EJBCA accepted for approval, keyed by CSR UID, until
+	// their annotations and approval Secret are written, so that the CSR isn't enrolled again.
+	pendingApprovals sync.Map
+	// enrollmentAttempts holds the UIDs of the CSRs this process recorded an enrollment attempt
+	// for, to tell the attempts it saw fail from those interrupted by a restart.
+	enrollmentAttempts sync.Map
+	// dryRunDecisions holds the dry-run decisions already recorded, so that each is recorded once.
+	dryRunDecisions sync.Map
+	// approvalPollInterval is how often enrollments waiting for approval are finalized.
+	approvalPollInterval time.Duration
+	// approvalNamespace is the namespace the passwords of enrollments waiting for approval are
+	// stored in.
+	approvalNamespace string
+}
+
+// ControllerOptions tunes how the controller waits for its cache and retries failed CSRs.
+type ControllerOptions struct {
+	// CacheSyncTimeout bounds how long Run waits for the CSR informer to sync.
+	CacheSyncTimeout time.Duration
+
+	// RetryBaseDelay and RetryMaxDelay bound the per-item exponential backoff.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// RetryQPS and RetryBurst configure the overall bucket limiter shared by all items.
+	RetryQPS   float64
+	RetryBurst int
+
+	// SignerNames are the spec.signerName values handled by this controller. A name ending
+	// in "/*" matches every signer name in that domain.
+	SignerNames []string
+
+	// Policies apply a mode and fixed EJBCA settings to individual signer names. Their signer
+	// names are handled even if SignerNames doesn't match them.
+	Policies []SignerPolicy
+
+	// Defaults are used when a CSR doesn't select a CA, profile or EST alias with annotations.
+	Defaults EnrollmentDefaults
+
+	// UseEST enrolls CSRs with the EJBCA EST interface instead of the REST API.
+	UseEST bool
+
+	// DryRun evaluates CSRs without enrolling them with EJBCA or writing their status.
+	DryRun bool
+
+	// NamespaceInformer enables namespace defaults and restrictions for CSRs requested by
+	// service accounts. They are disabled if it's nil.
+	NamespaceInformer coreinformers.NamespaceInformer
+
+	// VerifySANOwnership fails CSRs requested by service accounts whose DNS or IP SANs don't
+	// belong to a Service, Ingress, Pod or external domain of the service account's namespace.
+	VerifySANOwnership bool
+
+	// ClusterDomain is the DNS domain of the cluster, used to match Service names.
+	ClusterDomain string
+
+	// AuthorizeProfiles requires the requester of a CSR to be allowed, by a SubjectAccessReview,
+	// to use the CA, profiles or EST alias it would be enrolled with.
+	AuthorizeProfiles bool
+
+	// Issuers resolves the EJBCAIssuer and ClusterEJBCAIssuer resources that CSRs select by
+	// annotation or signer name. Issuer resources are disabled if it's nil.
+	Issuers IssuerResolver
+
+	// Auditor records every issuance decision. A nil Auditor discards them.
+	Auditor *audit.Logger
+
+	// Inventory creates an IssuedCertificate for every certificate EJBCA issues. The inventory
+	// is disabled if it's nil.
+	Inventory dynamic.Interface
+	// InventoryRetention is how long an IssuedCertificate is kept after its certificate expired.
+	// Zero keeps them.
+	InventoryRetention time.Duration
+
+	// EJBCAQPS and EJBCABurst cap the overall rate of calls to EJBCA. Zero disables the limit.
+	EJBCAQPS   float64
+	EJBCABurst int
+
+	// MaxConcurrentEnrollmentsPerCA bounds the enrollments in flight for each CA or EST alias.
+	// Zero disables the limit.
+	MaxConcurrentEnrollmentsPerCA int
+
+	// ApprovalPollInterval is how often enrollments waiting for approval by a CA administrator
+	// in EJBCA are finalized.
+	ApprovalPollInterval time.Duration
+
+	// ApprovalNamespace is the namespace of the Secrets that keep the end entity passwords of
+	// enrollments waiting for approval, usually the one the signer runs in.
+	ApprovalNamespace string
+}
+
+// EnrollmentDefaults are the EJBCA settings used when a CSR has no overriding annotation.
+type EnrollmentDefaults struct {
+	CertificateAuthorityName string
+	CertificateProfileName   string
+	EndEntityProfileName     string
+	ESTAlias                 string
 }
 
 func NewCertificateController(
 	name string,
 	kubeClient clientset.Interface,
 	csrInformer certificatesinformers.CertificateSigningRequestInformer,
-	ejbcaClient *ejbca.Client,
+	endpoints *EndpointPool,
+	opts ControllerOptions,
 ) *CertificateController {
 	signerLog.Infof("Creating new Certificate Controller called '%s'", name)
 
@@ -59,11 +195,30 @@ func NewCertificateController(
 		name:       name,
 		kubeClient: kubeClient,
 		queue: workqueue.NewNamedRateLimitingQueue(workqueue.NewMaxOfRateLimiter(
-			workqueue.NewItemExponentialFailureRateLimiter(200*time.Millisecond, 1000*time.Second),
-			// 10 qps, 100 bucket size.  This is only for retry speed and its only the overall factor (not per item)
-			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+			workqueue.NewItemExponentialFailureRateLimiter(opts.RetryBaseDelay, opts.RetryMaxDelay),
+			// This is only for retry speed and its only the overall factor (not per item)
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(opts.RetryQPS), opts.RetryBurst)},
 		), "certificate"),
-		ejbcaClient: ejbcaClient,
+		endpoints:          endpoints,
+		throttle:           newEnrollmentThrottle(opts.EJBCAQPS, opts.EJBCABurst, opts.MaxConcurrentEnrollmentsPerCA),
+		recorder:           eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: name}),
+		cacheSyncTimeout:   opts.CacheSyncTimeout,
+		signerNames:        opts.SignerNames,
+		policies:           make(map[string]*SignerPolicy),
+		defaults:           opts.Defaults,
+		useEST:             opts.UseEST,
+		dryRun:             opts.DryRun,
+		authorizeProfiles:  opts.AuthorizeProfiles,
+		verifySANOwnership: opts.VerifySANOwnership,
+		clusterDomain:      opts.ClusterDomain,
+		auditor:            opts.Auditor,
+		inventory:          opts.Inventory,
+		inventoryRetention: opts.InventoryRetention,
+		inventoryQueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "issuedcertificate"),
+		issuers:            opts.Issuers,
+
+		approvalPollInterval: opts.ApprovalPollInterval,
+		approvalNamespace:    opts.ApprovalNamespace,
 	}
 
 	// Manage the addition/update of certificate requests
@@ -93,56 +248,113 @@ func NewCertificateController(
 				}
 			}
 			signerLog.Infof("Deleting certificate request %s", csr.Name)
+			cc.pendingApprovals.Delete(csr.UID)
+			cc.forgetDryRuns(csr.UID)
+			cc.enrollmentAttempts.Delete(csr.UID)
 			cc.enqueueCertificateRequest(obj)
 		},
 	})
 
+	for i := range opts.Policies {
+		policy := opts.Policies[i]
+		cc.policies[policy.SignerName] = &policy
+	}
+
 	cc.handler = cc.handleRequests
 	cc.csrLister = csrInformer.Lister()
 	cc.csrsSynced = csrInformer.Informer().HasSynced
+	cc.namespacesSynced = func() bool { return true }
+	if opts.NamespaceInformer != nil {
+		cc.namespaceLister = opts.NamespaceInformer.Lister()
+		cc.namespacesSynced = opts.NamespaceInformer.Informer().HasSynced
+	}
+	cc.issuersSynced = func() bool { return true }
+	if opts.Issuers != nil {
+		cc.issuersSynced = opts.Issuers.HasSynced
+	}
 
 	signerLog.Tracef("Finished configuring Certificate Controller called '%s'", name)
 	return cc
 }
 
-// Run the main goroutine responsible for watching and syncing jobs.
-func (cc *CertificateController) Run(ctx context.Context, workers int) {
+// Run the main goroutine responsible for watching and syncing jobs. Once ctx is cancelled, Run stops
+// taking new CSRs off the queue and waits up to gracePeriod for in-flight enrollments to finish. An
+// error is returned if the caches never synced or the workers did not drain in time.
+func (cc *CertificateController) Run(ctx context.Context, workers int, gracePeriod time.Duration) error {
 	defer utilruntime.HandleCrash()
 	defer cc.queue.ShutDown()
 
 	signerLog.Infof("Starting certificate controller %q", cc.name)
 	defer signerLog.Infof("Shutting down certificate controller %q", cc.name)
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*60)
+	timeoutCtx, cancel := context.WithTimeout(ctx, cc.cacheSyncTimeout)
 	defer cancel()
-	if !cache.WaitForNamedCacheSync(fmt.Sprintf("certificate-%s", cc.name), timeoutCtx.Done(), cc.csrsSynced) {
-		return
+	if !cache.WaitForNamedCacheSync(fmt.Sprintf("certificate-%s", cc.name), timeoutCtx.Done(), cc.csrsSynced, cc.namespacesSynced, cc.issuersSynced) {
+		return fmt.Errorf("timed out waiting for caches to sync for %s", cc.name)
 	}
 
+	// Enrollments and status updates run with their own context so that a shutdown signal doesn't
+	// abort a request that EJBCA has already issued. It's only cancelled once the grace period expires.
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
-		go wait.UntilWithContext(ctx, cc.worker, time.Second)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { cc.worker(ctx, workCtx) }, time.Second, ctx.Done())
+		}()
+	}
+
+	if cc.inventory != nil {
+		go cc.runInventory(ctx)
 	}
 
 	signerLog.Infof("Certificate controller started for %s", cc.name)
 
 	<-ctx.Done()
+
+	signerLog.Infof("Draining in-flight certificate requests for %s (grace period %v)", cc.name, gracePeriod)
+	cc.queue.ShutDown()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		signerLog.Infof("All in-flight certificate requests for %s finished", cc.name)
+		return nil
+	case <-time.After(gracePeriod):
+		cancelWork()
+		return fmt.Errorf("grace period of %v expired before in-flight certificate requests finished", gracePeriod)
+	}
 }
 
 // worker runs a thread that dequeues CSRs, handles them, and marks them done.
-func (cc *CertificateController) worker(ctx context.Context) {
-	for cc.processNextWorkItem(ctx) {
+func (cc *CertificateController) worker(ctx context.Context, workCtx context.Context) {
+	for cc.processNextWorkItem(ctx, workCtx) {
 	}
 }
 
 // processNextWorkItem deals with one key off the queue.  It returns false when it's time to quit.
-func (cc *CertificateController) processNextWorkItem(ctx context.Context) bool {
+func (cc *CertificateController) processNextWorkItem(ctx context.Context, workCtx context.Context) bool {
 	cKey, quit := cc.queue.Get()
 	if quit {
 		return false
 	}
 	defer cc.queue.Done(cKey)
 
-	if err := cc.syncFunc(ctx, cKey.(string)); err != nil {
+	// Don't start new work once shutdown has begun. Anything left on the queue is picked up
+	// again by the informer when the next instance starts.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err := cc.syncFunc(workCtx, cKey.(string)); err != nil {
 		cc.queue.AddRateLimited(cKey)
 		if _, ignorable := err.(ignorableError); !ignorable {
 			utilruntime.HandleError(fmt.Errorf("Sync %v failed with : %v", cKey, err))
@@ -181,8 +393,27 @@ func (cc *CertificateController) syncFunc(ctx context.Context, key string) error
 		return err
 	}
 
+	if !cc.handlesSignerName(csr.Spec.SignerName) {
+		signerLog.Tracef("Ignoring certificate request %s for signer %s", csr.Name, csr.Spec.SignerName)
+		return nil
+	}
+
+	if csr.DeletionTimestamp != nil {
+		// a dry-run signer leaves revocation to the signer that issued the certificate
+		if hasFinalizer(csr, finalizerRevokeOnDelete) && !cc.dryRun {
+			return cc.revokeDeleted(ctx, csr.DeepCopy())
+		}
+		return nil
+	}
+
 	if len(csr.Status.Certificate) > 0 {
 		// no need to do anything because it already has a cert
+		cc.issued.Delete(csr.UID)
+		return nil
+	}
+
+	if hasFailedCondition(csr) {
+		// the signer already gave up on this request
 		return nil
 	}
 
@@ -191,6 +422,36 @@ func (cc *CertificateController) syncFunc(ctx context.Context, key string) error
 	return cc.handler(ctx, csr)
 }
 
+// hasFailedCondition returns true if the CSR has the Failed condition.
+func hasFailedCondition(csr *certificates.CertificateSigningRequest) bool {
+	for _, c := range csr.Status.Conditions {
+		if c.Type == certificates.CertificateFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// handlesSignerName returns true if signerName matches one of the controller's signer names, has
+// a policy or selects an issuer.
+func (cc *CertificateController) handlesSignerName(signerName string) bool {
+	if _, ok := cc.policies[signerName]; ok {
+		return true
+	}
+	if cc.issuers != nil && isIssuerSignerName(signerName) {
+		return true
+	}
+	for _, name := range cc.signerNames {
+		if name == signerName {
+			return true
+		}
+		if domain := strings.TrimSuffix(name, "*"); domain != name && strings.HasSuffix(domain, "/") && strings.HasPrefix(signerName, domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // IgnorableError returns an error that we shouldn't handle (i.e. log) because
 // it's spammy and usually user error. Instead we will log these errors at a
 // higher log level. We still need to throw these errors to signal that the
@@ -0,0 +1,105 @@
+package signer
+
+import (
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"github.com/sirupsen/logrus"
+	"strings"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	dryRunEvaluations = metrics.NewCounterVec(
+		"ejbca_signer_dry_run_evaluations_total",
+		"Number of certificate requests evaluated in dry-run mode, by the outcome the signer would have produced.",
+		"signer_name", "outcome", "certificate_authority", "certificate_profile", "end_entity_profile",
+	)
+)
+
+// firstDryRun returns true the first time a dry-run decision is made for the object with uid, so
+// that resyncs and updates of the object don't record it again. A changed decision, such as a
+// different failure reason, is recorded once more.
+func (cc *CertificateController) firstDryRun(uid types.UID, decision string) bool {
+	_, seen := cc.dryRunDecisions.LoadOrStore(string(uid)+"/"+decision, struct{}{})
+	return !seen
+}
+
+// forgetDryRuns drops the dry-run decisions recorded for the object with uid once it's deleted.
+func (cc *CertificateController) forgetDryRuns(uid types.UID) {
+	cc.dryRunDecisions.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), string(uid)+"/") {
+			cc.dryRunDecisions.Delete(key)
+		}
+		return true
+	})
+}
+
+// recordDryRun records what the signer would have done with a CSR, in place of enrolling it.
+// Nothing is sent to EJBCA and the CSR status is never written, so a dry-run signer can run
+// alongside the signer that actually issues the certificates. If policyErr is set the CSR
+// would have been failed, and enrollment may be nil. Each decision is recorded once per CSR, and
+// false is returned if it already was.
+func (cc *CertificateController) recordDryRun(csr *certificates.CertificateSigningRequest, enrollment *enrollmentRequest, policyErr *policyError) bool {
+	decision := "enrolled"
+	if policyErr != nil {
+		decision = "failed/" + policyErr.reason
+	}
+	if !cc.firstDryRun(csr.UID, decision) {
+		return false
+	}
+
+	fields := logrus.Fields{
+		"csr":        csr.Name,
+		"signerName": csr.Spec.SignerName,
+		"requester":  csr.Spec.Username,
+	}
+	var ca, certificateProfile, endEntityProfile string
+	if enrollment != nil {
+		ca = enrollment.certificateAuthorityName
+		certificateProfile = enrollment.certificateProfileName
+		endEntityProfile = enrollment.endEntityProfileName
+
+		fields["subject"] = enrollment.request.Subject.String()
+		fields["dnsNames"] = enrollment.request.DNSNames
+		fields["ipAddresses"] = enrollment.request.IPAddresses
+		fields["username"] = enrollment.username
+		if enrollment.useEST {
+			fields["method"] = "EST"
+			fields["estAlias"] = enrollment.estAlias
+		} else {
+			fields["method"] = "REST"
+			fields["certificateAuthorityName"] = ca
+			fields["certificateProfileName"] = certificateProfile
+			fields["endEntityProfileName"] = endEntityProfile
+		}
+	}
+
+	if policyErr != nil {
+		dryRunEvaluations.Inc(csr.Spec.SignerName, "failed", ca, certificateProfile, endEntityProfile)
+		fields["reason"] = policyErr.reason
+		handlerLog.WithFields(fields).Infof("Dry run: would fail certificate request: %s", policyErr.message)
+		cc.recorder.Eventf(csr, corev1.EventTypeWarning, "DryRunFailed", "Dry run: the signer would fail this request: %s", policyErr)
+		return true
+	}
+
+	dryRunEvaluations.Inc(csr.Spec.SignerName, "enrolled", ca, certificateProfile, endEntityProfile)
+	handlerLog.WithFields(fields).Infoln("Dry run: would enroll certificate request with EJBCA")
+	cc.recorder.Event(csr, corev1.EventTypeNormal, "DryRun", "Dry run: the signer would enroll this request with "+enrollment.describe())
+	return true
+}
+
+// describe summarises where the enrollment would be sent, for events and logs.
+func (e *enrollmentRequest) describe() string {
+	var via string
+	if e.issuer != nil {
+		via = " of " + e.issuer.Ref.String()
+	}
+	if e.useEST {
+		return fmt.Sprintf("EJBCA EST alias %q%s as %q", e.estAlias, via, e.request.Subject.String())
+	}
+	return fmt.Sprintf("EJBCA CA %q%s, certificate profile %q and end entity profile %q as end entity %q",
+		e.certificateAuthorityName, via, e.certificateProfileName, e.endEntityProfileName, e.username)
+}
@@ -0,0 +1,250 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/circuit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	endpointHealthy = metrics.NewGaugeVec(
+		"ejbca_signer_endpoint_healthy",
+		"Whether the last background health check of an EJBCA endpoint succeeded (1) or failed (0).",
+		"endpoint",
+	)
+	endpointFailovers = metrics.NewCounterVec(
+		"ejbca_signer_endpoint_failovers_total",
+		"Number of times a call failed over from an EJBCA endpoint to the next one.",
+		"endpoint",
+	)
+)
+
+// Endpoint is a single EJBCA node the signer can call.
+type Endpoint struct {
+	Hostname string
+	// Weight is the relative share of calls sent to the endpoint. If no endpoint in a pool has
+	// a weight, endpoints are tried in order.
+	Weight  int
+	Client  *ejbca.Client
+	Breaker *circuit.Breaker
+}
+
+// EndpointPool routes calls to the healthy EJBCA endpoints of an issuer and fails over between
+// them when it is known that the failed endpoint didn't act on the request.
+type EndpointPool struct {
+	endpoints []*Endpoint
+	weighted  bool
+
+	useEST   bool
+	estAlias string
+	interval time.Duration
+
+	lock      sync.Mutex
+	unhealthy map[*Endpoint]bool
+	random    *rand.Rand
+}
+
+// NewEndpointPool creates a pool of endpoints. Run must be called to health-check them every
+// interval; until the first check every endpoint is treated as healthy. The health check uses
+// the EST cacerts operation for estAlias if useEST is set, and the REST API status otherwise.
+func NewEndpointPool(endpoints []*Endpoint, useEST bool, estAlias string, interval time.Duration) *EndpointPool {
+	p := &EndpointPool{
+		endpoints: endpoints,
+		useEST:    useEST,
+		estAlias:  estAlias,
+		interval:  interval,
+		unhealthy: make(map[*Endpoint]bool),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Weight > 0 {
+			p.weighted = true
+		}
+		endpointHealthy.Set(1, endpoint.Hostname)
+	}
+	return p
+}
+
+// Run health-checks every endpoint until ctx is cancelled. A nil pool returns immediately.
+func (p *EndpointPool) Run(ctx context.Context) {
+	if p == nil || p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check health-checks every endpoint once, and returns an error if none of them is healthy.
+func (p *EndpointPool) Check() error {
+	var lastErr error
+	for _, endpoint := range p.endpoints {
+		if err := p.check(endpoint); err != nil {
+			lastErr = err
+		}
+	}
+	err := p.Ready()
+	if err != nil && lastErr != nil {
+		return fmt.Errorf("%v: %v", err, lastErr)
+	}
+	return err
+}
+
+// check health-checks a single endpoint and returns the error that made it unhealthy. Only
+// transport errors and 5xx answers mark it unhealthy, so that an account without access to the
+// status resource doesn't take every endpoint out.
+func (p *EndpointPool) check(endpoint *Endpoint) error {
+	var err error
+	if p.useEST {
+		_, err = endpoint.Client.EST.CaCerts(p.estAlias)
+	} else {
+		_, err = endpoint.Client.GetV1CertificateStatus()
+	}
+	err = asStatusError(err)
+	healthy := err == nil || !IsEndpointFailure(err)
+	if healthy {
+		err = nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if healthy == !p.unhealthy[endpoint] {
+		return err
+	}
+	if healthy {
+		signerLog.Infof("EJBCA endpoint %s is healthy again", endpoint.Hostname)
+		delete(p.unhealthy, endpoint)
+		endpointHealthy.Set(1, endpoint.Hostname)
+	} else {
+		signerLog.Warnf("EJBCA endpoint %s failed its health check: %v", endpoint.Hostname, err)
+		p.unhealthy[endpoint] = true
+		endpointHealthy.Set(0, endpoint.Hostname)
+	}
+	return err
+}
+
+// candidates returns the endpoints that are healthy and whose breaker isn't open, in the order
+// they should be tried. Weighted pools are ordered by weighted random selection.
+func (p *EndpointPool) candidates() []*Endpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var available []*Endpoint
+	for _, endpoint := range p.endpoints {
+		if !p.unhealthy[endpoint] && endpoint.Breaker.State() != circuit.Open {
+			available = append(available, endpoint)
+		}
+	}
+	if !p.weighted {
+		return available
+	}
+
+	ordered := make([]*Endpoint, 0, len(available))
+	for len(available) > 0 {
+		total := 0
+		for _, endpoint := range available {
+			total += endpoint.Weight
+		}
+		i := 0
+		if total > 0 {
+			for n := p.random.Intn(total); n >= available[i].Weight; i++ {
+				n -= available[i].Weight
+			}
+		}
+		ordered = append(ordered, available[i])
+		available = append(available[:i], available[i+1:]...)
+	}
+	return ordered
+}
+
+// Ready returns an error if no endpoint is available, for use as a readiness check.
+func (p *EndpointPool) Ready() error {
+	if p == nil {
+		return nil
+	}
+	if len(p.candidates()) == 0 {
+		return errors.New("no EJBCA endpoint is healthy")
+	}
+	return nil
+}
+
+// call runs fn against the available endpoints in turn, through each endpoint's circuit breaker.
+// It only moves on to the next endpoint if the error shows the request never reached EJBCA or
+// EJBCA rejected it without acting on it, so that a request is never issued twice. EJBCA JSON
+// errors are returned as a StatusError.
+func (p *EndpointPool) call(fn func(*ejbca.Client) error) error {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return errors.New("no EJBCA endpoint is available")
+	}
+
+	var err error
+	for i, endpoint := range candidates {
+		err = endpoint.Breaker.Call(func() error { return asStatusError(fn(endpoint.Client)) })
+		if err == nil || !canFailOver(err) {
+			return err
+		}
+		if i < len(candidates)-1 {
+			signerLog.Warnf("EJBCA endpoint %s failed before acting on the request; failing over to %s: %v", endpoint.Hostname, candidates[i+1].Hostname, err)
+			endpointFailovers.Inc(endpoint.Hostname)
+		}
+	}
+	return err
+}
+
+// canFailOver returns true if err proves that the request never reached EJBCA: the breaker
+// rejected it, the connection, DNS lookup or TLS handshake failed, or EJBCA itself answered that
+// it's unavailable with a 503. Other 5xx answers, and 502 or 504 from a gateway in front of
+// EJBCA, may come after EJBCA issued, as may a timeout while waiting for the response, so they
+// return false.
+func canFailOver(err error) bool {
+	if errors.Is(err, circuit.ErrOpen) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &dnsErr) || errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return true
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// String lists the endpoints of the pool.
+func (p *EndpointPool) String() string {
+	var hostnames []string
+	for _, endpoint := range p.endpoints {
+		hostnames = append(hostnames, endpoint.Hostname)
+	}
+	return fmt.Sprintf("%v", hostnames)
+}
@@ -0,0 +1,288 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	certificateExpiryDays = metrics.NewGaugeVec(
+		"ejbca_signer_certificate_expiry_days",
+		"Days until a certificate issued by the signer expires, for certificates within the largest expiry window.",
+		"serial_number", "issuer_dn", "subject", "namespace", "source_kind", "source_name",
+	)
+	expiryChecks = metrics.NewCounterVec(
+		"ejbca_signer_expiry_checks_total",
+		"Number of searches for expiring certificates per EJBCA connection, by result.",
+		"connection", "result",
+	)
+)
+
+// ExpiryMonitorOptions configure the search for expiring certificates.
+type ExpiryMonitorOptions struct {
+	// Interval is how often EJBCA is searched.
+	Interval time.Duration
+	// Windows are the days before expiry at which a warning Event is emitted.
+	Windows []int
+	// PageSize is the number of certificates requested from EJBCA at a time.
+	PageSize int
+}
+
+// ExpiryMonitor periodically pages through the certificates that EJBCA reports as expiring within
+// the largest window, matches them to the IssuedCertificates of the inventory, exports how many
+// days they have left and warns their requesters as they enter each window.
+type ExpiryMonitor struct {
+	cc            *CertificateController
+	dynamicClient dynamic.Interface
+	opts          ExpiryMonitorOptions
+
+	lock sync.Mutex
+	// notified holds the smallest window each certificate was reported in, by IssuedCertificate name.
+	notified map[string]int
+	// series holds the label values of the gauges exported by the last search.
+	series map[string][]string
+}
+
+// NewExpiryMonitor creates a monitor that searches the connections of cc and looks certificates
+// up in the inventory with dynamicClient. Run must be called to start it.
+func NewExpiryMonitor(cc *CertificateController, dynamicClient dynamic.Interface, opts ExpiryMonitorOptions) *ExpiryMonitor {
+	windows := append([]int{}, opts.Windows...)
+	sort.Ints(windows)
+	opts.Windows = windows
+	return &ExpiryMonitor{
+		cc:            cc,
+		dynamicClient: dynamicClient,
+		opts:          opts,
+		notified:      make(map[string]int),
+		series:        make(map[string][]string),
+	}
+}
+
+// Run searches for expiring certificates every interval until ctx is cancelled.
+func (m *ExpiryMonitor) Run(ctx context.Context) {
+	if len(m.opts.Windows) == 0 || m.opts.Interval <= 0 {
+		return
+	}
+	signerLog.Infof("Starting expiry monitor with windows of %v days", m.opts.Windows)
+	defer signerLog.Infoln("Shutting down expiry monitor")
+
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Check(ctx); err != nil {
+			signerLog.Errorf("Failed to search for expiring certificates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check searches every REST connection for expiring certificates once and updates the metrics
+// and Events of those the signer issued. Connections that fail are skipped and reported in the
+// returned error, and the metrics of certificates that weren't found are only removed after a
+// search without errors.
+func (m *ExpiryMonitor) Check(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var errs []string
+	seen := make(map[string]bool)
+	for name, enrollment := range m.connections() {
+		certs, err := m.expiring(ctx, name, enrollment)
+		if err != nil {
+			expiryChecks.Inc(name, "failed")
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		expiryChecks.Inc(name, "succeeded")
+		for _, leaf := range certs {
+			issuedName := issuedCertificateName(leaf.Issuer.String(), fmt.Sprintf("%X", leaf.SerialNumber))
+			if seen[issuedName] {
+				continue
+			}
+			tracked, err := m.observe(ctx, issuedName, leaf)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			// keep the state of certificates that couldn't be looked up
+			seen[issuedName] = tracked || err != nil
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	for name, labels := range m.series {
+		if !seen[name] {
+			certificateExpiryDays.Delete(labels...)
+			delete(m.series, name)
+		}
+	}
+	for name := range m.notified {
+		if !seen[name] {
+			delete(m.notified, name)
+		}
+	}
+	return nil
+}
+
+// connections returns the REST connections that are searched, by name. EST has no API to list
+// certificates.
+func (m *ExpiryMonitor) connections() map[string]*enrollmentRequest {
+	connections := make(map[string]*enrollmentRequest)
+	if m.cc.endpoints != nil && !m.cc.useEST {
+		connections["default"] = &enrollmentRequest{}
+	}
+	if m.cc.issuers != nil {
+		for _, issuer := range m.cc.issuers.Issuers() {
+			if !issuer.UseEST {
+				connections[issuer.Ref.String()] = &enrollmentRequest{issuer: issuer}
+			}
+		}
+	}
+	return connections
+}
+
+// expiring pages through the certificates EJBCA reports as expiring within the largest window.
+func (m *ExpiryMonitor) expiring(ctx context.Context, connection string, enrollment *enrollmentRequest) ([]*x509.Certificate, error) {
+	days := m.opts.Windows[len(m.opts.Windows)-1]
+	var certs []*x509.Certificate
+	offset := 0
+	for {
+		var page *ejbca.ExpiringCertificates
+		err := m.cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+			var err error
+			page, err = client.GetExpiringCertificates(days, offset, m.opts.PageSize)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cert := range page.CertificatesRestResponse.Certificates {
+			leaf, err := parseExpiringCertificate(cert.Certificate)
+			if err != nil {
+				signerLog.Warnf("Skipping expiring certificate %s reported by %s: %v", cert.SerialNumber, connection, err)
+				continue
+			}
+			certs = append(certs, leaf)
+		}
+
+		pagination := page.PaginationRestResponseComponent
+		if !pagination.MoreResults || pagination.NextOffset <= offset {
+			return certs, nil
+		}
+		offset = pagination.NextOffset
+	}
+}
+
+// parseExpiringCertificate parses a certificate returned by EJBCA, which is base64 encoded DER or PEM.
+func parseExpiringCertificate(encoded string) (*x509.Certificate, error) {
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// observe exports the days left of an expiring certificate that's in the inventory, and warns its
+// requester if it entered a smaller window. Certificates that aren't in the inventory weren't
+// issued by the signer and are ignored, as are revoked and renewed ones. It returns whether the
+// certificate is tracked.
+func (m *ExpiryMonitor) observe(ctx context.Context, name string, leaf *x509.Certificate) (bool, error) {
+	obj, err := m.dynamicClient.Resource(v1alpha1.IssuedCertificateResource).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get IssuedCertificate %s: %v", name, err)
+	}
+	issued := &v1alpha1.IssuedCertificate{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, issued); err != nil {
+		return false, fmt.Errorf("failed to decode IssuedCertificate %s: %v", name, err)
+	}
+	if issued.Status.RevocationStatus == v1alpha1.CertificateRevoked {
+		return false, nil
+	}
+	if renewed, err := m.renewed(ctx, issued); err != nil || renewed {
+		return false, err
+	}
+
+	days := time.Until(leaf.NotAfter).Hours() / 24
+	source := issued.Spec.Source
+	labels := []string{issued.Spec.SerialNumber, issued.Spec.IssuerDN, issued.Spec.Subject, source.Namespace, source.Kind, source.Name}
+	certificateExpiryDays.Set(math.Round(days*10)/10, labels...)
+	m.series[name] = labels
+
+	window := 0
+	for _, w := range m.opts.Windows {
+		if days <= float64(w) {
+			window = w
+			break
+		}
+	}
+	if window == 0 {
+		return true, nil
+	}
+	if notified, ok := m.notified[name]; ok && notified <= window {
+		return true, nil
+	}
+	m.notified[name] = window
+
+	message := fmt.Sprintf("Certificate %s for %s issued by %s expires in %.0f days at %s", issued.Spec.SerialNumber, issued.Spec.Subject, issued.Spec.IssuerDN, math.Floor(days), leaf.NotAfter.UTC().Format(time.RFC3339))
+	target := requesterEventTarget(issued)
+	if target == nil {
+		signerLog.Warnf("%s; its requester %q can't be notified", message, issued.Spec.Requester)
+		return true, nil
+	}
+	signerLog.Infof("%s; notifying %s %s/%s", message, target.Kind, target.Namespace, target.Name)
+	m.cc.recorder.Event(target, corev1.EventTypeWarning, "CertificateExpiring", message)
+	return true, nil
+}
+
+// renewed returns true if the certificate was issued for a Certificate resource that has been
+// renewed since, so that the old certificate expiring isn't a problem.
+func (m *ExpiryMonitor) renewed(ctx context.Context, issued *v1alpha1.IssuedCertificate) (bool, error) {
+	source := issued.Spec.Source
+	if source.Kind != v1alpha1.CertificateKind {
+		return false, nil
+	}
+	obj, err := m.dynamicClient.Resource(v1alpha1.CertificateResource).Namespace(source.Namespace).Get(ctx, source.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get Certificate %s/%s: %v", source.Namespace, source.Name, err)
+	}
+	if string(obj.GetUID()) != source.UID {
+		return true, nil
+	}
+	certificate := &v1alpha1.Certificate{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, certificate); err != nil {
+		return false, fmt.Errorf("failed to decode Certificate %s/%s: %v", source.Namespace, source.Name, err)
+	}
+	return certificate.Status.SerialNumber != "" && certificate.Status.SerialNumber != issued.Spec.SerialNumber, nil
+}
@@ -5,11 +5,17 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
 	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"math/rand"
+	"time"
 )
 
 var (
@@ -18,6 +24,11 @@ var (
 
 func (cc *CertificateController) handleRequests(ctx context.Context, csr *certificates.CertificateSigningRequest) error {
 	if !IsCertificateRequestApproved(csr) {
+		if _, denied := getCertApprovalCondition(&csr.Status); !denied {
+			if policy := cc.policyFor(csr.Spec.SignerName); policy != nil && policy.AutoApprove {
+				return cc.autoApprove(ctx, csr)
+			}
+		}
 		handlerLog.Warnf("Certificate request with name %s is not approved", csr.Name)
 		return nil
 	}
@@ -30,60 +41,309 @@ func (cc *CertificateController) handleRequests(ctx context.Context, csr *certif
 
 	handlerLog.Infof("Request Certificate - usages: %v", usages)
 
-	asn1CSR, _ := pem.Decode(csr.Spec.Request)
-	parsedRequest, err := x509.ParseCertificateRequest(asn1CSR.Bytes)
+	enrollment, err := cc.resolveEnrollment(csr, csrNamespace(csr))
+	if err == nil {
+		err = cc.checkPolicy(ctx, enrollment)
+	}
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		if cc.dryRun {
+			if cc.recordDryRun(csr, enrollment, policyErr) {
+				cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, policyErr.reason, policyErr.message, nil)
+			}
+			return nil
+		}
+		if err = cc.failCertificateRequest(ctx, csr, policyErr); err != nil {
+			return err
+		}
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	handlerLog.Tracef("Request Certificate - Subject DN: %s", parsedRequest.Subject.String())
+	handlerLog.Tracef("Request Certificate - Subject DN: %s", enrollment.request.Subject.String())
 
-	var chain []byte
-	if cc.ejbcaClient.EST == nil {
-		err, chain = restEnrollCSR(cc.ejbcaClient, csr)
-		if err != nil {
+	if cc.dryRun {
+		if cc.recordDryRun(csr, enrollment, nil) {
+			cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, "", enrollment.describe(), nil)
+		}
+		return nil
+	}
+
+	chain, err := cc.findIssuedCertificate(ctx, enrollment)
+	if errors.As(err, &policyErr) {
+		if err = cc.failCertificateRequest(ctx, csr, policyErr); err != nil {
 			return err
 		}
-	} else {
-		err, chain = estEnrollCSR(cc.ejbcaClient.EST, csr)
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		// Once EJBCA accepted the enrollment for approval, the CSR is only ever finalized.
+		if pending, ok := cc.pendingApprovals.Load(csr.UID); ok {
+			return cc.awaitApproval(ctx, enrollment, pending.(*approvalPendingError))
+		}
+		if csr.Annotations[annotationApprovalStatus] == approvalStatusAwaiting {
+			if chain, err = cc.finalizeApproval(ctx, enrollment); err != nil || chain == nil {
+				return err
+			}
+			cc.issued.Store(csr.UID, chain)
+			cc.recordAudit(csr, enrollment, audit.OutcomeIssued, "", "", chain)
+		}
+	}
+	if chain == nil {
+		// Record the attempt before calling EJBCA, so a retry can find what EJBCA issued even if
+		// this process dies before the status update below completes.
+		if csr, err = cc.recordEnrollmentAttempt(ctx, csr, enrollment); err != nil {
+			return err
+		}
+		enrollment.csr = csr
+
+		err = cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+			var err error
+			if enrollment.useEST {
+				err, chain = estEnrollCSR(client.EST, enrollment)
+			} else {
+				err, chain = restEnrollCSR(client, enrollment)
+			}
+			return err
+		})
+		var pending *approvalPendingError
+		if errors.As(err, &pending) {
+			return cc.awaitApproval(ctx, enrollment, pending)
+		}
 		if err != nil {
+			cc.recordAudit(csr, enrollment, audit.OutcomeError, "EnrollmentFailed", err.Error(), nil)
 			return err
 		}
+		cc.issued.Store(csr.UID, chain)
+		cc.recordAudit(csr, enrollment, audit.OutcomeIssued, "", "", chain)
+	}
+	if err = cc.verifyIssued(ctx, enrollment, chain); errors.As(err, &policyErr) {
+		if err = cc.failCertificateRequest(ctx, csr, policyErr); err != nil {
+			return err
+		}
+		cc.issued.Delete(csr.UID)
+		cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, chain)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cc.recordIssuedCertificate(ctx, v1alpha1.IssuedCertificateSource{Kind: sourceCertificateSigningRequest, Name: csr.Name, UID: string(csr.UID)}, csr, enrollment, chain)
+
+	if err = cc.writeCertificate(ctx, csr, chain); err != nil {
+		return err
 	}
+	cc.issued.Delete(csr.UID)
+
+	return nil
+}
+
+// enrollmentRequest is the fully resolved description of how a CSR will be enrolled with EJBCA,
+// after annotations and defaults have been applied.
+type enrollmentRequest struct {
+	csr     *certificates.CertificateSigningRequest
+	request *x509.CertificateRequest
 
-	csr.Status.Certificate = chain
+	useEST   bool
+	estAlias string
 
-	status, err := cc.kubeClient.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, csr, v1.UpdateOptions{})
+	certificateAuthorityName string
+	certificateProfileName   string
+	endEntityProfileName     string
+
+	// username is the EJBCA end entity name the certificate is enrolled under.
+	username string
+
+	// namespace is the namespace the request comes from: the requester's for CSRs requested by
+	// service accounts, the CertificateRequest's for cert-manager, and empty otherwise.
+	namespace string
+
+	// namespacePolicy is the policy of the requester's namespace, if it has one.
+	namespacePolicy *namespacePolicy
+	// signerPolicy is the policy of the CSR's signer name, if it has one.
+	signerPolicy *SignerPolicy
+	// issuer is the EJBCAIssuer or ClusterEJBCAIssuer selected by the CSR. The controller's own
+	// EJBCA connection is used if it's nil.
+	issuer *Issuer
+	// maxLifetime is the longest lifetime the issued certificate may have, or zero for no limit.
+	maxLifetime time.Duration
+	// generatedByEJBCA is set when EJBCA generates the key and takes the names from the end entity,
+	// so that the names can only be checked once the certificate is issued.
+	generatedByEJBCA bool
+}
+
+// resolveEnrollment parses the CSR and resolves the EJBCA connection, CA, profiles, EST alias and
+// end entity username from the policy of the signer name, the CSR annotations, the defaults of the
+// namespace and the defaults of the selected issuer or the controller, in that order of precedence.
+func (cc *CertificateController) resolveEnrollment(csr *certificates.CertificateSigningRequest, namespace string) (*enrollmentRequest, error) {
+	asn1CSR, _ := pem.Decode(csr.Spec.Request)
+	if asn1CSR == nil {
+		return nil, &policyError{reason: "InvalidRequest", message: "spec.request does not contain a PEM encoded PKCS#10 CSR"}
+	}
+	parsedRequest, err := x509.ParseCertificateRequest(asn1CSR.Bytes)
 	if err != nil {
-		handlerLog.Errorf("Error updating status for csr with name %s: %s", csr.Name, err.Error())
+		return nil, &policyError{reason: "InvalidRequest", message: fmt.Sprintf("failed to parse PKCS#10 CSR: %v", err)}
+	}
+
+	enrollment := &enrollmentRequest{
+		csr:                      csr,
+		request:                  parsedRequest,
+		useEST:                   cc.useEST,
+		estAlias:                 cc.defaults.ESTAlias,
+		certificateAuthorityName: cc.defaults.CertificateAuthorityName,
+		certificateProfileName:   cc.defaults.CertificateProfileName,
+		endEntityProfileName:     cc.defaults.EndEntityProfileName,
+		// The common name of the CSR is used as the end entity name
+		username:     parsedRequest.Subject.CommonName,
+		namespace:    namespace,
+		signerPolicy: cc.policyFor(csr.Spec.SignerName),
+	}
+
+	// The defaults of a selected issuer replace the controller's connection and defaults
+	if err = cc.resolveIssuer(enrollment); err != nil {
+		return enrollment, err
+	}
+
+	// Namespace defaults replace the controller defaults for requests from a namespace
+	policy, err := cc.namespacePolicyFor(enrollment)
+	if err != nil {
+		return enrollment, err
+	}
+	if policy != nil {
+		handlerLog.Tracef("Applying the defaults of namespace %s", policy.namespace)
+		policy.applyDefaults(enrollment)
+		enrollment.namespacePolicy = policy
+	}
+
+	// Override defaults with object annotations, if they exist
+	annotations := csr.GetAnnotations()
+	if alias, ok := annotations["estAlias"]; ok {
+		if err = policy.checkOverride("estAlias", alias); err != nil {
+			return enrollment, err
+		}
+		enrollment.estAlias = alias
+	}
+	if certificateProfileName, ok := annotations["certificateProfileName"]; ok {
+		if err = policy.checkOverride("certificateProfileName", certificateProfileName); err != nil {
+			return enrollment, err
+		}
+		handlerLog.Tracef("Using the %s certificate profile name", certificateProfileName)
+		enrollment.certificateProfileName = certificateProfileName
+	}
+	if endEntityProfileName, ok := annotations["endEntityProfileName"]; ok {
+		if err = policy.checkOverride("endEntityProfileName", endEntityProfileName); err != nil {
+			return enrollment, err
+		}
+		handlerLog.Tracef("Using the %s end entity profile name", endEntityProfileName)
+		enrollment.endEntityProfileName = endEntityProfileName
+	}
+	if certificateAuthorityName, ok := annotations["certificateAuthorityName"]; ok {
+		if err = policy.checkOverride("certificateAuthorityName", certificateAuthorityName); err != nil {
+			return enrollment, err
+		}
+		handlerLog.Tracef("Using the %s certificate authority", certificateAuthorityName)
+		enrollment.certificateAuthorityName = certificateAuthorityName
+	}
+
+	// The signer policy fixes where CSRs of its signer name are enrolled
+	if enrollment.signerPolicy != nil {
+		enrollment.signerPolicy.apply(enrollment)
+	}
+
+	return enrollment, nil
+}
+
+// checkPolicy decides whether a resolved enrollment may be sent to EJBCA. Requests that violate
+// policy return a *policyError and are failed rather than retried.
+func (cc *CertificateController) checkPolicy(ctx context.Context, enrollment *enrollmentRequest) error {
+	if err := enrollment.request.CheckSignature(); err != nil {
+		return &policyError{reason: "InvalidRequest", message: fmt.Sprintf("CSR signature is invalid: %v", err)}
+	}
+
+	if err := cc.checkMode(ctx, enrollment); err != nil {
 		return err
 	}
-	handlerLog.Infof("Successfully enrolled CSR. New status: %s", status.Status)
 
+	if enrollment.issuer == nil && cc.endpoints == nil && !cc.dryRun {
+		return &policyError{reason: "IssuerNotFound", message: "the signer has no default EJBCA connection; select an EJBCAIssuer or ClusterEJBCAIssuer"}
+	}
+
+	if enrollment.namespacePolicy != nil {
+		if err := enrollment.namespacePolicy.checkDNSNames(requestedDNSNames(enrollment.request)); err != nil {
+			return err
+		}
+	}
+
+	if !enrollment.useEST {
+		if enrollment.username == "" {
+			return &policyError{reason: "InvalidRequest", message: "CSR subject has no common name to use as the EJBCA end entity name"}
+		}
+		if enrollment.certificateAuthorityName == "" || enrollment.certificateProfileName == "" || enrollment.endEntityProfileName == "" {
+			return &policyError{reason: "MissingProfile", message: "no certificate authority, certificate profile or end entity profile was configured or requested with annotations"}
+		}
+	}
+
+	if err := cc.verifyOwnership(ctx, enrollment); err != nil {
+		return err
+	}
+
+	if _, _, err := revocationPolicy(enrollment.csr, enrollment.signerPolicy); err != nil {
+		return err
+	}
+
+	return cc.authorizeEnrollment(ctx, enrollment)
+}
+
+// policyError is returned when a CSR must not be enrolled. Unlike other errors it is not retried.
+type policyError struct {
+	reason  string
+	message string
+}
+
+func (e *policyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.message)
+}
+
+// failCertificateRequest marks the CSR as Failed so that it isn't retried, and records why.
+func (cc *CertificateController) failCertificateRequest(ctx context.Context, csr *certificates.CertificateSigningRequest, policyErr *policyError) error {
+	handlerLog.Warnf("Refusing to enroll certificate request %s: %s", csr.Name, policyErr)
+	cc.recorder.Event(csr, corev1.EventTypeWarning, policyErr.reason, policyErr.message)
+
+	csr.Status.Conditions = append(csr.Status.Conditions, certificates.CertificateSigningRequestCondition{
+		Type:           certificates.CertificateFailed,
+		Status:         corev1.ConditionTrue,
+		Reason:         policyErr.reason,
+		Message:        policyErr.message,
+		LastUpdateTime: v1.Now(),
+	})
+	_, err := cc.kubeClient.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, csr, v1.UpdateOptions{})
+	if err != nil {
+		handlerLog.Errorf("Error updating status for csr with name %s: %s", csr.Name, err.Error())
+		return err
+	}
 	return nil
 }
 
-func estEnrollCSR(client *ejbca.ESTClient, csr *certificates.CertificateSigningRequest) (error, []byte) {
+func estEnrollCSR(client *ejbca.ESTClient, enrollment *enrollmentRequest) (error, []byte) {
 	handlerLog.Debugln("Enrolling CSR with EST client")
-	annotations := csr.GetAnnotations()
-	alias := ""
-	// Get alias from object annotations, if they exist
-	a, ok := annotations["estAlias"]
-	if ok {
-		alias = a
-	}
 
 	// Decode PEM encoded PKCS#10 CSR to DER
-	block, _ := pem.Decode(csr.Spec.Request)
+	block, _ := pem.Decode(enrollment.csr.Spec.Request)
 
 	// Enroll CSR with simpleenroll
-	leaf, err := client.SimpleEnroll(alias, base64.StdEncoding.EncodeToString(block.Bytes))
+	leaf, err := client.SimpleEnroll(enrollment.estAlias, base64.StdEncoding.EncodeToString(block.Bytes))
 	if err != nil {
 		return err, nil
 	}
 
 	// Grab the CA chain of trust from cacerts
-	chain, err := client.CaCerts(alias)
+	chain, err := client.CaCerts(enrollment.estAlias)
 	if err != nil {
 		return err, nil
 	}
@@ -100,63 +360,49 @@ func estEnrollCSR(client *ejbca.ESTClient, csr *certificates.CertificateSigningR
 	return nil, leafAndChain
 }
 
-func restEnrollCSR(client *ejbca.Client, csr *certificates.CertificateSigningRequest) (error, []byte) {
+func restEnrollCSR(client *ejbca.Client, enrollment *enrollmentRequest) (error, []byte) {
 	handlerLog.Debugln("Enrolling CSR with REST client")
-	// Configure PKCS10 enrollment with metadata annotations, if they exist.
 	config := &ejbca.PKCS10CSREnrollment{
-		IncludeChain:       true,
-		CertificateRequest: string(csr.Spec.Request),
-	}
-
-	annotations := csr.GetAnnotations()
-	certificateProfileName, ok := annotations["certificateProfileName"]
-	if ok {
-		handlerLog.Tracef("Using the %s certificate profile name", certificateProfileName)
-		config.CertificateProfileName = certificateProfileName
-	}
-	endEntityProfileName, ok := annotations["endEntityProfileName"]
-	if ok {
-		handlerLog.Tracef("Using the %s end entity profile name", endEntityProfileName)
-		config.EndEntityProfileName = endEntityProfileName
-	}
-	certificateAuthorityName, ok := annotations["certificateAuthorityName"]
-	if ok {
-		handlerLog.Tracef("Using the %s certificate authority", endEntityProfileName)
-		config.CertificateAuthorityName = certificateAuthorityName
+		IncludeChain:             true,
+		CertificateRequest:       string(enrollment.csr.Spec.Request),
+		CertificateProfileName:   enrollment.certificateProfileName,
+		EndEntityProfileName:     enrollment.endEntityProfileName,
+		CertificateAuthorityName: enrollment.certificateAuthorityName,
+		Username:                 enrollment.username,
 	}
 
-	// Extract the common name from CSR
-	asn1CSR, _ := pem.Decode(csr.Spec.Request)
-	parsedRequest, err := x509.ParseCertificateRequest(asn1CSR.Bytes)
-	if err != nil {
-		return err, nil
-	}
-	config.Username = parsedRequest.Subject.CommonName
-
 	// Generate random password as it will likely never be used again
 	config.Password = randStringFromCharSet(10)
 
-	var chain []byte
 	resp, err := client.EnrollPKCS10(config)
 	if err != nil {
+		if pending, ok := asApprovalPending(err, config.Password); ok {
+			return pending, nil
+		}
 		return err, nil
 	}
 
-	cert, err := base64.StdEncoding.DecodeString(resp.Certificate)
+	chain, err := encodeRESTChain(resp.Certificate, resp.CertificateChain)
+	return err, chain
+}
+
+// encodeRESTChain converts a base64 encoded DER certificate and chain returned by the REST API
+// to PEM.
+func encodeRESTChain(certificate string, certificateChain []string) ([]byte, error) {
+	cert, err := base64.StdEncoding.DecodeString(certificate)
 	if err != nil {
-		return err, nil
+		return nil, err
 	}
-	chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
-	for _, certificate := range resp.CertificateChain {
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	for _, certificate := range certificateChain {
 		leaf, err := base64.StdEncoding.DecodeString(certificate)
 		if err != nil {
-			return err, nil
+			return nil, err
 		}
 
 		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})...)
 	}
-
-	return nil, chain
+	return chain, nil
 }
 
 // From https://github.com/hashicorp/terraform-plugin-sdk/blob/v2.10.0/helper/acctest/random.go#L51
@@ -0,0 +1,106 @@
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ejbcaErrorKeys are the fields of an EJBCA JSON error body, in the order the EJBCA client
+// prints them. The client doesn't return the HTTP status of an unsuccessful answer; it decodes a
+// JSON body into a map and returns it as a plain error, such as
+// map[error_code:503 error_message:Service unavailable].
+var ejbcaErrorKeys = []string{"error_code", "error_message", "request_id"}
+
+// StatusError is an error EJBCA answered a REST call with, recovered from the error the client
+// returned, so that errors can be told apart by status rather than by message. StatusCode is
+// EJBCA's error_code, which is the HTTP status of its answer. RequestID is the approval request
+// ID of an enrollment EJBCA accepted for approval, if the body names one. Answers that aren't
+// EJBCA JSON errors, such as a proxy's HTML error page or an EST error, keep no status in the
+// client and remain plain errors.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	RequestID  *int
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request failed with HTTP %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("request failed with HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// asStatusError returns a StatusError for err if it's an EJBCA JSON error returned by the
+// client, and err otherwise.
+func asStatusError(err error) error {
+	var statusErr *StatusError
+	if err == nil || errors.As(err, &statusErr) {
+		return err
+	}
+	message := err.Error()
+	if !strings.HasPrefix(message, "map[") || !strings.HasSuffix(message, "]") {
+		return err
+	}
+	fields := ejbcaErrorFields(message[len("map[") : len(message)-1])
+	code, ok := ejbcaErrorNumber(fields["error_code"])
+	if !ok {
+		return err
+	}
+	statusErr = &StatusError{StatusCode: code, Message: fields["error_message"]}
+	if requestID, ok := ejbcaErrorNumber(fields["request_id"]); ok {
+		statusErr.RequestID = &requestID
+	}
+	return statusErr
+}
+
+// ejbcaErrorFields splits the printed map of an EJBCA error body into its known fields. Values
+// may contain spaces, so each field ends where the next known key starts.
+func ejbcaErrorFields(body string) map[string]string {
+	type field struct {
+		key        string
+		start, end int
+	}
+	var found []field
+	pos := 0
+	for _, key := range ejbcaErrorKeys {
+		prefix := key + ":"
+		start := -1
+		if len(found) == 0 && strings.HasPrefix(body, prefix) {
+			start = 0
+		} else if i := strings.Index(body[pos:], " "+prefix); i >= 0 {
+			start = pos + i + 1
+		}
+		if start < 0 {
+			continue
+		}
+		found = append(found, field{key: key, start: start, end: start + len(prefix)})
+		pos = start + len(prefix)
+	}
+
+	fields := make(map[string]string, len(found))
+	for i, f := range found {
+		end := len(body)
+		if i+1 < len(found) {
+			end = found[i+1].start - 1
+		}
+		fields[f.key] = body[f.end:end]
+	}
+	return fields
+}
+
+// ejbcaErrorNumber parses a number of an EJBCA error body. The client decodes JSON numbers as
+// float64, which are printed in exponent form from a million.
+func ejbcaErrorNumber(value string) (int, bool) {
+	if value == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		return 0, false
+	}
+	return int(f), true
+}
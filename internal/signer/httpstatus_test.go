@@ -0,0 +1,113 @@
+package signer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// clientError returns the error the EJBCA client returns for a JSON error body.
+func clientError(t *testing.T, body string) error {
+	t.Helper()
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Errorf("%v", decoded)
+}
+
+func TestAsStatusError(t *testing.T) {
+	requestID := func(id int) *int { return &id }
+	tests := []struct {
+		name string
+		body string
+		err  error
+		want *StatusError
+	}{
+		{
+			name: "EJBCA error",
+			body: `{"error_code":503,"error_message":"Service unavailable"}`,
+			want: &StatusError{StatusCode: 503, Message: "Service unavailable"},
+		},
+		{
+			name: "message with spaces and colons",
+			body: `{"error_code":400,"error_message":"Wrong parameter: error_code:500 in request"}`,
+			want: &StatusError{StatusCode: 400, Message: "Wrong parameter: error_code:500 in request"},
+		},
+		{
+			name: "approval request",
+			body: `{"error_code":202,"error_message":"Request is waiting for approval","request_id":-1234567890}`,
+			want: &StatusError{StatusCode: 202, Message: "Request is waiting for approval", RequestID: requestID(-1234567890)},
+		},
+		{
+			name: "no message",
+			body: `{"error_code":500}`,
+			want: &StatusError{StatusCode: 500},
+		},
+		{
+			name: "HTML page from a proxy",
+			err:  errors.New("<html><body>502 Bad Gateway</body></html>"),
+		},
+		{
+			name: "JSON without an error code",
+			body: `{"error_message":"Something went wrong"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err
+			if err == nil {
+				err = clientError(t, tt.body)
+			}
+			got := asStatusError(err)
+
+			var statusErr *StatusError
+			if !errors.As(got, &statusErr) {
+				if tt.want != nil {
+					t.Fatalf("asStatusError(%q) = %v, want a StatusError", err, got)
+				}
+				if got != err {
+					t.Fatalf("asStatusError(%q) = %v, want the error unchanged", err, got)
+				}
+				return
+			}
+			if tt.want == nil {
+				t.Fatalf("asStatusError(%q) = %#v, want the error unchanged", err, statusErr)
+			}
+			if statusErr.StatusCode != tt.want.StatusCode || statusErr.Message != tt.want.Message {
+				t.Fatalf("asStatusError(%q) = %d %q, want %d %q", err, statusErr.StatusCode, statusErr.Message, tt.want.StatusCode, tt.want.Message)
+			}
+			switch {
+			case (statusErr.RequestID == nil) != (tt.want.RequestID == nil):
+				t.Fatalf("asStatusError(%q) request ID = %v, want %v", err, statusErr.RequestID, tt.want.RequestID)
+			case statusErr.RequestID != nil && *statusErr.RequestID != *tt.want.RequestID:
+				t.Fatalf("asStatusError(%q) request ID = %d, want %d", err, *statusErr.RequestID, *tt.want.RequestID)
+			}
+		})
+	}
+}
+
+func TestEJBCAFailureClassification(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantFailure  bool
+		wantFailOver bool
+	}{
+		{name: "bad request", body: `{"error_code":400,"error_message":"Bad request"}`},
+		{name: "internal error", body: `{"error_code":500,"error_message":"Internal error"}`, wantFailure: true},
+		{name: "unavailable", body: `{"error_code":503,"error_message":"Service unavailable"}`, wantFailure: true, wantFailOver: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := asStatusError(clientError(t, tt.body))
+			if got := IsEndpointFailure(err); got != tt.wantFailure {
+				t.Errorf("IsEndpointFailure(%v) = %v, want %v", err, got, tt.wantFailure)
+			}
+			if got := canFailOver(err); got != tt.wantFailOver {
+				t.Errorf("canFailOver(%v) = %v, want %v", err, got, tt.wantFailOver)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	certificates "k8s.io/api/certificates/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"strings"
+	"time"
+)
+
+// Annotations written by the signer to make enrollment idempotent. They are set on the CSR
+// before it's sent to EJBCA, so that a retry after a failed status update or a restart can
+// find the certificate EJBCA already issued instead of enrolling again. The enrollment started
+// annotation holds the CSR UID and the time of the attempt, separated by a slash, so annotations
+// set by the requester when the CSR was created are ignored.
+const (
+	annotationEnrollmentStarted = "ejbca.keyfactor.com/enrollment-started"
+	annotationEndEntityUsername = "ejbca.keyfactor.com/end-entity-username"
+)
+
+// issuedCertificateClockSkew widens the issue date window searched in EJBCA on both sides, to
+// allow for clock differences between the signer and EJBCA.
+const issuedCertificateClockSkew = 5 * time.Minute
+
+// issuedCertificateSearchPageSize is the number of certificates EJBCA returns per search. When
+// EJBCA has more, the search window is split in two until every window fits in a page.
+const issuedCertificateSearchPageSize = 100
+
+// issuedCertificateSearchMinWindow is how much the halves of a split search window overlap.
+// Windows of up to three times it aren't split, since their halves would barely shrink.
+const issuedCertificateSearchMinWindow = time.Second
+
+// enrollmentStartedValue returns the value of the enrollment started annotation of the CSR with
+// uid for an attempt at t.
+func enrollmentStartedValue(uid types.UID, t time.Time) string {
+	return string(uid) + "/" + t.UTC().Format(time.RFC3339)
+}
+
+// enrollmentStarted returns the time of the previous enrollment attempt recorded on csr by the
+// signer, and false if there is none. Annotations that don't name the CSR's UID weren't written
+// by the signer and are ignored.
+func enrollmentStarted(csr *certificates.CertificateSigningRequest) (time.Time, bool) {
+	value, ok := csr.Annotations[annotationEnrollmentStarted]
+	if !ok {
+		return time.Time{}, false
+	}
+	uid, started, found := strings.Cut(value, "/")
+	startTime, err := time.Parse(time.RFC3339, started)
+	if !found || uid != string(csr.UID) || err != nil {
+		handlerLog.Warnf("Ignoring the %s annotation on %s; it wasn't written by the signer", annotationEnrollmentStarted, csr.Name)
+		return time.Time{}, false
+	}
+	return startTime, true
+}
+
+// findIssuedCertificate returns the chain of a certificate that was already issued for csr by a
+// previous attempt whose status update didn't complete, or nil if there is none. Chains issued
+// by this process are kept in memory; after a restart, the REST API is searched for a
+// certificate with the CSR's public key issued to the recorded end entity. EST has no search, so
+// a CSR whose EST enrollment was in flight when the signer restarted is failed with a
+// policyError rather than enrolled a second time.
+func (cc *CertificateController) findIssuedCertificate(ctx context.Context, enrollment *enrollmentRequest) ([]byte, error) {
+	csr := enrollment.csr
+	if chain, ok := cc.issued.Load(csr.UID); ok {
+		handlerLog.Infof("Certificate for %s was already issued by EJBCA; retrying the status update", csr.Name)
+		return chain.([]byte), nil
+	}
+
+	startTime, ok := enrollmentStarted(csr)
+	if !ok {
+		return nil, nil
+	}
+	started := startTime.Format(time.RFC3339)
+
+	if enrollment.useEST {
+		if _, ok = cc.enrollmentAttempts.Load(csr.UID); ok {
+			// the attempt was made by this process, which saw it fail
+			return nil, nil
+		}
+		handlerLog.Warnf("A previous enrollment of %s started at %s may have been issued; EST can't look it up", csr.Name, started)
+		return nil, &policyError{
+			reason:  "EnrollmentInterrupted",
+			message: fmt.Sprintf("an EST enrollment started at %s was interrupted and may have issued a certificate that can't be looked up; create a new CertificateSigningRequest to enroll again", started),
+		}
+	}
+
+	username := csr.Annotations[annotationEndEntityUsername]
+	if username == "" {
+		username = enrollment.username
+	}
+	handlerLog.Infof("A previous enrollment of %s started at %s; searching EJBCA for a certificate issued to %s", csr.Name, started, username)
+
+	var chain []byte
+	err := cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+		var err error
+		chain, err = searchIssuedCertificate(client, enrollment, username, startTime.Add(-issuedCertificateClockSkew), time.Now().Add(issuedCertificateClockSkew))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search EJBCA for a certificate issued by a previous enrollment of %s: %v", csr.Name, err)
+	}
+	if chain == nil {
+		handlerLog.Infof("EJBCA has no certificate from the previous enrollment of %s; enrolling again", csr.Name)
+	}
+	return chain, nil
+}
+
+// certificateSearcher is the search API of the EJBCA REST client.
+type certificateSearcher interface {
+	SearchCertificates(criteria *ejbca.SearchCertificate) (*ejbca.SearchCertificateCriteriaResponse, error)
+}
+
+// searchIssuedCertificate searches EJBCA for an active certificate issued to username between
+// issuedAfter and issuedBefore whose public key matches the CSR. It returns the certificate and,
+// if EJBCA included it, its chain in PEM format. The window bounds the issue date, not the
+// validity of the certificate, which EJBCA backdates. The search API has no offsets, so when
+// EJBCA has more results than fit in a page, each half of the window is searched in turn.
+func searchIssuedCertificate(client certificateSearcher, enrollment *enrollmentRequest, username string, issuedAfter, issuedBefore time.Time) ([]byte, error) {
+	criteria := &ejbca.SearchCertificate{}
+	criteria.MaxNumberOfResults = issuedCertificateSearchPageSize
+	criteria.Criteria = []ejbca.Criteria{
+		{Property: "QUERY", Value: username, Operation: "EQUAL"},
+		{Property: "STATUS", Value: "CERT_ACTIVE", Operation: "EQUAL"},
+		{Property: "ISSUED_DATE", Value: issuedAfter.UTC().Format(time.RFC3339), Operation: "AFTER"},
+		{Property: "ISSUED_DATE", Value: issuedBefore.UTC().Format(time.RFC3339), Operation: "BEFORE"},
+	}
+
+	resp, err := client.SearchCertificates(criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, found := range resp.Certificates {
+		der, err := base64.StdEncoding.DecodeString(found.Certificate)
+		if err != nil {
+			continue
+		}
+		leaf, err := parseLeafCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		if err != nil || leaf == nil {
+			continue
+		}
+		if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, enrollment.request.RawSubjectPublicKeyInfo) {
+			continue
+		}
+
+		handlerLog.Infof("Found certificate with serial number %X issued to %s", leaf.SerialNumber, username)
+		chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		for _, certificate := range found.CertificateChain {
+			cert, err := base64.StdEncoding.DecodeString(certificate)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+		}
+		if len(found.CertificateChain) == 0 {
+			handlerLog.Warnf("EJBCA didn't return the chain for serial number %X; only the leaf certificate will be written", leaf.SerialNumber)
+		}
+		return chain, nil
+	}
+	if !resp.MoreResults {
+		return nil, nil
+	}
+
+	window := issuedBefore.Sub(issuedAfter)
+	if window <= 3*issuedCertificateSearchMinWindow {
+		return nil, fmt.Errorf("more than %d certificates were issued to %s between %s and %s", issuedCertificateSearchPageSize, username, issuedAfter.UTC().Format(time.RFC3339), issuedBefore.UTC().Format(time.RFC3339))
+	}
+	middle := issuedAfter.Add(window / 2)
+	handlerLog.Debugf("EJBCA has more than %d certificates issued to %s; searching before and after %s", issuedCertificateSearchPageSize, username, middle.UTC().Format(time.RFC3339))
+	// the halves overlap, so certificates issued at the boundary aren't missed
+	chain, err := searchIssuedCertificate(client, enrollment, username, issuedAfter, middle.Add(issuedCertificateSearchMinWindow))
+	if chain != nil || err != nil {
+		return chain, err
+	}
+	return searchIssuedCertificate(client, enrollment, username, middle.Add(-issuedCertificateSearchMinWindow), issuedBefore)
+}
+
+// recordEnrollmentAttempt annotates the CSR with the time and end entity of the enrollment that
+// is about to be sent to EJBCA, and adds the revocation finalizer if the CSR opted into it. EJBCA
+// must not be called if this fails. The updated CSR is returned.
+func (cc *CertificateController) recordEnrollmentAttempt(ctx context.Context, csr *certificates.CertificateSigningRequest, enrollment *enrollmentRequest) (*certificates.CertificateSigningRequest, error) {
+	csrClient := cc.kubeClient.CertificatesV1().CertificateSigningRequests()
+	var updated *certificates.CertificateSigningRequest
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := csrClient.Get(ctx, csr.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.UID != csr.UID {
+			return fmt.Errorf("certificate request %s was replaced", csr.Name)
+		}
+		if current.Annotations == nil {
+			current.Annotations = make(map[string]string)
+		}
+		setEnrollmentAttempt(current.Annotations, current.UID, enrollment)
+		if revoke, _, _ := revocationPolicy(current, enrollment.signerPolicy); revoke && !hasFinalizer(current, finalizerRevokeOnDelete) {
+			current.Finalizers = append(current.Finalizers, finalizerRevokeOnDelete)
+		}
+		updated, err = csrClient.Update(ctx, current, v1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record enrollment attempt on %s: %v", csr.Name, err)
+	}
+	cc.enrollmentAttempts.Store(csr.UID, struct{}{})
+	return updated, nil
+}
+
+// setEnrollmentAttempt sets the annotations that record an enrollment attempt, now, of the object
+// with uid.
+func setEnrollmentAttempt(annotations map[string]string, uid types.UID, enrollment *enrollmentRequest) {
+	annotations[annotationEnrollmentStarted] = enrollmentStartedValue(uid, time.Now())
+	if enrollment.username != "" {
+		annotations[annotationEndEntityUsername] = enrollment.username
+	} else {
+		delete(annotations, annotationEndEntityUsername)
+	}
+}
+
+// writeCertificate writes the issued chain to the CSR status. Conflicts are retried against the
+// latest version of the CSR, and nothing is written if another writer already set a certificate.
+func (cc *CertificateController) writeCertificate(ctx context.Context, csr *certificates.CertificateSigningRequest, chain []byte) error {
+	csrClient := cc.kubeClient.CertificatesV1().CertificateSigningRequests()
+	current := csr
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if len(current.Status.Certificate) > 0 {
+			handlerLog.Infof("Certificate request %s already has a certificate", csr.Name)
+			return nil
+		}
+		current.Status.Certificate = chain
+		status, err := csrClient.UpdateStatus(ctx, current, v1.UpdateOptions{})
+		if err == nil {
+			handlerLog.Infof("Successfully enrolled CSR. New status: %s", status.Status)
+			return nil
+		}
+
+		handlerLog.Errorf("Error updating status for csr with name %s: %s", csr.Name, err.Error())
+		latest, getErr := csrClient.Get(ctx, csr.Name, v1.GetOptions{})
+		if getErr != nil {
+			return err
+		}
+		if latest.UID != csr.UID {
+			return fmt.Errorf("certificate request %s was replaced before its certificate could be written", csr.Name)
+		}
+		current = latest
+		return err
+	})
+}
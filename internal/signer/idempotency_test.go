@@ -0,0 +1,196 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+)
+
+func newTestKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newTestRequest returns a parsed certificate request for key.
+func newTestRequest(t *testing.T, key crypto.Signer, template *x509.CertificateRequest) *x509.CertificateRequest {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// newTestCertificate returns a self-signed certificate for key, based on template, in DER.
+func newTestCertificate(t *testing.T, key crypto.Signer, template *x509.Certificate) []byte {
+	t.Helper()
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// issuedCertificate is a certificate in the fake EJBCA, issued at issued.
+type issuedCertificate struct {
+	der    []byte
+	issued time.Time
+}
+
+// fakeSearcher answers certificate searches from certificates, applying the ISSUED_DATE
+// criteria and the page size like EJBCA.
+type fakeSearcher struct {
+	certificates []issuedCertificate
+	searches     int
+}
+
+func (f *fakeSearcher) SearchCertificates(criteria *ejbca.SearchCertificate) (*ejbca.SearchCertificateCriteriaResponse, error) {
+	f.searches++
+	var after, before time.Time
+	for _, c := range criteria.Criteria {
+		if c.Property != "ISSUED_DATE" {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, c.Value)
+		if err != nil {
+			return nil, err
+		}
+		if c.Operation == "AFTER" {
+			after = value
+		} else {
+			before = value
+		}
+	}
+
+	resp := &ejbca.SearchCertificateCriteriaResponse{}
+	for _, certificate := range f.certificates {
+		if certificate.issued.Before(after) || certificate.issued.After(before) {
+			continue
+		}
+		if len(resp.Certificates) == criteria.MaxNumberOfResults {
+			resp.MoreResults = true
+			break
+		}
+		resp.Certificates = append(resp.Certificates, ejbca.FinalizeCertificateEnrollmentResponse{
+			Certificate: base64.StdEncoding.EncodeToString(certificate.der),
+		})
+	}
+	return resp, nil
+}
+
+func TestSearchIssuedCertificate(t *testing.T) {
+	started := time.Now().Truncate(time.Second)
+	key := newTestKey(t)
+	request := newTestRequest(t, key, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "app"}})
+
+	// matching is issued a minute after the attempt, and backdated by EJBCA's default ten minutes
+	matching := issuedCertificate{
+		der: newTestCertificate(t, key, &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "app"},
+			NotBefore: started.Add(-10 * time.Minute),
+			NotAfter:  started.Add(24 * time.Hour),
+		}),
+		issued: started.Add(time.Minute),
+	}
+	// others are issued to the same end entity for other keys, one second apart
+	others := func(n int, from time.Time) []issuedCertificate {
+		var certificates []issuedCertificate
+		for i := 0; i < n; i++ {
+			certificates = append(certificates, issuedCertificate{
+				der: newTestCertificate(t, newTestKey(t), &x509.Certificate{
+					Subject:   pkix.Name{CommonName: "app"},
+					NotBefore: from,
+					NotAfter:  from.Add(24 * time.Hour),
+				}),
+				issued: from.Add(time.Duration(i) * time.Second),
+			})
+		}
+		return certificates
+	}
+
+	tests := []struct {
+		name         string
+		certificates []issuedCertificate
+		want         []byte
+		wantErr      bool
+	}{
+		{
+			name:         "backdated certificate",
+			certificates: []issuedCertificate{matching},
+			want:         matching.der,
+		},
+		{
+			name:         "only other keys",
+			certificates: others(3, started),
+		},
+		{
+			name:         "more than a page",
+			certificates: append(others(2*issuedCertificateSearchPageSize, started.Add(-issuedCertificateClockSkew)), matching),
+			want:         matching.der,
+		},
+		{
+			name: "more than a page in one second",
+			certificates: func() []issuedCertificate {
+				var certificates []issuedCertificate
+				for _, other := range others(issuedCertificateSearchPageSize+1, started) {
+					other.issued = started
+					certificates = append(certificates, other)
+				}
+				return certificates
+			}(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			searcher := &fakeSearcher{certificates: tt.certificates}
+			sort.SliceStable(searcher.certificates, func(i, j int) bool {
+				return searcher.certificates[i].issued.Before(searcher.certificates[j].issued)
+			})
+			enrollment := &enrollmentRequest{request: request}
+
+			chain, err := searchIssuedCertificate(searcher, enrollment, "app", started.Add(-issuedCertificateClockSkew), started.Add(time.Hour))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("searchIssuedCertificate returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("searchIssuedCertificate returned %v", err)
+			}
+			if tt.want == nil {
+				if chain != nil {
+					t.Fatalf("searchIssuedCertificate found a certificate for another key")
+				}
+				return
+			}
+			block, _ := pem.Decode(chain)
+			if block == nil || string(block.Bytes) != string(tt.want) {
+				t.Fatalf("searchIssuedCertificate didn't return the matching certificate")
+			}
+		})
+	}
+}
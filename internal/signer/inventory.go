@@ -0,0 +1,326 @@
+package signer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"strings"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// Kinds of the objects that certificates are issued for.
+const (
+	sourceCertificateSigningRequest = "CertificateSigningRequest"
+	sourceCertificateRequest        = "CertificateRequest"
+)
+
+// certificateRequestAPIVersion is the API version of cert-manager CertificateRequests.
+const certificateRequestAPIVersion = "cert-manager.io/v1"
+
+// inventoryPruneInterval is how often IssuedCertificates past their retention are deleted.
+const inventoryPruneInterval = time.Hour
+
+// inventoryPageSize is the number of IssuedCertificates listed at a time when pruning.
+const inventoryPageSize = 100
+
+// issuedCertificateName returns the name of the IssuedCertificate of a certificate. The serial
+// number is only unique per CA, so it's qualified by a hash of the issuer DN.
+func issuedCertificateName(issuerDN string, serialNumber string) string {
+	hash := sha256.Sum256([]byte(issuerDN))
+	return strings.ToLower(serialNumber) + "-" + hex.EncodeToString(hash[:])[:10]
+}
+
+// recordIssuedCertificate creates the IssuedCertificate of a certificate EJBCA issued for the
+// source. The certificate is already issued, so failures aren't returned: the IssuedCertificate
+// is queued and its creation retried with backoff. A retried issuance writes the same
+// IssuedCertificate.
+func (cc *CertificateController) recordIssuedCertificate(ctx context.Context, source v1alpha1.IssuedCertificateSource, csr *certificates.CertificateSigningRequest, enrollment *enrollmentRequest, chain []byte) {
+	if cc.inventory == nil {
+		return
+	}
+	leaf, err := parseLeafCertificate(chain)
+	if err != nil || leaf == nil {
+		handlerLog.Errorf("Failed to record the certificate issued for %s %s in the inventory: %v", source.Kind, source.Name, err)
+		return
+	}
+
+	serialNumber := fmt.Sprintf("%X", leaf.SerialNumber)
+	issued := &v1alpha1.IssuedCertificate{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       v1alpha1.IssuedCertificateKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: issuedCertificateName(leaf.Issuer.String(), serialNumber),
+		},
+		Spec: v1alpha1.IssuedCertificateSpec{
+			SerialNumber:      serialNumber,
+			IssuerDN:          leaf.Issuer.String(),
+			Subject:           leaf.Subject.String(),
+			DNSNames:          leaf.DNSNames,
+			EmailAddresses:    leaf.EmailAddresses,
+			NotBefore:         metav1.Time{Time: leaf.NotBefore},
+			NotAfter:          metav1.Time{Time: leaf.NotAfter},
+			EndEntityUsername: enrollment.username,
+			SignerName:        csr.Spec.SignerName,
+			Requester:         csr.Spec.Username,
+			Groups:            csr.Spec.Groups,
+			Source:            source,
+			Certificate:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})),
+		},
+		Status: activeCertificateStatus(),
+	}
+	for _, ip := range leaf.IPAddresses {
+		issued.Spec.IPAddresses = append(issued.Spec.IPAddresses, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		issued.Spec.URIs = append(issued.Spec.URIs, uri.String())
+	}
+	if enrollment.issuer != nil {
+		issued.Spec.Issuer = enrollment.issuer.Ref.String()
+	}
+	if enrollment.useEST {
+		issued.Spec.ESTAlias = enrollment.estAlias
+	} else {
+		issued.Spec.CertificateAuthorityName = enrollment.certificateAuthorityName
+		issued.Spec.CertificateProfileName = enrollment.certificateProfileName
+		issued.Spec.EndEntityProfileName = enrollment.endEntityProfileName
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(issued)
+	if err != nil {
+		handlerLog.Errorf("Failed to encode IssuedCertificate %s: %v", issued.Name, err)
+		return
+	}
+	if err = cc.createIssuedCertificate(ctx, content); err != nil {
+		handlerLog.Errorf("Failed to record the certificate issued for %s %s in the inventory; retrying: %v", source.Kind, source.Name, err)
+		cc.pendingInventory.Store(issued.Name, content)
+		cc.inventoryQueue.AddRateLimited(issued.Name)
+		return
+	}
+	handlerLog.Infof("Recorded certificate %s issued for %s %s as IssuedCertificate %s", serialNumber, source.Kind, source.Name, issued.Name)
+}
+
+// createIssuedCertificate creates an IssuedCertificate and sets its status. An IssuedCertificate
+// that already exists only gets its status set if an earlier attempt didn't set it.
+func (cc *CertificateController) createIssuedCertificate(ctx context.Context, content map[string]interface{}) error {
+	resource := cc.inventory.Resource(v1alpha1.IssuedCertificateResource)
+	object := &unstructured.Unstructured{Object: content}
+	created, err := resource.Create(ctx, object, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		if created, err = resource.Get(ctx, object.GetName(), metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("failed to get IssuedCertificate %s: %v", object.GetName(), err)
+		}
+		if status, _, _ := unstructured.NestedString(created.Object, "status", "revocationStatus"); status != "" {
+			return nil
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to create IssuedCertificate %s: %v", object.GetName(), err)
+	}
+	// The status subresource ignores the status of created objects
+	created.Object["status"] = content["status"]
+	if _, err = resource.UpdateStatus(ctx, created, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update the status of IssuedCertificate %s: %v", object.GetName(), err)
+	}
+	return nil
+}
+
+// runInventory retries the IssuedCertificates that couldn't be created, and deletes those whose
+// certificate expired longer than the retention ago, until ctx is cancelled. IssuedCertificates
+// still queued when the signer stops aren't recorded.
+func (cc *CertificateController) runInventory(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+	defer cc.inventoryQueue.ShutDown()
+
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for cc.processNextInventoryItem(ctx) {
+		}
+	}, time.Second)
+
+	if cc.inventoryRetention > 0 {
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			if err := cc.pruneInventory(ctx); err != nil {
+				signerLog.Errorf("Failed to delete expired IssuedCertificates: %v", err)
+			}
+		}, inventoryPruneInterval)
+	}
+	<-ctx.Done()
+}
+
+func (cc *CertificateController) processNextInventoryItem(ctx context.Context) bool {
+	key, quit := cc.inventoryQueue.Get()
+	if quit {
+		return false
+	}
+	defer cc.inventoryQueue.Done(key)
+
+	content, ok := cc.pendingInventory.Load(key)
+	if !ok {
+		cc.inventoryQueue.Forget(key)
+		return true
+	}
+	if err := cc.createIssuedCertificate(ctx, content.(map[string]interface{})); err != nil {
+		utilruntime.HandleError(err)
+		cc.inventoryQueue.AddRateLimited(key)
+		return true
+	}
+	handlerLog.Infof("Recorded IssuedCertificate %s", key)
+	cc.inventoryQueue.Forget(key)
+	cc.pendingInventory.Delete(key)
+	return true
+}
+
+// pruneInventory pages through the inventory and deletes the IssuedCertificates whose
+// certificate expired longer than the retention ago.
+func (cc *CertificateController) pruneInventory(ctx context.Context) error {
+	resource := cc.inventory.Resource(v1alpha1.IssuedCertificateResource)
+	cutoff := time.Now().Add(-cc.inventoryRetention)
+	deleted := 0
+	opts := metav1.ListOptions{Limit: inventoryPageSize}
+	for {
+		list, err := resource.List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("failed to list IssuedCertificates: %v", err)
+		}
+		for i := range list.Items {
+			object := &list.Items[i]
+			issued := &v1alpha1.IssuedCertificate{}
+			if err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, issued); err != nil {
+				handlerLog.Warnf("Failed to decode IssuedCertificate %s: %v", object.GetName(), err)
+				continue
+			}
+			if !issued.Spec.NotAfter.Time.Before(cutoff) {
+				continue
+			}
+			uid := issued.UID
+			err = resource.Delete(ctx, issued.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete IssuedCertificate %s: %v", issued.Name, err)
+			}
+			deleted++
+		}
+		opts.Continue = list.GetContinue()
+		if opts.Continue == "" {
+			break
+		}
+	}
+	if deleted > 0 {
+		signerLog.Infof("Deleted %d IssuedCertificates that expired more than %v ago", deleted, cc.inventoryRetention)
+	}
+	return nil
+}
+
+// updateIssuedCertificateStatus sets the revocation status of the IssuedCertificate of a
+// certificate, if the certificate is in the inventory.
+func (cc *CertificateController) updateIssuedCertificateStatus(ctx context.Context, issuerDN string, serialNumber string, status v1alpha1.IssuedCertificateStatus) error {
+	if cc.inventory == nil {
+		return nil
+	}
+	name := issuedCertificateName(issuerDN, serialNumber)
+	resource := cc.inventory.Resource(v1alpha1.IssuedCertificateResource)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+		if err != nil {
+			return err
+		}
+		current.Object["status"] = updated
+		_, err = resource.UpdateStatus(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update the status of IssuedCertificate %s: %v", name, err)
+	}
+	return nil
+}
+
+// markIssuedCertificateRevoked records the revocation of a certificate in the inventory. Failures
+// are logged, since the certificate is already revoked.
+func (cc *CertificateController) markIssuedCertificateRevoked(ctx context.Context, issuerDN string, serialNumber string, reason string, revokedAt time.Time) {
+	status := revokedCertificateStatus(reason, revokedAt)
+	if err := cc.updateIssuedCertificateStatus(ctx, issuerDN, serialNumber, status); err != nil {
+		handlerLog.Error(err)
+	}
+}
+
+// activeCertificateStatus is the status of an IssuedCertificate that isn't known to be revoked.
+func activeCertificateStatus() v1alpha1.IssuedCertificateStatus {
+	status := v1alpha1.IssuedCertificateStatus{RevocationStatus: v1alpha1.CertificateActive}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    v1alpha1.ConditionRevoked,
+		Status:  metav1.ConditionFalse,
+		Reason:  v1alpha1.CertificateActive,
+		Message: "The certificate isn't known to be revoked",
+	})
+	return status
+}
+
+// revokedCertificateStatus is the status of an IssuedCertificate that was revoked with the RFC
+// 5280 reason.
+func revokedCertificateStatus(reason string, revokedAt time.Time) v1alpha1.IssuedCertificateStatus {
+	status := v1alpha1.IssuedCertificateStatus{
+		RevocationStatus: v1alpha1.CertificateRevoked,
+		RevocationReason: reason,
+		RevocationDate:   &metav1.Time{Time: revokedAt},
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    v1alpha1.ConditionRevoked,
+		Status:  metav1.ConditionTrue,
+		Reason:  conditionReason(reason),
+		Message: fmt.Sprintf("The certificate was revoked at %s with reason %s", revokedAt.UTC().Format(time.RFC3339), reason),
+	})
+	return status
+}
+
+// conditionReason converts an RFC 5280 reason like KEY_COMPROMISE to a condition reason like
+// KeyCompromise.
+func conditionReason(reason string) string {
+	var converted strings.Builder
+	for _, word := range strings.Split(strings.ToLower(reason), "_") {
+		if word != "" {
+			converted.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	if converted.Len() == 0 {
+		return v1alpha1.CertificateRevoked
+	}
+	return converted.String()
+}
+
+// requesterEventTarget returns the object that identifies the requester of a certificate: the
+// namespaced resource it was issued for, or the requesting service account. It returns nil if the
+// requester can't be identified.
+func requesterEventTarget(issued *v1alpha1.IssuedCertificate) *corev1.ObjectReference {
+	source := issued.Spec.Source
+	switch source.Kind {
+	case v1alpha1.CertificateKind:
+		return &corev1.ObjectReference{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: source.Kind, Namespace: source.Namespace, Name: source.Name, UID: types.UID(source.UID)}
+	case sourceCertificateRequest:
+		return &corev1.ObjectReference{APIVersion: certificateRequestAPIVersion, Kind: source.Kind, Namespace: source.Namespace, Name: source.Name, UID: types.UID(source.UID)}
+	}
+	if namespace, name, ok := splitServiceAccount(issued.Spec.Requester); ok {
+		return &corev1.ObjectReference{APIVersion: "v1", Kind: "ServiceAccount", Namespace: namespace, Name: name}
+	}
+	return nil
+}
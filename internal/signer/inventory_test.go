@@ -0,0 +1,120 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+
+	certificates "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// newTestInventory returns a fake dynamic client holding the IssuedCertificates.
+func newTestInventory(t *testing.T, issued ...*v1alpha1.IssuedCertificate) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	var objects []runtime.Object
+	for _, certificate := range issued {
+		certificate.APIVersion = v1alpha1.SchemeGroupVersion.String()
+		certificate.Kind = v1alpha1.IssuedCertificateKind
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, &unstructured.Unstructured{Object: content})
+	}
+	listKinds := map[schema.GroupVersionResource]string{v1alpha1.IssuedCertificateResource: "IssuedCertificateList"}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+func TestPruneInventory(t *testing.T) {
+	now := time.Now()
+	issued := func(name string, notAfter time.Time) *v1alpha1.IssuedCertificate {
+		return &v1alpha1.IssuedCertificate{
+			ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name)},
+			Spec:       v1alpha1.IssuedCertificateSpec{NotAfter: metav1.Time{Time: notAfter}},
+		}
+	}
+	inventory := newTestInventory(t,
+		issued("valid", now.Add(24*time.Hour)),
+		issued("expired-recently", now.Add(-24*time.Hour)),
+		issued("expired-long-ago", now.Add(-60*24*time.Hour)),
+	)
+	cc := &CertificateController{inventory: inventory, inventoryRetention: 30 * 24 * time.Hour}
+
+	if err := cc.pruneInventory(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	list, err := inventory.Resource(v1alpha1.IssuedCertificateResource).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[string]bool{}
+	for _, item := range list.Items {
+		remaining[item.GetName()] = true
+	}
+	if len(remaining) != 2 || !remaining["valid"] || !remaining["expired-recently"] {
+		t.Fatalf("IssuedCertificates left after pruning = %v, want valid and expired-recently", remaining)
+	}
+}
+
+func TestRecordIssuedCertificateRetries(t *testing.T) {
+	inventory := newTestInventory(t)
+	creates := 0
+	inventory.PrependReactor("create", "issuedcertificates", func(k8stesting.Action) (bool, runtime.Object, error) {
+		creates++
+		if creates == 1 {
+			return true, nil, errors.New("the server is currently unable to handle the request")
+		}
+		return false, nil, nil
+	})
+	cc := &CertificateController{
+		inventory:      inventory,
+		inventoryQueue: workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)),
+	}
+	defer cc.inventoryQueue.ShutDown()
+
+	key := newTestKey(t)
+	der := newTestCertificate(t, key, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "app"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	})
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	csr := &certificates.CertificateSigningRequest{ObjectMeta: metav1.ObjectMeta{Name: "app", UID: "uid"}}
+	source := v1alpha1.IssuedCertificateSource{Kind: sourceCertificateSigningRequest, Name: "app", UID: "uid"}
+
+	cc.recordIssuedCertificate(context.Background(), source, csr, &enrollmentRequest{username: "app"}, chain)
+	for deadline := time.Now().Add(time.Second); cc.inventoryQueue.Len() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the IssuedCertificate that failed to be created wasn't queued")
+		}
+	}
+	cc.processNextInventoryItem(context.Background())
+
+	list, err := inventory.Resource(v1alpha1.IssuedCertificateResource).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("got %d IssuedCertificates after the retry, want 1", len(list.Items))
+	}
+	if status, _, _ := unstructured.NestedString(list.Items[0].Object, "status", "revocationStatus"); status != v1alpha1.CertificateActive {
+		t.Errorf("revocation status = %q, want %q", status, v1alpha1.CertificateActive)
+	}
+	if _, ok := cc.pendingInventory.Load(list.Items[0].GetName()); ok {
+		t.Errorf("the created IssuedCertificate is still pending")
+	}
+}
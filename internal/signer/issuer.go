@@ -0,0 +1,129 @@
+package signer
+
+import (
+	"fmt"
+	certificates "k8s.io/api/certificates/v1"
+	"strings"
+)
+
+// Annotations that select an EJBCAIssuer of the requester's namespace or a ClusterEJBCAIssuer.
+const (
+	annotationIssuer        = "ejbca.keyfactor.com/issuer"
+	annotationClusterIssuer = "ejbca.keyfactor.com/cluster-issuer"
+)
+
+// Signer name domains that select an issuer by name: ejbcaissuers.ejbca.keyfactor.com/<namespace>.<name>
+// and clusterejbcaissuers.ejbca.keyfactor.com/<name>.
+const (
+	issuerSignerDomain        = "ejbcaissuers.ejbca.keyfactor.com/"
+	clusterIssuerSignerDomain = "clusterejbcaissuers.ejbca.keyfactor.com/"
+)
+
+// IssuerRef names an EJBCAIssuer, or a ClusterEJBCAIssuer if Namespace is empty.
+type IssuerRef struct {
+	Namespace string
+	Name      string
+}
+
+func (r IssuerRef) String() string {
+	if r.Namespace == "" {
+		return "ClusterEJBCAIssuer " + r.Name
+	}
+	return fmt.Sprintf("EJBCAIssuer %s/%s", r.Namespace, r.Name)
+}
+
+// SignerName returns the signer name that selects the issuer.
+func (r IssuerRef) SignerName() string {
+	if r.Namespace == "" {
+		return clusterIssuerSignerDomain + r.Name
+	}
+	return issuerSignerDomain + r.Namespace + "." + r.Name
+}
+
+// Issuer is an EJBCA connection defined by an EJBCAIssuer or ClusterEJBCAIssuer resource.
+type Issuer struct {
+	Ref       IssuerRef
+	Endpoints *EndpointPool
+	UseEST    bool
+	// Defaults replace the controller defaults for CSRs enrolled with the issuer.
+	Defaults EnrollmentDefaults
+}
+
+// IssuerResolver looks up the connections of EJBCAIssuer and ClusterEJBCAIssuer resources.
+type IssuerResolver interface {
+	// Issuer returns the issuer named by ref, nil if it doesn't exist, or an error if it isn't ready.
+	Issuer(ref IssuerRef) (*Issuer, error)
+	// Issuers returns the connections of every issuer that has one.
+	Issuers() []*Issuer
+	// HasSynced returns true once the issuers have been listed.
+	HasSynced() bool
+}
+
+// issuerRefFor returns the issuer selected by the signer name or annotations of the CSR, or nil if
+// it doesn't select one. The issuer annotation names an EJBCAIssuer of the request's namespace.
+func issuerRefFor(csr *certificates.CertificateSigningRequest, namespace string) (*IssuerRef, error) {
+	signerName := csr.Spec.SignerName
+	if name := strings.TrimPrefix(signerName, clusterIssuerSignerDomain); name != signerName {
+		return &IssuerRef{Name: name}, nil
+	}
+	if name := strings.TrimPrefix(signerName, issuerSignerDomain); name != signerName {
+		// Namespace names can't contain dots, so the first one separates the namespace
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("signer name %s must have the form %s<namespace>.<name>", signerName, issuerSignerDomain)}
+		}
+		return &IssuerRef{Namespace: parts[0], Name: parts[1]}, nil
+	}
+
+	annotations := csr.GetAnnotations()
+	issuer, hasIssuer := annotations[annotationIssuer]
+	clusterIssuer, hasClusterIssuer := annotations[annotationClusterIssuer]
+	switch {
+	case hasIssuer && hasClusterIssuer:
+		return nil, &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("only one of the %s and %s annotations may be set", annotationIssuer, annotationClusterIssuer)}
+	case hasClusterIssuer:
+		return &IssuerRef{Name: clusterIssuer}, nil
+	case hasIssuer:
+		if namespace == "" {
+			return nil, &policyError{reason: "IssuerNotAllowed", message: fmt.Sprintf("%s is not a service account; only service accounts can use a namespaced EJBCAIssuer", csr.Spec.Username)}
+		}
+		return &IssuerRef{Namespace: namespace, Name: issuer}, nil
+	}
+	return nil, nil
+}
+
+// resolveIssuer looks up the issuer selected by the CSR, if any, and applies its settings to the
+// enrollment. A namespaced issuer only serves requests from its own namespace.
+func (cc *CertificateController) resolveIssuer(enrollment *enrollmentRequest) error {
+	ref, err := issuerRefFor(enrollment.csr, enrollment.namespace)
+	if err != nil || ref == nil {
+		return err
+	}
+	if cc.issuers == nil {
+		return &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("the CSR selects %s, but issuer resources are not enabled", ref)}
+	}
+	if ref.Namespace != "" && ref.Namespace != enrollment.namespace {
+		return &policyError{reason: "IssuerNotAllowed", message: fmt.Sprintf("%s only serves requests from namespace %s", ref, ref.Namespace)}
+	}
+
+	issuer, err := cc.issuers.Issuer(*ref)
+	if err != nil {
+		return err
+	}
+	if issuer == nil {
+		return &policyError{reason: "IssuerNotFound", message: fmt.Sprintf("%s doesn't exist", ref)}
+	}
+
+	enrollment.issuer = issuer
+	enrollment.useEST = issuer.UseEST
+	enrollment.estAlias = issuer.Defaults.ESTAlias
+	enrollment.certificateAuthorityName = issuer.Defaults.CertificateAuthorityName
+	enrollment.certificateProfileName = issuer.Defaults.CertificateProfileName
+	enrollment.endEntityProfileName = issuer.Defaults.EndEntityProfileName
+	return nil
+}
+
+// isIssuerSignerName returns true if signerName selects an issuer by name.
+func isIssuerSignerName(signerName string) bool {
+	return strings.HasPrefix(signerName, issuerSignerDomain) || strings.HasPrefix(signerName, clusterIssuerSignerDomain)
+}
@@ -0,0 +1,134 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"software.sslmate.com/src/go-pkcs12"
+	"strconv"
+)
+
+// keystoreResponseFormat is the keystore format that keystore enrollment must return. The end
+// entity's token type must be P12.
+const keystoreResponseFormat = "PKCS12"
+
+// ejbcaKeySpec returns the key_alg and key_spec of keystore enrollment for a private key spec.
+func ejbcaKeySpec(spec v1alpha1.CertificatePrivateKey) (string, string) {
+	switch spec.Algorithm {
+	case v1alpha1.ECDSAKeyAlgorithm:
+		switch spec.Size {
+		case 384:
+			return "EC", "secp384r1"
+		case 521:
+			return "EC", "secp521r1"
+		}
+		return "EC", "secp256r1"
+	case v1alpha1.Ed25519KeyAlgorithm:
+		return "Ed25519", "Ed25519"
+	default:
+		size := spec.Size
+		if size == 0 {
+			size = 2048
+		}
+		return "RSA", strconv.Itoa(size)
+	}
+}
+
+// enrollKeystore has EJBCA generate the key of a Certificate for the end entity named by the
+// enrollment, with the enrollment code from the Certificate's Secret.
+func (c *ManagedCertificateController) enrollKeystore(ctx context.Context, certificate *v1alpha1.Certificate, enrollment *enrollmentRequest) (*managedIssuance, error) {
+	password, err := c.secretKey(ctx, certificate.Namespace, *certificate.Spec.EnrollmentCodeSecretRef)
+	if err != nil {
+		return nil, err
+	}
+	keyAlg, keySpec := ejbcaKeySpec(certificate.Spec.PrivateKey)
+
+	var issuance *managedIssuance
+	err = c.cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+		var err error
+		err, issuance = restEnrollKeystore(client, enrollment, keyAlg, keySpec, string(password))
+		return err
+	})
+	return issuance, err
+}
+
+// restEnrollKeystore enrolls a keystore for the end entity and unpacks the returned PKCS#12 into
+// the key and chain.
+func restEnrollKeystore(client *ejbca.Client, enrollment *enrollmentRequest, keyAlg string, keySpec string, password string) (error, *managedIssuance) {
+	handlerLog.Debugf("Enrolling %s %s keystore with REST client", keyAlg, keySpec)
+	resp, err := client.EnrollKeystore(&ejbca.EnrollKeystore{
+		Username: enrollment.username,
+		Password: password,
+		KeyAlg:   keyAlg,
+		KeySpec:  keySpec,
+	})
+	if err != nil {
+		return err, nil
+	}
+	if resp.ResponseFormat != "" && resp.ResponseFormat != keystoreResponseFormat {
+		return fmt.Errorf("EJBCA returned a %s keystore for %s; the end entity's token type must be P12", resp.ResponseFormat, enrollment.username), nil
+	}
+
+	keystore, err := base64.StdEncoding.DecodeString(resp.Certificate)
+	if err != nil {
+		return fmt.Errorf("failed to decode the keystore of %s: %v", enrollment.username, err), nil
+	}
+	key, leaf, caCerts, err := pkcs12.DecodeChain(keystore, password)
+	if err != nil {
+		return fmt.Errorf("failed to unpack the PKCS#12 keystore of %s: %v", enrollment.username, err), nil
+	}
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("the keystore of %s holds an unsupported %T private key", enrollment.username, key), nil
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	for _, cert := range caCerts {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	if len(caCerts) == 0 {
+		for _, encoded := range resp.CertificateChain {
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return err, nil
+			}
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+	}
+	return nil, &managedIssuance{key: privateKey, chain: chain}
+}
+
+// checkIssuedNames applies the subject and SAN checks to a certificate that EJBCA generated from
+// the end entity, since they couldn't be checked before enrollment. The common name must be the
+// end entity that was requested, and the subject and every DNS, IP, URI and email SAN of the
+// certificate go through the checks of the signer policy's mode, the namespace restrictions and
+// SAN ownership verification as if they had been requested.
+func (cc *CertificateController) checkIssuedNames(ctx context.Context, enrollment *enrollmentRequest, leaf *x509.Certificate) error {
+	if leaf.Subject.CommonName != enrollment.request.Subject.CommonName {
+		return &policyError{reason: "SubjectMismatch", message: fmt.Sprintf("EJBCA issued a certificate for %q instead of end entity %q", leaf.Subject.CommonName, enrollment.request.Subject.CommonName)}
+	}
+
+	issued := *enrollment.request
+	issued.Subject = leaf.Subject
+	issued.DNSNames = leaf.DNSNames
+	issued.IPAddresses = leaf.IPAddresses
+	issued.URIs = leaf.URIs
+	issued.EmailAddresses = leaf.EmailAddresses
+	checked := *enrollment
+	checked.request = &issued
+
+	if err := cc.checkMode(ctx, &checked); err != nil {
+		return err
+	}
+	if checked.namespacePolicy != nil {
+		if err := checked.namespacePolicy.checkDNSNames(requestedDNSNames(&issued)); err != nil {
+			return err
+		}
+	}
+	return cc.verifyOwnership(ctx, &checked)
+}
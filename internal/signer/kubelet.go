@@ -0,0 +1,152 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+const (
+	nodeUsernamePrefix = "system:node:"
+	nodesGroup         = "system:nodes"
+)
+
+// Usages a kubelet serving certificate may request. Server auth is required.
+var kubeletServingAllowedUsages = map[certificates.KeyUsage]bool{
+	certificates.UsageDigitalSignature: true,
+	certificates.UsageKeyEncipherment:  true,
+	certificates.UsageServerAuth:       true,
+}
+
+// checkKubeletServing verifies a kubelet serving CSR against the identity of the requesting node:
+// the requester must be system:node:<name> in the system:nodes group, the subject must be
+// CN=system:node:<name>, O=system:nodes, every DNS and IP SAN must be one of the Node's
+// status.addresses, and the usages must be limited to server auth.
+func (cc *CertificateController) checkKubeletServing(ctx context.Context, enrollment *enrollmentRequest) error {
+	csr := enrollment.csr
+	request := enrollment.request
+
+	nodeName := strings.TrimPrefix(csr.Spec.Username, nodeUsernamePrefix)
+	if nodeName == csr.Spec.Username || nodeName == "" {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("%s is not a node", csr.Spec.Username)}
+	}
+	if !containsString(csr.Spec.Groups, nodesGroup) {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("%s is not in the %s group", csr.Spec.Username, nodesGroup)}
+	}
+
+	if request.Subject.CommonName != csr.Spec.Username {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("common name %q must be %q", request.Subject.CommonName, csr.Spec.Username)}
+	}
+	if len(request.Subject.Organization) != 1 || request.Subject.Organization[0] != nodesGroup {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("organization %v must be [%s]", request.Subject.Organization, nodesGroup)}
+	}
+	if len(request.URIs) > 0 || len(request.EmailAddresses) > 0 {
+		return &policyError{reason: "InvalidNodeIdentity", message: "a kubelet serving certificate must not have URI or email SANs"}
+	}
+	if len(request.DNSNames) == 0 && len(request.IPAddresses) == 0 {
+		return &policyError{reason: "InvalidNodeIdentity", message: "a kubelet serving certificate must have at least one DNS or IP SAN"}
+	}
+
+	hasServerAuth := false
+	for _, usage := range csr.Spec.Usages {
+		if !kubeletServingAllowedUsages[usage] {
+			return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("usage %q is not allowed for a kubelet serving certificate", usage)}
+		}
+		if usage == certificates.UsageServerAuth {
+			hasServerAuth = true
+		}
+	}
+	if !hasServerAuth {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("a kubelet serving certificate must request the %q usage", certificates.UsageServerAuth)}
+	}
+
+	node, err := cc.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("node %s doesn't exist", nodeName)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+
+	dnsNames := make(map[string]bool)
+	ips := make(map[string]bool)
+	for _, address := range node.Status.Addresses {
+		switch address.Type {
+		case corev1.NodeHostName, corev1.NodeInternalDNS, corev1.NodeExternalDNS:
+			dnsNames[strings.ToLower(address.Address)] = true
+		case corev1.NodeInternalIP, corev1.NodeExternalIP:
+			ips[address.Address] = true
+		}
+	}
+	for _, dnsName := range request.DNSNames {
+		if !dnsNames[strings.ToLower(dnsName)] {
+			return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("DNS name %q is not an address of node %s", dnsName, nodeName)}
+		}
+	}
+	for _, ip := range request.IPAddresses {
+		if !ips[ip.String()] {
+			return &policyError{reason: "InvalidNodeIdentity", message: fmt.Sprintf("IP address %s is not an address of node %s", ip, nodeName)}
+		}
+	}
+	return nil
+}
+
+// autoApprove approves a pending CSR whose signer policy allows auto-approval if it passes the
+// policy's checks, and denies it otherwise. Signing happens once the approval is observed.
+func (cc *CertificateController) autoApprove(ctx context.Context, csr *certificates.CertificateSigningRequest) error {
+	enrollment, err := cc.resolveEnrollment(csr, csrNamespace(csr))
+	if err == nil {
+		err = cc.checkMode(ctx, enrollment)
+	}
+
+	condition := certificates.CertificateSigningRequestCondition{
+		Type:           certificates.CertificateApproved,
+		Status:         corev1.ConditionTrue,
+		Reason:         "AutoApproved",
+		Message:        fmt.Sprintf("Auto-approved by %s after verifying the requester's identity", cc.name),
+		LastUpdateTime: v1.Now(),
+	}
+	eventType := corev1.EventTypeNormal
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		condition.Type = certificates.CertificateDenied
+		condition.Reason = policyErr.reason
+		condition.Message = policyErr.message
+		eventType = corev1.EventTypeWarning
+	} else if err != nil {
+		return err
+	}
+
+	if cc.dryRun {
+		if !cc.firstDryRun(csr.UID, "condition/"+string(condition.Type)+"/"+condition.Reason) {
+			return nil
+		}
+		handlerLog.Infof("Dry run: certificate request %s would be %s: %s", csr.Name, strings.ToLower(string(condition.Type)), condition.Message)
+		cc.recorder.Event(csr, eventType, "DryRun", fmt.Sprintf("Dry run: the signer would set the %s condition: %s", condition.Type, condition.Message))
+		return nil
+	}
+
+	handlerLog.Infof("Setting the %s condition on certificate request %s: %s", condition.Type, csr.Name, condition.Message)
+	csr.Status.Conditions = append(csr.Status.Conditions, condition)
+	_, err = cc.kubeClient.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, csr.Name, csr, v1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update approval of %s: %v", csr.Name, err)
+	}
+	cc.recorder.Event(csr, eventType, condition.Reason, condition.Message)
+	return nil
+}
+
+// containsString returns true if values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// issuedLifetimeTolerance is allowed on top of the lifetime limit of an enrollment, since EJBCA
+// backdates the start of validity by ten minutes by default.
+const issuedLifetimeTolerance = 10 * time.Minute
+
+// limitLifetime limits the lifetime of the certificate issued for the enrollment to limit, unless
+// a shorter limit is already set.
+func (e *enrollmentRequest) limitLifetime(limit time.Duration) {
+	if limit > 0 && (e.maxLifetime == 0 || limit < e.maxLifetime) {
+		e.maxLifetime = limit
+	}
+}
+
+// limitToRequestedLifetime limits the lifetime of the certificate to the expirationSeconds of the
+// CSR. It's used for Certificates and cert-manager CertificateRequests, whose requested duration
+// EJBCA doesn't receive and so can only be checked once the certificate is issued.
+func (e *enrollmentRequest) limitToRequestedLifetime() {
+	if seconds := e.csr.Spec.ExpirationSeconds; seconds != nil {
+		e.limitLifetime(time.Duration(*seconds) * time.Second)
+	}
+}
+
+// checkIssuedLifetime fails a certificate whose lifetime exceeds the limit of the enrollment. The
+// lifetime is decided by the certificate profile in EJBCA, so it can only be checked after issuance.
+func checkIssuedLifetime(enrollment *enrollmentRequest, leaf *x509.Certificate) error {
+	if enrollment.maxLifetime == 0 {
+		return nil
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > enrollment.maxLifetime+issuedLifetimeTolerance {
+		return &policyError{reason: "LifetimeExceeded", message: fmt.Sprintf("EJBCA issued a certificate valid for %s, which exceeds the maximum of %s; the certificate profile must issue shorter certificates", lifetime.Round(time.Second), enrollment.maxLifetime)}
+	}
+	return nil
+}
+
+// verifyIssued applies the checks that can only be made once EJBCA issued the certificate: its
+// lifetime, and its names if EJBCA generated it from the end entity. A certificate that fails them
+// is revoked and a *policyError is returned; if it can't be revoked, the error is returned so the
+// check is retried with the same chain.
+func (cc *CertificateController) verifyIssued(ctx context.Context, enrollment *enrollmentRequest, chain []byte) error {
+	leaf, err := parseLeafCertificate(chain)
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		return errors.New("EJBCA returned no certificate")
+	}
+	err = checkIssuedLifetime(enrollment, leaf)
+	if err == nil && enrollment.generatedByEJBCA {
+		err = cc.checkIssuedNames(ctx, enrollment, leaf)
+	}
+	var policyErr *policyError
+	if !errors.As(err, &policyErr) {
+		return err
+	}
+	if revokeErr := cc.revokeRejected(ctx, enrollment, leaf, policyErr); revokeErr != nil {
+		return revokeErr
+	}
+	return policyErr
+}
@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+)
+
+func TestLimitLifetime(t *testing.T) {
+	seconds := func(s int32) *int32 { return &s }
+	tests := []struct {
+		name              string
+		limit             time.Duration
+		expirationSeconds *int32
+		want              time.Duration
+	}{
+		{name: "no limit"},
+		{name: "policy limit", limit: 24 * time.Hour, want: 24 * time.Hour},
+		{name: "shorter requested lifetime", limit: 24 * time.Hour, expirationSeconds: seconds(3600), want: time.Hour},
+		{name: "longer requested lifetime", limit: time.Hour, expirationSeconds: seconds(86400), want: time.Hour},
+		{name: "requested lifetime only", expirationSeconds: seconds(3600), want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enrollment := &enrollmentRequest{csr: &certificates.CertificateSigningRequest{
+				Spec: certificates.CertificateSigningRequestSpec{ExpirationSeconds: tt.expirationSeconds},
+			}}
+			enrollment.limitLifetime(tt.limit)
+			enrollment.limitToRequestedLifetime()
+			if enrollment.maxLifetime != tt.want {
+				t.Fatalf("maxLifetime = %v, want %v", enrollment.maxLifetime, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIssuedLifetime(t *testing.T) {
+	notBefore := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name        string
+		maxLifetime time.Duration
+		lifetime    time.Duration
+		wantErr     bool
+	}{
+		{name: "no limit", lifetime: 365 * 24 * time.Hour},
+		{name: "within the limit", maxLifetime: 24 * time.Hour, lifetime: 24 * time.Hour},
+		{name: "backdated by EJBCA", maxLifetime: 24 * time.Hour, lifetime: 24*time.Hour + issuedLifetimeTolerance},
+		{name: "beyond the tolerance", maxLifetime: 24 * time.Hour, lifetime: 24*time.Hour + issuedLifetimeTolerance + time.Second, wantErr: true},
+		{name: "profile ignores the limit", maxLifetime: time.Hour, lifetime: 365 * 24 * time.Hour, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(tt.lifetime)}
+			err := checkIssuedLifetime(&enrollmentRequest{maxLifetime: tt.maxLifetime}, leaf)
+			var policyErr *policyError
+			switch {
+			case tt.wantErr && !errors.As(err, &policyErr):
+				t.Fatalf("checkIssuedLifetime returned %v, want a policy error", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("checkIssuedLifetime returned %v", err)
+			}
+		})
+	}
+}
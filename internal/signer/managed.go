@@ -0,0 +1,779 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"net"
+	"net/url"
+	"software.sslmate.com/src/go-pkcs12"
+	"sync"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// managedCertificateSignerName is the signer name of Certificates that don't select an issuer, so
+// that signer policies can apply to them.
+const managedCertificateSignerName = "ejbca.keyfactor.com/certificate"
+
+// Keys of the Secret of a Certificate, in addition to tls.crt and tls.key.
+const (
+	secretKeyCA     = "ca.crt"
+	secretKeyPKCS12 = "keystore.p12"
+	secretKeyJKS    = "keystore.jks"
+)
+
+// Annotations of the Secret of a Certificate. The spec hash covers the fields that require a new
+// certificate when they change.
+const (
+	annotationCertificateName     = "ejbca.keyfactor.com/certificate-name"
+	annotationCertificateSpecHash = "ejbca.keyfactor.com/certificate-spec-hash"
+)
+
+// Identity a Certificate is enrolled as. Certificates have no requesting user, so they are
+// authorized as a user of their own and the groups of all Certificates and of the Certificates of
+// their namespace, rather than as the service accounts of their namespace.
+const (
+	certificateUsernamePrefix = "ejbca.keyfactor.com:certificate:"
+	certificatesGroup         = "ejbca.keyfactor.com:certificates"
+)
+
+// jksAlias is the alias of the private key entry of JKS keystores.
+const jksAlias = "certificate"
+
+// managedIssuance is a key and the chain EJBCA issued for it.
+type managedIssuance struct {
+	key   crypto.Signer
+	chain []byte
+	// enrollment is the enrollment the chain was issued for.
+	enrollment *enrollmentRequest
+	// specHash is the hash of the Certificate spec the chain was issued for.
+	specHash string
+	// verified is set once the chain passed the checks made after issuance, and rejected once it
+	// failed them.
+	verified bool
+	rejected bool
+}
+
+// ManagedCertificateController reconciles Certificate resources: it generates a private key,
+// enrolls it through the CertificateController, writes the result to the Certificate's Secret and
+// renews the certificate before it expires.
+type ManagedCertificateController struct {
+	cc            *CertificateController
+	dynamicClient dynamic.Interface
+
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+
+	// issued holds issuances, keyed by Certificate UID, until they are written to the Secret, so
+	// that a failed Secret update doesn't enroll again. An issuance for an earlier spec is dropped.
+	issued sync.Map
+}
+
+// NewManagedCertificateController creates a controller for Certificate resources that enrolls
+// them through cc. Run must be called to start it.
+func NewManagedCertificateController(cc *CertificateController, dynamicClient dynamic.Interface, resyncPeriod time.Duration) *ManagedCertificateController {
+	c := &ManagedCertificateController{
+		cc:            cc,
+		dynamicClient: dynamicClient,
+		factory:       dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, resyncPeriod),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "certificate"),
+	}
+	c.informer = c.factory.ForResource(v1alpha1.CertificateResource).Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if accessor, err := meta.Accessor(obj); err == nil {
+				c.issued.Delete(accessor.GetUID())
+			}
+		},
+	})
+	return c
+}
+
+func (c *ManagedCertificateController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %+v: %v", obj, err))
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts the informer and workers and blocks until ctx is cancelled.
+func (c *ManagedCertificateController) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	signerLog.Infoln("Starting Certificate controller")
+	defer signerLog.Infoln("Shutting down Certificate controller")
+
+	c.factory.Start(ctx.Done())
+	if !cache.WaitForNamedCacheSync("certificate", ctx.Done(), c.informer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	<-ctx.Done()
+}
+
+func (c *ManagedCertificateController) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *ManagedCertificateController) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		utilruntime.HandleError(fmt.Errorf("sync %v failed with: %v", key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync issues the certificate of a Certificate if its Secret doesn't hold a valid one for the
+// current spec, or if it's due for renewal, and schedules the next renewal.
+func (c *ManagedCertificateController) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	object := obj.(*unstructured.Unstructured)
+	certificate := &v1alpha1.Certificate{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, certificate); err != nil {
+		return fmt.Errorf("failed to decode Certificate %s: %v", key, err)
+	}
+
+	if err = validateCertificateSpec(&certificate.Spec); err != nil {
+		return c.setReady(ctx, object, certificate, metav1.ConditionFalse, "InvalidSpec", err.Error())
+	}
+
+	secret, err := c.cc.kubeClient.CoreV1().Secrets(certificate.Namespace).Get(ctx, certificate.Spec.SecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get Secret %s/%s: %v", certificate.Namespace, certificate.Spec.SecretName, err)
+	}
+	if secret != nil && !metav1.IsControlledBy(secret, certificate) {
+		// only Secrets this Certificate created are written, never one created by someone else
+		message := fmt.Sprintf("Secret %s exists and isn't controlled by this Certificate", certificate.Spec.SecretName)
+		if owner := secret.Annotations[annotationCertificateName]; owner != "" && owner != certificate.Name {
+			message = fmt.Sprintf("Secret %s belongs to Certificate %s", certificate.Spec.SecretName, owner)
+		}
+		return c.setReady(ctx, object, certificate, metav1.ConditionFalse, "SecretInUse", message)
+	}
+
+	specHash := certificateSpecHash(&certificate.Spec)
+	leaf, privateKey, reason := certificateInSecret(certificate, secret, specHash)
+	if reason == "" {
+		if !keystoresUpToDate(certificate, secret) {
+			handlerLog.Infof("Updating the keystores of Certificate %s", key)
+			if err = c.writeSecret(ctx, certificate, secret, privateKey, secret.Data[corev1.TLSCertKey], specHash); err != nil {
+				return err
+			}
+		}
+		return c.ready(ctx, object, certificate, leaf)
+	}
+
+	handlerLog.Infof("Issuing Certificate %s: %s", key, reason)
+	issuance, err := c.issue(ctx, object, certificate)
+	if err != nil || issuance == nil {
+		return err
+	}
+	if err = c.writeSecret(ctx, certificate, secret, issuance.key, issuance.chain, specHash); err != nil {
+		return err
+	}
+	c.issued.Delete(certificate.UID)
+
+	if leaf, err = parseLeafCertificate(issuance.chain); err != nil {
+		return err
+	}
+	c.cc.recorder.Event(object, corev1.EventTypeNormal, "Issued", fmt.Sprintf("Certificate with serial number %X issued by EJBCA and written to Secret %s", leaf.SerialNumber, certificate.Spec.SecretName))
+	return c.ready(ctx, object, certificate, leaf)
+}
+
+// issue generates a key and enrolls it with EJBCA. It returns nil without an error if the
+// Certificate must not be enrolled, after reporting why in its Ready condition.
+func (c *ManagedCertificateController) issue(ctx context.Context, object *unstructured.Unstructured, certificate *v1alpha1.Certificate) (*managedIssuance, error) {
+	if issued, ok := c.issued.Load(certificate.UID); ok {
+		issuance := issued.(*managedIssuance)
+		switch {
+		case issuance.specHash != certificateSpecHash(&certificate.Spec):
+			// the spec changed since, so the issuance is for a certificate that's no longer wanted
+			c.issued.Delete(certificate.UID)
+		case issuance.rejected:
+			// enrolling the same spec again would be rejected again
+			return nil, nil
+		case !issuance.verified:
+			return c.verify(ctx, object, certificate, issuance)
+		default:
+			return issuance, nil
+		}
+	}
+
+	serverSide := certificate.Spec.PrivateKey.Generator == v1alpha1.EJBCAKeyGenerator
+	keySpec := certificate.Spec.PrivateKey
+	if serverSide {
+		// EJBCA generates the key, so the CSR only carries the end entity name through the policy
+		// checks; the names EJBCA issues are checked after enrollment.
+		keySpec = v1alpha1.CertificatePrivateKey{Algorithm: v1alpha1.ECDSAKeyAlgorithm}
+	}
+	privateKey, err := generatePrivateKey(keySpec)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := certificateToCSR(certificate, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := c.cc
+	enrollment, err := cc.resolveEnrollment(csr, certificate.Namespace)
+	if err == nil {
+		enrollment.limitToRequestedLifetime()
+		enrollment.generatedByEJBCA = serverSide
+		err = cc.checkPolicy(ctx, enrollment)
+	}
+	if err == nil && serverSide && enrollment.useEST {
+		err = &policyError{reason: "KeystoreEnrollmentUnsupported", message: "EJBCA can only generate keys with the REST API, but the selected connection uses EST"}
+	}
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		return nil, c.fail(ctx, object, certificate, csr, enrollment, policyErr, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.dryRun {
+		cc.recorder.Event(object, corev1.EventTypeNormal, "DryRun", "Dry run: the signer would enroll this certificate with "+enrollment.describe())
+		cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, "", enrollment.describe(), nil)
+		return nil, nil
+	}
+
+	var issuance *managedIssuance
+	if serverSide {
+		issuance, err = c.enrollKeystore(ctx, certificate, enrollment)
+	} else {
+		var chain []byte
+		err = cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+			var err error
+			if enrollment.useEST {
+				err, chain = estEnrollCSR(client.EST, enrollment)
+			} else {
+				err, chain = restEnrollCSR(client, enrollment)
+			}
+			return err
+		})
+		issuance = &managedIssuance{key: privateKey, chain: chain}
+	}
+	if err != nil {
+		cc.recordAudit(csr, enrollment, audit.OutcomeError, "EnrollmentFailed", err.Error(), nil)
+		if statusErr := c.setReady(ctx, object, certificate, metav1.ConditionFalse, "Pending", fmt.Sprintf("Enrollment with EJBCA failed and will be retried: %v", err)); statusErr != nil {
+			handlerLog.Errorf("Failed to update the status of Certificate %s/%s: %v", certificate.Namespace, certificate.Name, statusErr)
+		}
+		return nil, err
+	}
+	cc.recordAudit(csr, enrollment, audit.OutcomeIssued, "", "", issuance.chain)
+
+	// Keep the issuance until it's written, so that a failed check or Secret update doesn't
+	// enroll again
+	issuance.enrollment = enrollment
+	issuance.specHash = certificateSpecHash(&certificate.Spec)
+	c.issued.Store(certificate.UID, issuance)
+	return c.verify(ctx, object, certificate, issuance)
+}
+
+// verify applies the checks that can only be made once EJBCA issued the certificate, and records
+// it in the inventory if it passes them. It returns nil without an error if the certificate was
+// rejected, after reporting why in the Certificate's Ready condition; the Certificate isn't
+// enrolled again until its spec changes.
+func (c *ManagedCertificateController) verify(ctx context.Context, object *unstructured.Unstructured, certificate *v1alpha1.Certificate, issuance *managedIssuance) (*managedIssuance, error) {
+	cc := c.cc
+	enrollment := issuance.enrollment
+	csr := enrollment.csr
+	err := cc.verifyIssued(ctx, enrollment, issuance.chain)
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		if err = c.fail(ctx, object, certificate, csr, enrollment, policyErr, issuance.chain); err != nil {
+			return nil, err
+		}
+		issuance.rejected = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	issuance.verified = true
+	cc.recordIssuedCertificate(ctx, v1alpha1.IssuedCertificateSource{Kind: v1alpha1.CertificateKind, Namespace: certificate.Namespace, Name: certificate.Name, UID: string(certificate.UID)}, csr, enrollment, issuance.chain)
+	return issuance, nil
+}
+
+// fail reports why a Certificate must not be enrolled, or why its certificate must not be used,
+// in its Ready condition. In dry-run mode it only records the decision.
+func (c *ManagedCertificateController) fail(ctx context.Context, object *unstructured.Unstructured, certificate *v1alpha1.Certificate, csr *certificates.CertificateSigningRequest, enrollment *enrollmentRequest, policyErr *policyError, chain []byte) error {
+	cc := c.cc
+	if cc.dryRun {
+		cc.recorder.Event(object, corev1.EventTypeWarning, "DryRunFailed", fmt.Sprintf("Dry run: the signer would fail this certificate: %s: %s", policyErr.reason, policyErr.message))
+		cc.recordAudit(csr, enrollment, audit.OutcomeDryRun, policyErr.reason, policyErr.message, nil)
+		return nil
+	}
+	cc.recordAudit(csr, enrollment, audit.OutcomeFailed, policyErr.reason, policyErr.message, chain)
+	cc.recorder.Event(object, corev1.EventTypeWarning, policyErr.reason, policyErr.message)
+	return c.setReady(ctx, object, certificate, metav1.ConditionFalse, policyErr.reason, policyErr.message)
+}
+
+// ready reports the certificate in the Secret in the status and schedules its renewal.
+func (c *ManagedCertificateController) ready(ctx context.Context, object *unstructured.Unstructured, certificate *v1alpha1.Certificate, leaf *x509.Certificate) error {
+	renewal := renewalTime(leaf, certificate.Spec.RenewBefore)
+	status := &certificate.Status
+	status.NotBefore = &metav1.Time{Time: leaf.NotBefore}
+	status.NotAfter = &metav1.Time{Time: leaf.NotAfter}
+	status.SerialNumber = fmt.Sprintf("%X", leaf.SerialNumber)
+	status.RenewalTime = &metav1.Time{Time: renewal}
+
+	message := fmt.Sprintf("The certificate is valid until %s and will be renewed at %s", leaf.NotAfter.UTC().Format(time.RFC3339), renewal.UTC().Format(time.RFC3339))
+	if err := c.setReady(ctx, object, certificate, metav1.ConditionTrue, "Issued", message); err != nil {
+		return err
+	}
+
+	key, _ := cache.MetaNamespaceKeyFunc(object)
+	c.queue.AddAfter(key, time.Until(renewal))
+	return nil
+}
+
+// setReady sets the Ready condition and writes the status if it changed.
+func (c *ManagedCertificateController) setReady(ctx context.Context, object *unstructured.Unstructured, certificate *v1alpha1.Certificate, status metav1.ConditionStatus, reason string, message string) error {
+	meta.SetStatusCondition(&certificate.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionReady,
+		Status:             status,
+		ObservedGeneration: certificate.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+
+	updated, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&certificate.Status)
+	if err != nil {
+		return err
+	}
+	if current, _, _ := unstructured.NestedMap(object.Object, "status"); equality.Semantic.DeepEqual(current, updated) {
+		return nil
+	}
+	object = object.DeepCopy()
+	object.Object["status"] = updated
+
+	resource := c.dynamicClient.Resource(v1alpha1.CertificateResource).Namespace(certificate.Namespace)
+	if _, err = resource.UpdateStatus(ctx, object, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update the status of Certificate %s/%s: %v", certificate.Namespace, certificate.Name, err)
+	}
+	handlerLog.Infof("Set the Ready condition of Certificate %s/%s to %s: %s", certificate.Namespace, certificate.Name, status, message)
+	return nil
+}
+
+// writeSecret writes the key, chain and keystores of the Certificate to its Secret, creating it if
+// secret is nil. The Secret is owned by the Certificate, so it's deleted with it.
+func (c *ManagedCertificateController) writeSecret(ctx context.Context, certificate *v1alpha1.Certificate, secret *corev1.Secret, privateKey crypto.Signer, chain []byte, specHash string) error {
+	data, err := c.secretData(ctx, certificate, privateKey, chain)
+	if err != nil {
+		return err
+	}
+
+	secrets := c.cc.kubeClient.CoreV1().Secrets(certificate.Namespace)
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: certificate.Spec.SecretName, Namespace: certificate.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+		secret.Annotations = map[string]string{annotationCertificateName: certificate.Name, annotationCertificateSpecHash: specHash}
+		secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(certificate, v1alpha1.SchemeGroupVersion.WithKind(v1alpha1.CertificateKind))}
+		secret.Data = data
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret = secret.DeepCopy()
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[annotationCertificateName] = certificate.Name
+		secret.Annotations[annotationCertificateSpecHash] = specHash
+		secret.Data = data
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write Secret %s/%s: %v", certificate.Namespace, certificate.Spec.SecretName, err)
+	}
+	return nil
+}
+
+// secretData returns the Secret data of a key and chain: tls.crt, tls.key, ca.crt if the chain
+// includes a CA, and the keystores of the spec.
+func (c *ManagedCertificateController) secretData(ctx context.Context, certificate *v1alpha1.Certificate, privateKey crypto.Signer, chain []byte) (map[string][]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the private key: %v", err)
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       chain,
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	if ca := lastCertificate(chain); ca != nil {
+		data[secretKeyCA] = ca
+	}
+
+	keystores := certificate.Spec.Keystores
+	if keystores == nil || (keystores.PKCS12 == nil && keystores.JKS == nil) {
+		return data, nil
+	}
+	certs, err := parseChain(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	if keystores.PKCS12 != nil {
+		password, err := c.secretKey(ctx, certificate.Namespace, keystores.PKCS12.PasswordSecretRef)
+		if err != nil {
+			return nil, err
+		}
+		if data[secretKeyPKCS12], err = pkcs12.Encode(rand.Reader, privateKey, certs[0], certs[1:], string(password)); err != nil {
+			return nil, fmt.Errorf("failed to encode the PKCS#12 keystore: %v", err)
+		}
+	}
+
+	if keystores.JKS != nil {
+		password, err := c.secretKey(ctx, certificate.Namespace, keystores.JKS.PasswordSecretRef)
+		if err != nil {
+			return nil, err
+		}
+		entry := keystore.PrivateKeyEntry{CreationTime: time.Now(), PrivateKey: keyDER}
+		for _, cert := range certs {
+			entry.CertificateChain = append(entry.CertificateChain, keystore.Certificate{Type: "X509", Content: cert.Raw})
+		}
+		ks := keystore.New()
+		if err = ks.SetPrivateKeyEntry(jksAlias, entry, password); err != nil {
+			return nil, fmt.Errorf("failed to add the private key to the JKS keystore: %v", err)
+		}
+		var buf bytes.Buffer
+		if err = ks.Store(&buf, password); err != nil {
+			return nil, fmt.Errorf("failed to encode the JKS keystore: %v", err)
+		}
+		data[secretKeyJKS] = buf.Bytes()
+	}
+	return data, nil
+}
+
+// secretKey reads a password or enrollment code from a Secret of the Certificate's namespace.
+func (c *ManagedCertificateController) secretKey(ctx context.Context, namespace string, ref v1alpha1.SecretKeySelector) ([]byte, error) {
+	secret, err := c.cc.kubeClient.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Secret %s/%s: %v", namespace, ref.Name, err)
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s/%s has no key %s", namespace, ref.Name, ref.Key)
+	}
+	return value, nil
+}
+
+// validateCertificateSpec checks the parts of the spec that the API server doesn't.
+func validateCertificateSpec(spec *v1alpha1.CertificateSpec) error {
+	if spec.SecretName == "" {
+		return errors.New("spec.secretName must be set")
+	}
+	switch spec.PrivateKey.Generator {
+	case "", v1alpha1.SignerKeyGenerator:
+	case v1alpha1.EJBCAKeyGenerator:
+		if spec.CommonName == "" {
+			return errors.New("spec.commonName must name the EJBCA end entity when EJBCA generates the key")
+		}
+		if spec.EnrollmentCodeSecretRef == nil || spec.EnrollmentCodeSecretRef.Name == "" || spec.EnrollmentCodeSecretRef.Key == "" {
+			return errors.New("spec.enrollmentCodeSecretRef must set name and key when EJBCA generates the key")
+		}
+		if spec.Subject != nil || len(spec.DNSNames) > 0 || len(spec.IPAddresses) > 0 || len(spec.URIs) > 0 || len(spec.EmailAddresses) > 0 {
+			return errors.New("spec.subject and SANs must be empty when EJBCA generates the key; EJBCA uses those of the end entity")
+		}
+	default:
+		return fmt.Errorf("spec.privateKey.generator must be Signer or EJBCA, got %q", spec.PrivateKey.Generator)
+	}
+	switch spec.PrivateKey.Algorithm {
+	case "", v1alpha1.RSAKeyAlgorithm:
+		if spec.PrivateKey.Size != 0 && (spec.PrivateKey.Size < 2048 || spec.PrivateKey.Size > 8192) {
+			return fmt.Errorf("spec.privateKey.size must be between 2048 and 8192 for RSA, got %d", spec.PrivateKey.Size)
+		}
+	case v1alpha1.ECDSAKeyAlgorithm:
+		switch spec.PrivateKey.Size {
+		case 0, 256, 384, 521:
+		default:
+			return fmt.Errorf("spec.privateKey.size must be 256, 384 or 521 for ECDSA, got %d", spec.PrivateKey.Size)
+		}
+	case v1alpha1.Ed25519KeyAlgorithm:
+	default:
+		return fmt.Errorf("spec.privateKey.algorithm must be RSA, ECDSA or Ed25519, got %q", spec.PrivateKey.Algorithm)
+	}
+	for _, ip := range spec.IPAddresses {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("spec.ipAddresses entry %q is not an IP address", ip)
+		}
+	}
+	for _, uri := range spec.URIs {
+		if _, err := url.Parse(uri); err != nil {
+			return fmt.Errorf("spec.uris entry %q is not a URI: %v", uri, err)
+		}
+	}
+	if spec.IssuerRef != nil {
+		switch spec.IssuerRef.Kind {
+		case "", v1alpha1.EJBCAIssuerKind, v1alpha1.ClusterEJBCAIssuerKind:
+		default:
+			return fmt.Errorf("spec.issuerRef.kind must be %s or %s, got %q", v1alpha1.EJBCAIssuerKind, v1alpha1.ClusterEJBCAIssuerKind, spec.IssuerRef.Kind)
+		}
+	}
+	if keystores := spec.Keystores; keystores != nil {
+		for name, options := range map[string]*v1alpha1.KeystoreOptions{"pkcs12": keystores.PKCS12, "jks": keystores.JKS} {
+			if options != nil && (options.PasswordSecretRef.Name == "" || options.PasswordSecretRef.Key == "") {
+				return fmt.Errorf("spec.keystores.%s.passwordSecretRef must set name and key", name)
+			}
+		}
+	}
+	return nil
+}
+
+// certificateSpecHash hashes the fields of the spec that the issued certificate depends on.
+func certificateSpecHash(spec *v1alpha1.CertificateSpec) string {
+	issuance := *spec
+	issuance.SecretName = ""
+	issuance.RenewBefore = nil
+	issuance.Keystores = nil
+	encoded, _ := json.Marshal(&issuance)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// certificateInSecret returns the certificate and key in the Secret of a Certificate, or the reason
+// a new certificate must be issued.
+func certificateInSecret(certificate *v1alpha1.Certificate, secret *corev1.Secret, specHash string) (*x509.Certificate, crypto.Signer, string) {
+	if secret == nil {
+		return nil, nil, fmt.Sprintf("Secret %s doesn't exist", certificate.Spec.SecretName)
+	}
+	if secret.Annotations[annotationCertificateSpecHash] != specHash {
+		return nil, nil, "the spec changed"
+	}
+	leaf, err := parseLeafCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return nil, nil, fmt.Sprintf("Secret %s has no valid certificate: %v", secret.Name, err)
+	}
+	privateKey, err := parsePrivateKey(secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, nil, fmt.Sprintf("Secret %s has no valid private key: %v", secret.Name, err)
+	}
+	if publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(leaf.PublicKey) {
+		return nil, nil, fmt.Sprintf("the private key in Secret %s doesn't match the certificate", secret.Name)
+	}
+	if !time.Now().Before(renewalTime(leaf, certificate.Spec.RenewBefore)) {
+		return nil, nil, fmt.Sprintf("the certificate expires at %s and is due for renewal", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return leaf, privateKey, ""
+}
+
+// keystoresUpToDate returns true if the Secret has exactly the keystores of the spec.
+func keystoresUpToDate(certificate *v1alpha1.Certificate, secret *corev1.Secret) bool {
+	keystores := certificate.Spec.Keystores
+	if keystores == nil {
+		keystores = &v1alpha1.CertificateKeystores{}
+	}
+	_, hasPKCS12 := secret.Data[secretKeyPKCS12]
+	_, hasJKS := secret.Data[secretKeyJKS]
+	return hasPKCS12 == (keystores.PKCS12 != nil) && hasJKS == (keystores.JKS != nil)
+}
+
+// renewalTime returns when a certificate is renewed: renewBefore before it expires, or after two
+// thirds of its lifetime if renewBefore isn't set or isn't shorter than the lifetime.
+func renewalTime(leaf *x509.Certificate, renewBefore *metav1.Duration) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	before := lifetime / 3
+	if renewBefore != nil && renewBefore.Duration > 0 && renewBefore.Duration < lifetime {
+		before = renewBefore.Duration
+	}
+	return leaf.NotAfter.Add(-before)
+}
+
+// generatePrivateKey generates a key of the requested algorithm and size.
+func generatePrivateKey(spec v1alpha1.CertificatePrivateKey) (crypto.Signer, error) {
+	switch spec.Algorithm {
+	case v1alpha1.ECDSAKeyAlgorithm:
+		curve := elliptic.P256()
+		switch spec.Size {
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case v1alpha1.Ed25519KeyAlgorithm:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		size := spec.Size
+		if size == 0 {
+			size = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	}
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// parseChain parses every certificate of a PEM chain, leaf first.
+func parseChain(chain []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := chain; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate chain: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("certificate chain is empty")
+	}
+	return certs, nil
+}
+
+// certificateToCSR creates a CSR for the Certificate's key and subject and expresses it as a CSR
+// of the selected issuer's signer name, or managedCertificateSignerName. Certificates have no
+// requesting user; they are authorized as the service accounts of their namespace.
+func certificateToCSR(certificate *v1alpha1.Certificate, privateKey crypto.Signer) (*certificates.CertificateSigningRequest, error) {
+	spec := &certificate.Spec
+	template := &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: spec.CommonName},
+		DNSNames:       spec.DNSNames,
+		EmailAddresses: spec.EmailAddresses,
+	}
+	if subject := spec.Subject; subject != nil {
+		template.Subject.Organization = subject.Organizations
+		template.Subject.OrganizationalUnit = subject.OrganizationalUnits
+		template.Subject.Country = subject.Countries
+		template.Subject.Province = subject.Provinces
+		template.Subject.Locality = subject.Localities
+	}
+	for _, ip := range spec.IPAddresses {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+	for _, uri := range spec.URIs {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the CSR of Certificate %s/%s: %v", certificate.Namespace, certificate.Name, err)
+	}
+
+	signerName := managedCertificateSignerName
+	if ref := spec.IssuerRef; ref != nil {
+		issuerRef := IssuerRef{Namespace: certificate.Namespace, Name: ref.Name}
+		if ref.Kind == v1alpha1.ClusterEJBCAIssuerKind {
+			issuerRef.Namespace = ""
+		}
+		signerName = issuerRef.SignerName()
+	}
+
+	csr := &certificates.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        certificate.Namespace + "/" + certificate.Name,
+			UID:         certificate.UID,
+			Annotations: certificate.Annotations,
+		},
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+			SignerName: signerName,
+			Username:   certificateUsernamePrefix + certificate.Namespace + ":" + certificate.Name,
+			Groups:     []string{certificatesGroup, certificatesGroup + ":" + certificate.Namespace},
+			Usages:     []certificates.KeyUsage{certificates.UsageDigitalSignature, certificates.UsageKeyEncipherment},
+		},
+	}
+	if len(spec.Usages) > 0 {
+		csr.Spec.Usages = nil
+		for _, usage := range spec.Usages {
+			csr.Spec.Usages = append(csr.Spec.Usages, certificates.KeyUsage(usage))
+		}
+	}
+	if spec.Duration != nil {
+		seconds := int32(spec.Duration.Duration / time.Second)
+		csr.Spec.ExpirationSeconds = &seconds
+	}
+	return csr, nil
+}
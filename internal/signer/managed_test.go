@@ -0,0 +1,36 @@
+package signer
+
+import (
+	"testing"
+
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCertificateToCSRIdentity(t *testing.T) {
+	certificate := &v1alpha1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "payments", UID: "uid"},
+		Spec:       v1alpha1.CertificateSpec{SecretName: "api-tls", CommonName: "api.payments.svc"},
+	}
+	csr, err := certificateToCSR(certificate, newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "ejbca.keyfactor.com:certificate:payments:api"; csr.Spec.Username != want {
+		t.Errorf("username = %q, want %q", csr.Spec.Username, want)
+	}
+	wantGroups := []string{"ejbca.keyfactor.com:certificates", "ejbca.keyfactor.com:certificates:payments"}
+	if len(csr.Spec.Groups) != len(wantGroups) {
+		t.Fatalf("groups = %q, want %q", csr.Spec.Groups, wantGroups)
+	}
+	for i, group := range wantGroups {
+		if csr.Spec.Groups[i] != group {
+			t.Fatalf("groups = %q, want %q", csr.Spec.Groups, wantGroups)
+		}
+	}
+	if _, ok := serviceAccountNamespace(csr.Spec.Username); ok {
+		t.Errorf("username %q is a service account", csr.Spec.Username)
+	}
+}
@@ -0,0 +1,188 @@
+package signer
+
+import (
+	"crypto/x509"
+	"fmt"
+	certificates "k8s.io/api/certificates/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net"
+	"strings"
+)
+
+// Namespace annotations that set issuance defaults and restrictions for CSRs requested by the
+// service accounts of that namespace.
+const (
+	namespaceAnnotationCertificateAuthority = "ejbca.keyfactor.com/certificate-authority"
+	namespaceAnnotationCertificateProfile   = "ejbca.keyfactor.com/certificate-profile"
+	namespaceAnnotationEndEntityProfile     = "ejbca.keyfactor.com/end-entity-profile"
+	namespaceAnnotationESTAlias             = "ejbca.keyfactor.com/est-alias"
+	namespaceAnnotationAllowedDNSSuffixes   = "ejbca.keyfactor.com/allowed-dns-suffixes"
+	namespaceAnnotationAllowOverrides       = "ejbca.keyfactor.com/allow-overrides"
+)
+
+const serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+// splitServiceAccount returns the namespace and name of a service account username of the form
+// system:serviceaccount:<namespace>:<name>, or false if username isn't a service account.
+func splitServiceAccount(username string) (string, string, bool) {
+	if !strings.HasPrefix(username, serviceAccountUsernamePrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountUsernamePrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// serviceAccountNamespace returns the namespace of a service account username, or false if
+// username isn't a service account.
+func serviceAccountNamespace(username string) (string, bool) {
+	namespace, _, ok := splitServiceAccount(username)
+	return namespace, ok
+}
+
+// csrNamespace returns the namespace a CSR is requested from: the namespace of the requesting
+// service account, or empty for other requesters.
+func csrNamespace(csr *certificates.CertificateSigningRequest) string {
+	namespace, _ := serviceAccountNamespace(csr.Spec.Username)
+	return namespace
+}
+
+// namespacePolicy holds the defaults and restrictions a namespace applies to its service accounts.
+type namespacePolicy struct {
+	namespace string
+
+	certificateAuthorityName string
+	certificateProfileName   string
+	endEntityProfileName     string
+	estAlias                 string
+
+	// allowedDNSSuffixes restricts DNS SANs to these domains, if set.
+	allowedDNSSuffixes []string
+	// externalDomains are domains outside the cluster that the namespace owns.
+	externalDomains []string
+	// allowOverrides is false if CSRs may not select a different CA, profile or alias than the
+	// namespace sets.
+	allowOverrides bool
+}
+
+// namespacePolicyFor returns the policy of the namespace the request comes from, or nil if it
+// doesn't come from a namespace or the namespace doesn't exist.
+func (cc *CertificateController) namespacePolicyFor(enrollment *enrollmentRequest) (*namespacePolicy, error) {
+	name := enrollment.namespace
+	if cc.namespaceLister == nil || name == "" {
+		return nil, nil
+	}
+
+	namespace, err := cc.namespaceLister.Get(name)
+	if errors.IsNotFound(err) {
+		handlerLog.Debugf("Namespace %s of %s doesn't exist; using the global defaults", name, enrollment.csr.Name)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %v", name, err)
+	}
+
+	annotations := namespace.GetAnnotations()
+	policy := &namespacePolicy{
+		namespace:                name,
+		certificateAuthorityName: annotations[namespaceAnnotationCertificateAuthority],
+		certificateProfileName:   annotations[namespaceAnnotationCertificateProfile],
+		endEntityProfileName:     annotations[namespaceAnnotationEndEntityProfile],
+		estAlias:                 annotations[namespaceAnnotationESTAlias],
+		allowedDNSSuffixes:       splitDomains(annotations[namespaceAnnotationAllowedDNSSuffixes]),
+		externalDomains:          splitDomains(annotations[namespaceAnnotationExternalDomains]),
+		allowOverrides:           annotations[namespaceAnnotationAllowOverrides] != "false",
+	}
+	return policy, nil
+}
+
+// splitDomains parses a comma separated list of domains, ignoring leading and trailing dots.
+func splitDomains(list string) []string {
+	var domains []string
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.Trim(strings.TrimSpace(domain), "."); domain != "" {
+			domains = append(domains, strings.ToLower(domain))
+		}
+	}
+	return domains
+}
+
+// applyDefaults replaces the global defaults of an enrollment with the namespace's.
+func (p *namespacePolicy) applyDefaults(enrollment *enrollmentRequest) {
+	if p.certificateAuthorityName != "" {
+		enrollment.certificateAuthorityName = p.certificateAuthorityName
+	}
+	if p.certificateProfileName != "" {
+		enrollment.certificateProfileName = p.certificateProfileName
+	}
+	if p.endEntityProfileName != "" {
+		enrollment.endEntityProfileName = p.endEntityProfileName
+	}
+	if p.estAlias != "" {
+		enrollment.estAlias = p.estAlias
+	}
+}
+
+// checkOverride returns a *policyError if the CSR uses annotation to select a different value
+// than the namespace sets and the namespace doesn't allow overrides. A nil policy allows anything.
+func (p *namespacePolicy) checkOverride(annotation string, requested string) error {
+	if p == nil || p.allowOverrides {
+		return nil
+	}
+	var namespaceValue string
+	switch annotation {
+	case "certificateAuthorityName":
+		namespaceValue = p.certificateAuthorityName
+	case "certificateProfileName":
+		namespaceValue = p.certificateProfileName
+	case "endEntityProfileName":
+		namespaceValue = p.endEntityProfileName
+	case "estAlias":
+		namespaceValue = p.estAlias
+	}
+	if namespaceValue == "" || requested == namespaceValue {
+		return nil
+	}
+	return &policyError{
+		reason:  "NamespaceRestricted",
+		message: fmt.Sprintf("namespace %s doesn't allow the %s annotation to select %q instead of %q", p.namespace, annotation, requested, namespaceValue),
+	}
+}
+
+// checkDNSNames returns a *policyError if a DNS name isn't within one of the allowed suffixes.
+func (p *namespacePolicy) checkDNSNames(dnsNames []string) error {
+	if len(p.allowedDNSSuffixes) == 0 {
+		return nil
+	}
+	for _, dnsName := range dnsNames {
+		name := strings.ToLower(strings.TrimSuffix(dnsName, "."))
+		if !withinDomains(name, p.allowedDNSSuffixes) {
+			return &policyError{
+				reason:  "NamespaceRestricted",
+				message: fmt.Sprintf("DNS name %q is not within the domains allowed for namespace %s: %s", dnsName, p.namespace, strings.Join(p.allowedDNSSuffixes, ", ")),
+			}
+		}
+	}
+	return nil
+}
+
+// requestedDNSNames returns the DNS SANs of request, and its Subject CN if that's a DNS name.
+// Many EJBCA profiles copy the CN into a SAN, and clients still match it, so it's checked like
+// the SANs.
+func requestedDNSNames(request *x509.CertificateRequest) []string {
+	names := request.DNSNames
+	if commonNameIsDNSName(request.Subject.CommonName) {
+		names = append(append([]string(nil), names...), request.Subject.CommonName)
+	}
+	return names
+}
+
+// commonNameIsDNSName returns true if cn is a DNS name of more than one label, possibly a
+// wildcard. Single labels, such as an application or user name, aren't taken as DNS names.
+func commonNameIsDNSName(cn string) bool {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(cn, ".")), "*.")
+	return strings.Contains(name, ".") && net.ParseIP(name) == nil && len(validation.IsDNS1123Subdomain(name)) == 0
+}
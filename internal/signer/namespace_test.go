@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+)
+
+func TestNamespaceCheckDNSNames(t *testing.T) {
+	policy := &namespacePolicy{namespace: "payments", allowedDNSSuffixes: []string{"payments.svc.cluster.local", "payments.example.com"}}
+	tests := []struct {
+		name       string
+		policy     *namespacePolicy
+		commonName string
+		dnsNames   []string
+		wantErr    bool
+	}{
+		{name: "no restriction", policy: &namespacePolicy{namespace: "payments"}, dnsNames: []string{"api.example.org"}},
+		{name: "allowed suffix", policy: policy, dnsNames: []string{"api.payments.svc.cluster.local", "payments.example.com"}},
+		{name: "case and trailing dot", policy: policy, dnsNames: []string{"API.Payments.Example.com."}},
+		{name: "outside the suffixes", policy: policy, dnsNames: []string{"api.payments.example.com", "api.example.org"}, wantErr: true},
+		{name: "suffix without a dot", policy: policy, dnsNames: []string{"evilpayments.example.com"}, wantErr: true},
+		{name: "common name within the suffixes", policy: policy, commonName: "api.payments.example.com"},
+		{name: "common name outside the suffixes", policy: policy, commonName: "api.example.org", dnsNames: []string{"api.payments.example.com"}, wantErr: true},
+		{name: "wildcard common name outside the suffixes", policy: policy, commonName: "*.example.org", wantErr: true},
+		{name: "common name of a single label", policy: policy, commonName: "payments-api"},
+		{name: "common name that isn't a DNS name", policy: policy, commonName: "system:serviceaccount:payments:api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &x509.CertificateRequest{Subject: pkix.Name{CommonName: tt.commonName}, DNSNames: tt.dnsNames}
+			err := tt.policy.checkDNSNames(requestedDNSNames(request))
+			var policyErr *policyError
+			switch {
+			case tt.wantErr && !errors.As(err, &policyErr):
+				t.Fatalf("checkDNSNames returned %v, want a policy error", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("checkDNSNames returned %v", err)
+			}
+		})
+	}
+}
+
+func TestNamespaceCheckOverride(t *testing.T) {
+	restricted := &namespacePolicy{namespace: "payments", certificateProfileName: "PaymentsServer"}
+	tests := []struct {
+		name      string
+		policy    *namespacePolicy
+		requested string
+		wantErr   bool
+	}{
+		{name: "no policy", requested: "Other"},
+		{name: "same value", policy: restricted, requested: "PaymentsServer"},
+		{name: "different value", policy: restricted, requested: "Other", wantErr: true},
+		{name: "overrides allowed", policy: &namespacePolicy{namespace: "payments", certificateProfileName: "PaymentsServer", allowOverrides: true}, requested: "Other"},
+		{name: "namespace sets no value", policy: &namespacePolicy{namespace: "payments"}, requested: "Other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.checkOverride("certificateProfileName", tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkOverride returned %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"net"
+	"strings"
+)
+
+// namespaceAnnotationExternalDomains lists domains outside the cluster that a namespace owns,
+// such as those served by an external load balancer. Any DNS SAN within them is accepted.
+const namespaceAnnotationExternalDomains = "ejbca.keyfactor.com/external-domains"
+
+// requestedIPAddresses returns the IP SANs of request, and its Subject CN if that's an IP address.
+func requestedIPAddresses(request *x509.CertificateRequest) []net.IP {
+	ips := request.IPAddresses
+	if ip := net.ParseIP(request.Subject.CommonName); ip != nil {
+		ips = append(append([]net.IP(nil), ips...), ip)
+	}
+	return ips
+}
+
+// verifyOwnership checks that the namespace a request comes from owns every DNS name and IP
+// address of the CSR: its SANs, and its Subject CN if it's one. A DNS name is owned if it names a Service of the namespace, is an Ingress host in the
+// namespace or is within one of the namespace's external domains. An IP address is owned if it's
+// the cluster IP of a Service or the IP of a Pod in the namespace. SANs that aren't owned fail the
+// CSR with a *policyError.
+func (cc *CertificateController) verifyOwnership(ctx context.Context, enrollment *enrollmentRequest) error {
+	namespace := enrollment.namespace
+	if !cc.verifySANOwnership || namespace == "" {
+		return nil
+	}
+	dnsNames, ips := requestedDNSNames(enrollment.request), requestedIPAddresses(enrollment.request)
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		return nil
+	}
+
+	services, err := cc.kubeClient.CoreV1().Services(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list services in namespace %s: %v", namespace, err)
+	}
+
+	if len(dnsNames) > 0 {
+		owned := make(map[string]bool)
+		for _, service := range services.Items {
+			for _, name := range serviceDNSNames(service.Name, namespace, cc.clusterDomain) {
+				owned[name] = true
+			}
+		}
+
+		ingresses, err := cc.kubeClient.NetworkingV1().Ingresses(namespace).List(ctx, v1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list ingresses in namespace %s: %v", namespace, err)
+		}
+		var hosts []string
+		for _, ingress := range ingresses.Items {
+			for _, rule := range ingress.Spec.Rules {
+				hosts = append(hosts, rule.Host)
+			}
+			for _, tls := range ingress.Spec.TLS {
+				hosts = append(hosts, tls.Hosts...)
+			}
+		}
+
+		var externalDomains []string
+		if enrollment.namespacePolicy != nil {
+			externalDomains = enrollment.namespacePolicy.externalDomains
+		}
+
+		for _, dnsName := range dnsNames {
+			name := strings.ToLower(strings.TrimSuffix(dnsName, "."))
+			if owned[name] || matchesHost(name, hosts) || withinDomains(name, externalDomains) {
+				continue
+			}
+			return &policyError{
+				reason:  "UnownedIdentity",
+				message: fmt.Sprintf("DNS name %q is not a Service, Ingress host or external domain of namespace %s", dnsName, namespace),
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		if serviceHasIP(services.Items, ip) {
+			continue
+		}
+		pods, err := cc.kubeClient.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("status.podIP", ip.String()).String(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list pods in namespace %s: %v", namespace, err)
+		}
+		if len(pods.Items) > 0 {
+			continue
+		}
+		return &policyError{
+			reason:  "UnownedIdentity",
+			message: fmt.Sprintf("IP address %s is not the address of a Service or Pod in namespace %s", ip, namespace),
+		}
+	}
+	return nil
+}
+
+// serviceDNSNames returns the names a Service can be reached under from inside the cluster.
+func serviceDNSNames(service string, namespace string, clusterDomain string) []string {
+	names := []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+	}
+	if clusterDomain != "" {
+		names = append(names, service+"."+namespace+".svc."+clusterDomain)
+	}
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	return names
+}
+
+// matchesHost returns true if name equals one of the Ingress hosts, or is matched by a wildcard
+// host, which covers a single label.
+func matchesHost(name string, hosts []string) bool {
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if host == name {
+			return true
+		}
+		if strings.HasPrefix(host, "*.") {
+			if i := strings.Index(name, "."); i > 0 && name[i:] == host[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withinDomains returns true if name is one of domains or a subdomain of one.
+func withinDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceHasIP returns true if ip is a cluster IP of one of the services.
+func serviceHasIP(services []corev1.Service, ip net.IP) bool {
+	for _, service := range services {
+		clusterIPs := service.Spec.ClusterIPs
+		if len(clusterIPs) == 0 {
+			clusterIPs = []string{service.Spec.ClusterIP}
+		}
+		for _, clusterIP := range clusterIPs {
+			if parsed := net.ParseIP(clusterIP); parsed != nil && parsed.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
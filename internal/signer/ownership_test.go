@@ -0,0 +1,82 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVerifyOwnership(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "api", Namespace: "payments"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10"}},
+		},
+		&corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "db", Namespace: "prod"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.96.0.20", ClusterIPs: []string{"10.96.0.20"}},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "payments"},
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{{Host: "pay.example.com"}},
+				TLS:   []networkingv1.IngressTLS{{Hosts: []string{"*.shop.example.com"}}},
+			},
+		},
+	}
+	policy := &namespacePolicy{namespace: "payments", externalDomains: []string{"payments.example.net"}}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		commonName string
+		dnsNames   []string
+		ips        []string
+		wantErr    bool
+	}{
+		{name: "service names", namespace: "payments", dnsNames: []string{"api", "api.payments", "api.payments.svc", "api.payments.svc.cluster.local"}},
+		{name: "ingress hosts", namespace: "payments", dnsNames: []string{"pay.example.com", "www.shop.example.com"}},
+		{name: "wildcard host covers one label", namespace: "payments", dnsNames: []string{"a.b.shop.example.com"}, wantErr: true},
+		{name: "external domain", namespace: "payments", dnsNames: []string{"api.payments.example.net"}},
+		{name: "service of another namespace", namespace: "payments", dnsNames: []string{"db.prod.svc.cluster.local"}, wantErr: true},
+		{name: "service cluster IP", namespace: "payments", ips: []string{"10.96.0.10"}},
+		{name: "cluster IP of another namespace", namespace: "payments", ips: []string{"10.96.0.20"}, wantErr: true},
+		{name: "owned common name", namespace: "payments", commonName: "api.payments.svc"},
+		{name: "unowned common name", namespace: "payments", commonName: "db.prod.svc.cluster.local", dnsNames: []string{"api.payments.svc"}, wantErr: true},
+		{name: "unowned IP common name", namespace: "payments", commonName: "10.96.0.20", wantErr: true},
+		{name: "common name of a single label", namespace: "payments", commonName: "payments-api"},
+		{name: "not from a namespace", dnsNames: []string{"db.prod.svc.cluster.local"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &CertificateController{
+				kubeClient:         fake.NewSimpleClientset(objects...),
+				verifySANOwnership: true,
+				clusterDomain:      "cluster.local",
+			}
+			request := &x509.CertificateRequest{Subject: pkix.Name{CommonName: tt.commonName}, DNSNames: tt.dnsNames}
+			for _, ip := range tt.ips {
+				request.IPAddresses = append(request.IPAddresses, net.ParseIP(ip))
+			}
+			enrollment := &enrollmentRequest{request: request, namespace: tt.namespace, namespacePolicy: policy}
+
+			err := cc.verifyOwnership(context.Background(), enrollment)
+			var policyErr *policyError
+			switch {
+			case tt.wantErr && !errors.As(err, &policyErr):
+				t.Fatalf("verifyOwnership returned %v, want a policy error", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("verifyOwnership returned %v", err)
+			}
+		})
+	}
+}
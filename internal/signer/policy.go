@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Modes a SignerPolicy can apply to the CSRs of its signer name.
+const (
+	// ModeDefault applies no checks beyond the controller's.
+	ModeDefault = ""
+	// ModeSPIFFE issues SPIFFE X.509-SVIDs to service accounts.
+	ModeSPIFFE = "spiffe"
+	// ModeKubeletServing issues kubelet serving certificates after verifying the node's identity.
+	ModeKubeletServing = "kubelet-serving"
+	// ModeAPIServerClient issues kube-apiserver client certificates to users by group rules.
+	ModeAPIServerClient = "kube-apiserver-client"
+)
+
+// SignerPolicy applies a mode and, optionally, its own EJBCA CA, profiles and EST alias to the
+// CSRs of a single signer name. The EJBCA settings of a policy can't be overridden by CSR or
+// namespace annotations.
+type SignerPolicy struct {
+	SignerName string
+	Mode       string
+
+	// Enrollment selects where CSRs of the signer name are enrolled. Empty fields fall back to
+	// the usual defaults and annotations.
+	Enrollment EnrollmentDefaults
+
+	// SPIFFETrustDomain is the trust domain of SPIFFE IDs issued in ModeSPIFFE.
+	SPIFFETrustDomain string
+
+	// ClientGroups grant users kube-apiserver client certificates in ModeAPIServerClient.
+	ClientGroups []ClientGroupRule
+	// AllowedPrivilegedGroups are the system: groups, such as system:masters, that ClientGroups
+	// may grant in ModeAPIServerClient.
+	AllowedPrivilegedGroups []string
+
+	// AutoApprove approves pending CSRs that pass the checks of the mode, and denies the others.
+	AutoApprove bool
+
+	// RevokeOnDelete revokes the certificates of CSRs of the signer name in EJBCA when the CSRs are
+	// deleted, with RevocationReason or DefaultRevocationReason.
+	RevokeOnDelete   bool
+	RevocationReason string
+}
+
+// policyFor returns the policy for signerName, or nil if it has none.
+func (cc *CertificateController) policyFor(signerName string) *SignerPolicy {
+	return cc.policies[signerName]
+}
+
+// apply routes an enrollment to the EJBCA settings fixed by the policy.
+func (p *SignerPolicy) apply(enrollment *enrollmentRequest) {
+	if p.Enrollment.CertificateAuthorityName != "" {
+		enrollment.certificateAuthorityName = p.Enrollment.CertificateAuthorityName
+	}
+	if p.Enrollment.CertificateProfileName != "" {
+		enrollment.certificateProfileName = p.Enrollment.CertificateProfileName
+	}
+	if p.Enrollment.EndEntityProfileName != "" {
+		enrollment.endEntityProfileName = p.Enrollment.EndEntityProfileName
+	}
+	if p.Enrollment.ESTAlias != "" {
+		enrollment.estAlias = p.Enrollment.ESTAlias
+	}
+}
+
+// checkMode runs the checks of the policy's mode. Requests that violate them return a *policyError.
+func (cc *CertificateController) checkMode(ctx context.Context, enrollment *enrollmentRequest) error {
+	policy := enrollment.signerPolicy
+	if policy == nil {
+		return nil
+	}
+	switch policy.Mode {
+	case ModeDefault:
+		return nil
+	case ModeSPIFFE:
+		return checkSPIFFE(policy, enrollment)
+	case ModeKubeletServing:
+		return cc.checkKubeletServing(ctx, enrollment)
+	case ModeAPIServerClient:
+		return checkAPIServerClient(policy, enrollment)
+	}
+	return fmt.Errorf("signer policy for %s has unknown mode %q", policy.SignerName, policy.Mode)
+}
@@ -0,0 +1,254 @@
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"strings"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Annotations that opt a CSR into revocation when it's deleted, and report why revocation failed.
+const (
+	annotationRevokeOnDelete   = "ejbca.keyfactor.com/revoke-on-delete"
+	annotationRevocationReason = "ejbca.keyfactor.com/revocation-reason"
+	annotationRevocationError  = "ejbca.keyfactor.com/revocation-error"
+)
+
+// finalizerRevokeOnDelete keeps a deleted CSR until its certificate has been revoked in EJBCA.
+const finalizerRevokeOnDelete = "ejbca.keyfactor.com/revoke-on-delete"
+
+// csrGarbageCollectionAge is how long after its approval the kube-controller-manager garbage
+// collects a CSR that has a certificate.
+const csrGarbageCollectionAge = time.Hour
+
+// DefaultRevocationReason is the reason certificates are revoked with if none is configured.
+const DefaultRevocationReason = "CESSATION_OF_OPERATION"
+
+// rejectedRevocationReason is the reason certificates that fail the checks made after issuance
+// are revoked with.
+const rejectedRevocationReason = "PRIVILEGES_WITHDRAWN"
+
+// RevocationReasons are the RFC 5280 reasons a certificate can be revoked with.
+var RevocationReasons = map[string]bool{
+	"UNSPECIFIED":            true,
+	"KEY_COMPROMISE":         true,
+	"CA_COMPROMISE":          true,
+	"AFFILIATION_CHANGED":    true,
+	"SUPERSEDED":             true,
+	"CESSATION_OF_OPERATION": true,
+	"CERTIFICATE_HOLD":       true,
+	"PRIVILEGES_WITHDRAWN":   true,
+	"AA_COMPROMISE":          true,
+}
+
+var (
+	revocations = metrics.NewCounterVec(
+		"ejbca_signer_revocations_total",
+		"Number of certificates revoked in EJBCA because their CSR was deleted or they were rejected after issuance, by result.",
+		"signer_name", "result",
+	)
+)
+
+// revocationPolicy returns whether the certificate of a CSR is revoked when the CSR is deleted, and
+// the reason it's revoked with. The signer policy takes precedence over the CSR annotations.
+func revocationPolicy(csr *certificates.CertificateSigningRequest, policy *SignerPolicy) (bool, string, error) {
+	annotations := csr.GetAnnotations()
+	revoke := annotations[annotationRevokeOnDelete] == "true"
+	reason := annotations[annotationRevocationReason]
+	if policy != nil && policy.RevokeOnDelete {
+		revoke = true
+		if policy.RevocationReason != "" {
+			reason = policy.RevocationReason
+		}
+	}
+	if reason == "" {
+		reason = DefaultRevocationReason
+	}
+	if revoke && !RevocationReasons[reason] {
+		return false, "", &policyError{reason: "InvalidRevocationReason", message: fmt.Sprintf("%q is not an RFC 5280 revocation reason", reason)}
+	}
+	return revoke, reason, nil
+}
+
+// hasFinalizer returns true if the CSR has the finalizer.
+func hasFinalizer(csr *certificates.CertificateSigningRequest, finalizer string) bool {
+	return containsString(csr.Finalizers, finalizer)
+}
+
+// revokeDeleted revokes the certificate of a deleted CSR that opted into revocation, unless the
+// CSR may have been garbage collected, and then releases the CSR. Failures are reported on the
+// CSR and retried.
+func (cc *CertificateController) revokeDeleted(ctx context.Context, csr *certificates.CertificateSigningRequest) error {
+	leaf, err := parseLeafCertificate(csr.Status.Certificate)
+	if err != nil || leaf == nil {
+		handlerLog.Infof("Certificate request %s was deleted without a certificate to revoke", csr.Name)
+		return cc.updateCSRMetadata(ctx, csr, removeRevocationFinalizer)
+	}
+	if deletedByGarbageCollection(csr, leaf) {
+		revocations.Inc(csr.Spec.SignerName, "garbage_collected")
+		handlerLog.Infof("Certificate request %s was deleted after it could be garbage collected; its certificate isn't revoked", csr.Name)
+		return cc.updateCSRMetadata(ctx, csr, removeRevocationFinalizer)
+	}
+
+	_, reason, err := revocationPolicy(csr, cc.policyFor(csr.Spec.SignerName))
+	if err != nil {
+		handlerLog.Warnf("Revoking the certificate of %s with %s: %v", csr.Name, DefaultRevocationReason, err)
+		reason = DefaultRevocationReason
+	}
+
+	issuerDN := leaf.Issuer.String()
+	serialNumber := fmt.Sprintf("%X", leaf.SerialNumber)
+	enrollment, err := cc.resolveEnrollment(csr, csrNamespace(csr))
+	if err == nil {
+		err = cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+			return restRevokeCertificate(client, issuerDN, serialNumber, reason, "")
+		})
+	}
+	if err != nil {
+		revocations.Inc(csr.Spec.SignerName, "failed")
+		message := fmt.Sprintf("Failed to revoke certificate %s issued by %s: %v", serialNumber, issuerDN, err)
+		cc.recorder.Event(csr, corev1.EventTypeWarning, "RevocationFailed", message)
+		if enrollment != nil {
+			cc.recordAudit(csr, enrollment, audit.OutcomeError, "RevocationFailed", message, csr.Status.Certificate)
+		}
+		if csr.Annotations[annotationRevocationError] != message {
+			if updateErr := cc.updateCSRMetadata(ctx, csr, func(current *certificates.CertificateSigningRequest) {
+				current.Annotations[annotationRevocationError] = message
+			}); updateErr != nil {
+				handlerLog.Errorf("Failed to record the revocation failure on %s: %v", csr.Name, updateErr)
+			}
+		}
+		return err
+	}
+
+	revocations.Inc(csr.Spec.SignerName, "revoked")
+	handlerLog.Infof("Revoked certificate %s of deleted certificate request %s with reason %s", serialNumber, csr.Name, reason)
+	cc.recorder.Event(csr, corev1.EventTypeNormal, "Revoked", fmt.Sprintf("Revoked certificate %s issued by %s with reason %s", serialNumber, issuerDN, reason))
+	cc.recordAudit(csr, enrollment, audit.OutcomeRevoked, reason, "", csr.Status.Certificate)
+	cc.markIssuedCertificateRevoked(ctx, issuerDN, serialNumber, reason, time.Now())
+	return cc.updateCSRMetadata(ctx, csr, removeRevocationFinalizer)
+}
+
+// deletedByGarbageCollection returns true if a deleted CSR may have been garbage collected by the
+// kube-controller-manager, which deletes CSRs an hour after they were approved once they have a
+// certificate, and CSRs whose certificate expired. Who deleted a CSR isn't recorded, so a
+// deletion from that deadline on is never taken as a request to revoke the certificate.
+func deletedByGarbageCollection(csr *certificates.CertificateSigningRequest, leaf *x509.Certificate) bool {
+	deleted := csr.DeletionTimestamp.Time
+	if !deleted.Before(leaf.NotAfter) {
+		return true
+	}
+	for _, condition := range csr.Status.Conditions {
+		if condition.Type == certificates.CertificateApproved {
+			// the kube-controller-manager counts from the last update of the condition
+			return !deleted.Before(condition.LastUpdateTime.Add(csrGarbageCollectionAge))
+		}
+	}
+	return false
+}
+
+// revokeRejected revokes a certificate that EJBCA issued but that failed the checks made after
+// issuance, so that it can't be used even though it's never handed to the requester. EST has no
+// revocation, so certificates enrolled with EST are only reported.
+func (cc *CertificateController) revokeRejected(ctx context.Context, enrollment *enrollmentRequest, leaf *x509.Certificate, policyErr *policyError) error {
+	csr := enrollment.csr
+	issuerDN := leaf.Issuer.String()
+	serialNumber := fmt.Sprintf("%X", leaf.SerialNumber)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	if enrollment.useEST {
+		handlerLog.Warnf("Certificate %s issued by %s for %s was rejected (%s), but can't be revoked over EST; revoke it in EJBCA", serialNumber, issuerDN, csr.Name, policyErr.reason)
+		revocations.Inc(csr.Spec.SignerName, "unsupported")
+		return nil
+	}
+
+	err := cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+		return restRevokeCertificate(client, issuerDN, serialNumber, rejectedRevocationReason, "")
+	})
+	if err != nil {
+		revocations.Inc(csr.Spec.SignerName, "failed")
+		message := fmt.Sprintf("Failed to revoke rejected certificate %s issued by %s: %v", serialNumber, issuerDN, err)
+		cc.recordAudit(csr, enrollment, audit.OutcomeError, "RevocationFailed", message, chain)
+		return fmt.Errorf("%s", message)
+	}
+
+	revocations.Inc(csr.Spec.SignerName, "revoked")
+	handlerLog.Infof("Revoked certificate %s issued by %s for %s with reason %s: %s", serialNumber, issuerDN, csr.Name, rejectedRevocationReason, policyErr.message)
+	cc.recordAudit(csr, enrollment, audit.OutcomeRevoked, policyErr.reason, policyErr.message, chain)
+	return nil
+}
+
+// restRevokeCertificate revokes the certificate with the hex serial number issued by issuerDN,
+// optionally backdated to an ISO 8601 date. A certificate that's already revoked isn't an error.
+func restRevokeCertificate(client *ejbca.Client, issuerDN string, serialNumber string, reason string, date string) error {
+	handlerLog.Debugf("Revoking certificate %s issued by %s with REST client", serialNumber, issuerDN)
+	resp, err := client.RevokeCertificate(&ejbca.RevokeCertificate{
+		IssuerDn:                issuerDN,
+		CertificateSerialNumber: serialNumber,
+		Reason:                  reason,
+		Date:                    date,
+	})
+	if err != nil {
+		if isAlreadyRevoked(err) {
+			handlerLog.Infof("Certificate %s issued by %s was already revoked", serialNumber, issuerDN)
+			return nil
+		}
+		return err
+	}
+	if !resp.Revoked {
+		return fmt.Errorf("EJBCA didn't revoke the certificate: %s", resp.Message)
+	}
+	return nil
+}
+
+// isAlreadyRevoked returns true if EJBCA refused a revocation because the certificate is revoked.
+func isAlreadyRevoked(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "already revoked")
+}
+
+// removeRevocationFinalizer releases a deleted CSR once its certificate has been revoked, or
+// doesn't need to be.
+func removeRevocationFinalizer(csr *certificates.CertificateSigningRequest) {
+	var finalizers []string
+	for _, finalizer := range csr.Finalizers {
+		if finalizer != finalizerRevokeOnDelete {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	csr.Finalizers = finalizers
+	delete(csr.Annotations, annotationRevocationError)
+}
+
+// updateCSRMetadata applies update to the latest version of the CSR and writes it, retrying on
+// conflicts. Annotations are never nil when update is called.
+func (cc *CertificateController) updateCSRMetadata(ctx context.Context, csr *certificates.CertificateSigningRequest, update func(*certificates.CertificateSigningRequest)) error {
+	csrClient := cc.kubeClient.CertificatesV1().CertificateSigningRequests()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := csrClient.Get(ctx, csr.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.UID != csr.UID {
+			return fmt.Errorf("certificate request %s was replaced", csr.Name)
+		}
+		if current.Annotations == nil {
+			current.Annotations = make(map[string]string)
+		}
+		update(current)
+		_, err = csrClient.Update(ctx, current, v1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", csr.Name, err)
+	}
+	return nil
+}
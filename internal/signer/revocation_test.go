@@ -0,0 +1,41 @@
+package signer
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeletedByGarbageCollection(t *testing.T) {
+	approved := time.Now().Truncate(time.Second)
+	leaf := &x509.Certificate{NotAfter: approved.Add(24 * time.Hour)}
+	tests := []struct {
+		name     string
+		approved *time.Time
+		deleted  time.Time
+		want     bool
+	}{
+		{name: "deleted within the hour", approved: &approved, deleted: approved.Add(59 * time.Minute)},
+		{name: "deleted at the deadline", approved: &approved, deleted: approved.Add(time.Hour), want: true},
+		{name: "deleted after the deadline", approved: &approved, deleted: approved.Add(3 * time.Hour), want: true},
+		{name: "deleted once expired", approved: &approved, deleted: leaf.NotAfter, want: true},
+		{name: "approval without an update time", approved: &time.Time{}, deleted: approved, want: true},
+		{name: "not approved", deleted: approved.Add(3 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr := &certificates.CertificateSigningRequest{ObjectMeta: v1.ObjectMeta{DeletionTimestamp: &v1.Time{Time: tt.deleted}}}
+			if tt.approved != nil {
+				csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{
+					{Type: certificates.CertificateApproved, LastUpdateTime: v1.Time{Time: *tt.approved}},
+				}
+			}
+			if got := deletedByGarbageCollection(csr, leaf); got != tt.want {
+				t.Fatalf("deletedByGarbageCollection = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
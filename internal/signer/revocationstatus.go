@@ -0,0 +1,240 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/apis/v1alpha1"
+	"golang.org/x/time/rate"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	revokedCertificates = metrics.NewGaugeVec(
+		"ejbca_signer_revoked_certificates",
+		"Unexpired certificates issued by the signer that EJBCA reports as revoked.",
+		"serial_number", "issuer_dn", "subject", "namespace", "source_kind", "source_name", "reason",
+	)
+	revocationChecks = metrics.NewCounterVec(
+		"ejbca_signer_revocation_checks_total",
+		"Number of revocation status checks of issued certificates, by result.",
+		"result",
+	)
+)
+
+// RevocationMonitorOptions configure the reconciliation of the revocation status of issued
+// certificates.
+type RevocationMonitorOptions struct {
+	// Interval is how often every certificate in the inventory is checked.
+	Interval time.Duration
+	// BatchSize is the number of IssuedCertificates listed at a time.
+	BatchSize int
+	// QPS caps the rate of revocation status checks sent to EJBCA.
+	QPS float64
+}
+
+// RevocationMonitor periodically checks the unexpired certificates of the inventory with
+// CheckRevocationStatus, so that certificates revoked in EJBCA outside the cluster are found. It
+// marks them revoked in the inventory, exports them as metrics and warns their requesters.
+type RevocationMonitor struct {
+	cc            *CertificateController
+	dynamicClient dynamic.Interface
+	opts          RevocationMonitorOptions
+	limiter       *rate.Limiter
+
+	lock sync.Mutex
+	// series holds the label values of the gauges exported by the last pass.
+	series map[string][]string
+}
+
+// NewRevocationMonitor creates a monitor that lists the inventory with dynamicClient and checks
+// certificates through the connections of cc. Run must be called to start it.
+func NewRevocationMonitor(cc *CertificateController, dynamicClient dynamic.Interface, opts RevocationMonitorOptions) *RevocationMonitor {
+	m := &RevocationMonitor{
+		cc:            cc,
+		dynamicClient: dynamicClient,
+		opts:          opts,
+		series:        make(map[string][]string),
+	}
+	if opts.QPS > 0 {
+		m.limiter = rate.NewLimiter(rate.Limit(opts.QPS), 1)
+	}
+	return m
+}
+
+// Run checks the inventory every interval until ctx is cancelled.
+func (m *RevocationMonitor) Run(ctx context.Context) {
+	if m.opts.Interval <= 0 {
+		return
+	}
+	signerLog.Infof("Starting revocation monitor with an interval of %v", m.opts.Interval)
+	defer signerLog.Infoln("Shutting down revocation monitor")
+
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Check(ctx); err != nil {
+			signerLog.Errorf("Failed to check the revocation status of issued certificates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check pages through the inventory once and checks every unexpired certificate that isn't
+// known to be revoked. Certificates that can't be checked are skipped and reported in the returned
+// error, and the metrics of certificates that are gone are only removed after a complete pass.
+func (m *RevocationMonitor) Check(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var errs []string
+	seen := make(map[string]bool)
+	resource := m.dynamicClient.Resource(v1alpha1.IssuedCertificateResource)
+	opts := metav1.ListOptions{Limit: int64(m.opts.BatchSize)}
+	for {
+		list, err := resource.List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("failed to list IssuedCertificates: %v", err)
+		}
+		for i := range list.Items {
+			object := &list.Items[i]
+			if err = m.reconcile(ctx, object, seen); err != nil {
+				revocationChecks.Inc("failed")
+				errs = append(errs, err.Error())
+				seen[object.GetName()] = true
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		opts.Continue = list.GetContinue()
+		if opts.Continue == "" {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	for name, labels := range m.series {
+		if !seen[name] {
+			revokedCertificates.Delete(labels...)
+			delete(m.series, name)
+		}
+	}
+	return nil
+}
+
+// reconcile checks the revocation status of one IssuedCertificate, and records it in seen if it
+// has a gauge.
+func (m *RevocationMonitor) reconcile(ctx context.Context, object *unstructured.Unstructured, seen map[string]bool) error {
+	issued := &v1alpha1.IssuedCertificate{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, issued); err != nil {
+		return fmt.Errorf("failed to decode IssuedCertificate %s: %v", object.GetName(), err)
+	}
+	if time.Now().After(issued.Spec.NotAfter.Time) {
+		return nil
+	}
+	if issued.Status.RevocationStatus == v1alpha1.CertificateRevoked {
+		m.export(issued)
+		seen[issued.Name] = true
+		return nil
+	}
+
+	enrollment, ok := m.connection(issued)
+	if !ok {
+		return nil
+	}
+	if m.limiter != nil {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	var status *ejbca.GetRevocationStatusResponse
+	err := m.cc.callEJBCA(ctx, enrollment, func(client *ejbca.Client) error {
+		var err error
+		status, err = client.CheckRevocationStatus(issued.Spec.IssuerDN, issued.Spec.SerialNumber)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the revocation status of IssuedCertificate %s: %v", issued.Name, err)
+	}
+
+	if !status.Revoked {
+		revocationChecks.Inc("active")
+		if meta.FindStatusCondition(issued.Status.Conditions, v1alpha1.ConditionRevoked) == nil {
+			// recorded before the inventory had conditions
+			return m.cc.updateIssuedCertificateStatus(ctx, issued.Spec.IssuerDN, issued.Spec.SerialNumber, activeCertificateStatus())
+		}
+		return nil
+	}
+
+	revocationChecks.Inc("revoked")
+	revokedAt, err := time.Parse(time.RFC3339, status.RevocationDate)
+	if err != nil {
+		revokedAt = time.Now()
+	}
+	issued.Status = revokedCertificateStatus(status.RevocationReason, revokedAt)
+	if err = m.cc.updateIssuedCertificateStatus(ctx, issued.Spec.IssuerDN, issued.Spec.SerialNumber, issued.Status); err != nil {
+		return err
+	}
+	m.export(issued)
+	seen[issued.Name] = true
+
+	message := fmt.Sprintf("Certificate %s for %s issued by %s was revoked in EJBCA at %s with reason %s", issued.Spec.SerialNumber, issued.Spec.Subject, issued.Spec.IssuerDN, revokedAt.UTC().Format(time.RFC3339), status.RevocationReason)
+	m.cc.recorder.Event(object, corev1.EventTypeWarning, "CertificateRevoked", message)
+	target := requesterEventTarget(issued)
+	if target == nil {
+		signerLog.Warnf("%s; its requester %q can't be notified", message, issued.Spec.Requester)
+		return nil
+	}
+	signerLog.Infof("%s; notifying %s %s/%s", message, target.Kind, target.Namespace, target.Name)
+	m.cc.recorder.Event(target, corev1.EventTypeWarning, "CertificateRevoked", message)
+	return nil
+}
+
+// connection returns the connection the certificate was enrolled with. Certificates enrolled
+// with EST, or with an issuer that no longer exists, can't be checked.
+func (m *RevocationMonitor) connection(issued *v1alpha1.IssuedCertificate) (*enrollmentRequest, bool) {
+	if issued.Spec.ESTAlias != "" {
+		return nil, false
+	}
+	if issued.Spec.Issuer == "" {
+		return &enrollmentRequest{}, m.cc.endpoints != nil && !m.cc.useEST
+	}
+	if m.cc.issuers == nil {
+		return nil, false
+	}
+	for _, issuer := range m.cc.issuers.Issuers() {
+		if issuer.Ref.String() == issued.Spec.Issuer {
+			return &enrollmentRequest{issuer: issuer}, !issuer.UseEST
+		}
+	}
+	signerLog.Debugf("Skipping the revocation check of IssuedCertificate %s; issuer %s doesn't exist", issued.Name, issued.Spec.Issuer)
+	return nil, false
+}
+
+// export sets the gauge of a revoked certificate.
+func (m *RevocationMonitor) export(issued *v1alpha1.IssuedCertificate) {
+	source := issued.Spec.Source
+	labels := []string{issued.Spec.SerialNumber, issued.Spec.IssuerDN, issued.Spec.Subject, source.Namespace, source.Kind, source.Name, issued.Status.RevocationReason}
+	if previous, ok := m.series[issued.Name]; ok && strings.Join(previous, "\x00") != strings.Join(labels, "\x00") {
+		revokedCertificates.Delete(previous...)
+	}
+	revokedCertificates.Set(1, labels...)
+	m.series[issued.Name] = labels
+}
@@ -0,0 +1,118 @@
+package signer
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	certificates "k8s.io/api/certificates/v1"
+	"net/url"
+	"strings"
+)
+
+// oidBasicConstraints is the object identifier of the basic constraints extension.
+var oidBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+
+// Key usages an X.509-SVID may request. It must include digital signature, and must not include
+// cert sign or CRL sign because an SVID is never a CA.
+var spiffeAllowedUsages = map[certificates.KeyUsage]bool{
+	certificates.UsageDigitalSignature: true,
+	certificates.UsageKeyEncipherment:  true,
+	certificates.UsageKeyAgreement:     true,
+	certificates.UsageServerAuth:       true,
+	certificates.UsageClientAuth:       true,
+}
+
+// spiffeID returns the SPIFFE ID of a service account.
+func spiffeID(trustDomain string, namespace string, serviceAccount string) string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", trustDomain, namespace, serviceAccount)
+}
+
+// checkSPIFFE enforces the X.509-SVID rules on a CSR requested by a service account: exactly one
+// URI SAN, which is the SPIFFE ID of the requester in the policy's trust domain, no CA basic
+// constraint, digital signature but no CA key usages, no email or IP SANs, and a common name, if
+// any, that is the SPIFFE ID or one of the DNS SANs. The SPIFFE ID is used as the EJBCA end entity.
+func checkSPIFFE(policy *SignerPolicy, enrollment *enrollmentRequest) error {
+	csr := enrollment.csr
+	request := enrollment.request
+
+	namespace, serviceAccount, ok := splitServiceAccount(csr.Spec.Username)
+	if !ok {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("%s is not a service account; SVIDs are only issued to service accounts", csr.Spec.Username)}
+	}
+	expected := spiffeID(policy.SPIFFETrustDomain, namespace, serviceAccount)
+
+	if len(request.URIs) != 1 {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("an SVID must have exactly one URI SAN, the CSR has %d", len(request.URIs))}
+	}
+	if uri := request.URIs[0]; !sameSPIFFEID(uri, expected) {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("URI SAN %q doesn't match the requester's SPIFFE ID %q", uri, expected)}
+	}
+	if len(request.EmailAddresses) > 0 || len(request.IPAddresses) > 0 {
+		return &policyError{reason: "InvalidSVID", message: "an SVID must not have email or IP address SANs"}
+	}
+
+	if cn := request.Subject.CommonName; cn != "" && cn != expected && !containsFold(request.DNSNames, cn) {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("common name %q must be the SPIFFE ID or one of the DNS SANs", cn)}
+	}
+
+	if isCA, err := requestsCA(request.Extensions); err != nil {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("invalid basic constraints extension: %v", err)}
+	} else if isCA {
+		return &policyError{reason: "InvalidSVID", message: "an SVID must not be a CA certificate"}
+	}
+
+	hasDigitalSignature := false
+	for _, usage := range csr.Spec.Usages {
+		if !spiffeAllowedUsages[usage] {
+			return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("usage %q is not allowed for an SVID", usage)}
+		}
+		if usage == certificates.UsageDigitalSignature {
+			hasDigitalSignature = true
+		}
+	}
+	if !hasDigitalSignature {
+		return &policyError{reason: "InvalidSVID", message: fmt.Sprintf("an SVID must request the %q usage", certificates.UsageDigitalSignature)}
+	}
+
+	enrollment.username = expected
+	return nil
+}
+
+// sameSPIFFEID compares a URI SAN with a SPIFFE ID. The scheme and trust domain are case
+// insensitive; the path is not.
+func sameSPIFFEID(uri *url.URL, expected string) bool {
+	want, err := url.Parse(expected)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(uri.Scheme, want.Scheme) && strings.EqualFold(uri.Host, want.Host) &&
+		uri.Path == want.Path && uri.User == nil && uri.RawQuery == "" && uri.Fragment == ""
+}
+
+// requestsCA returns true if the requested extensions include basic constraints with CA set.
+func requestsCA(extensions []pkix.Extension) (bool, error) {
+	for _, extension := range extensions {
+		if !extension.Id.Equal(oidBasicConstraints) {
+			continue
+		}
+		var constraints struct {
+			IsCA       bool `asn1:"optional"`
+			MaxPathLen int  `asn1:"optional,default:-1"`
+		}
+		if _, err := asn1.Unmarshal(extension.Value, &constraints); err != nil {
+			return false, err
+		}
+		return constraints.IsCA, nil
+	}
+	return false, nil
+}
+
+// containsFold returns true if values contains value, ignoring case.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/metrics"
+	"golang.org/x/time/rate"
+	"net"
+	"net/url"
+	"sync"
+)
+
+var (
+	enrollmentsInFlight = metrics.NewGaugeVec(
+		"ejbca_signer_enrollments_in_flight",
+		"Number of enrollments currently in progress with EJBCA, by certificate authority or EST alias.",
+		"certificate_authority",
+	)
+)
+
+// enrollmentThrottle limits how hard the signer drives EJBCA: calls are bounded by an overall
+// rate, and enrollments by a maximum number in flight for each CA. Zero values disable a limit.
+type enrollmentThrottle struct {
+	limiter  *rate.Limiter
+	maxPerCA int
+
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newEnrollmentThrottle(qps float64, burst int, maxPerCA int) *enrollmentThrottle {
+	t := &enrollmentThrottle{maxPerCA: maxPerCA, slots: make(map[string]chan struct{})}
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+	return t
+}
+
+// wait blocks until the overall rate limit allows another call to EJBCA.
+func (t *enrollmentThrottle) wait(ctx context.Context) error {
+	if t.limiter == nil {
+		return nil
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// acquire blocks until an enrollment with ca may start. The returned function must be called
+// once the enrollment has finished.
+func (t *enrollmentThrottle) acquire(ctx context.Context, ca string) (func(), error) {
+	var slots chan struct{}
+	if t.maxPerCA > 0 {
+		t.lock.Lock()
+		var ok bool
+		slots, ok = t.slots[ca]
+		if !ok {
+			slots = make(chan struct{}, t.maxPerCA)
+			t.slots[ca] = slots
+		}
+		t.lock.Unlock()
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for a free enrollment slot for %s: %w", ca, ctx.Err())
+		}
+	}
+
+	enrollmentsInFlight.Add(1, ca)
+	return func() {
+		enrollmentsInFlight.Add(-1, ca)
+		if slots != nil {
+			<-slots
+		}
+	}, nil
+}
+
+// callEJBCA runs fn, a call to EJBCA on behalf of an enrollment, inside the overall rate limit and
+// the concurrency limit for its CA, against the endpoints of its issuer or the controller.
+func (cc *CertificateController) callEJBCA(ctx context.Context, enrollment *enrollmentRequest, fn func(*ejbca.Client) error) error {
+	release, err := cc.throttle.acquire(ctx, enrollment.throttleKey())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err = cc.throttle.wait(ctx); err != nil {
+		return err
+	}
+	if enrollment.issuer != nil {
+		return enrollment.issuer.Endpoints.call(fn)
+	}
+	return cc.endpoints.call(fn)
+}
+
+// throttleKey identifies the CA an enrollment is limited by. CAs of an issuer are limited
+// separately from those of the controller's own connection.
+func (e *enrollmentRequest) throttleKey() string {
+	key := e.certificateAuthorityName
+	if e.useEST {
+		key = "est:" + e.estAlias
+	}
+	if e.issuer != nil {
+		key = e.issuer.Ref.String() + ":" + key
+	}
+	return key
+}
+
+// IsEndpointFailure returns true if err means that the EJBCA endpoint is unavailable: the
+// transport failed, or EJBCA answered with a 5xx error. Errors that EJBCA returns for a bad
+// request don't count against the endpoint, and neither do answers that aren't EJBCA errors,
+// since the client keeps no status for them.
+func IsEndpointFailure(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
@@ -0,0 +1,112 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentThrottleLimitsEachCA(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPerCA int
+		cas      int
+		workers  int
+	}{
+		{name: "one CA", maxPerCA: 2, cas: 1, workers: 8},
+		{name: "several CAs", maxPerCA: 2, cas: 5, workers: 20},
+		{name: "one slot per CA", maxPerCA: 1, cas: 3, workers: 12},
+		{name: "new CAs while others release", maxPerCA: 1, cas: 2000, workers: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := newEnrollmentThrottle(0, 0, tt.maxPerCA)
+			inFlight := make([]int32, tt.cas)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.workers*100)
+			for w := 0; w < tt.workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						ca := (w*100 + i) % tt.cas
+						release, err := throttle.acquire(context.Background(), fmt.Sprintf("ca-%d", ca))
+						if err != nil {
+							errs <- err
+							return
+						}
+						if n := atomic.AddInt32(&inFlight[ca], 1); n > int32(tt.maxPerCA) {
+							errs <- fmt.Errorf("%d enrollments in flight for ca-%d, want at most %d", n, ca, tt.maxPerCA)
+						}
+						runtime.Gosched()
+						atomic.AddInt32(&inFlight[ca], -1)
+						release()
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEnrollmentThrottleAcquire(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPerCA int
+		held     int
+		wantErr  bool
+	}{
+		{name: "unlimited", maxPerCA: 0, held: 5},
+		{name: "free slot", maxPerCA: 2, held: 1},
+		{name: "all slots taken", maxPerCA: 2, held: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := newEnrollmentThrottle(0, 0, tt.maxPerCA)
+			for i := 0; i < tt.held; i++ {
+				if _, err := throttle.acquire(context.Background(), "ca"); err != nil {
+					t.Fatalf("acquire %d: %v", i, err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			release, err := throttle.acquire(ctx, "ca")
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("acquire returned %v, want a deadline error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("acquire returned %v", err)
+			}
+			release()
+		})
+	}
+}
+
+func TestEnrollmentThrottleReleaseFreesSlot(t *testing.T) {
+	throttle := newEnrollmentThrottle(0, 0, 1)
+	release, err := throttle.acquire(context.Background(), "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = throttle.acquire(ctx, "ca"); err != nil {
+		t.Fatalf("acquire after release returned %v", err)
+	}
+}
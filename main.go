@@ -2,17 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/Keyfactor/ejbca-go-client/pkg/ejbca"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/circuit"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/health"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/issuer"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/signer"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/config"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/credential"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 )
 
 var (
@@ -20,62 +31,75 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate-config":
+			os.Exit(validateConfig(os.Args[2:]))
+		case "verify-audit-log":
+			os.Exit(verifyAuditLog(os.Args[2:]))
+		}
+	}
+
+	var kubeconfig, kubeContext, configPath, credentialsPath string
+	flag.StringVar(&kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig file. Only required if running outside of a cluster.")
+	flag.StringVar(&kubeContext, "context", os.Getenv("KUBE_CONTEXT"), "Name of the kubeconfig context to use. Defaults to the current context.")
+	flag.StringVar(&configPath, "config", envOrDefault("CONFIG_PATH", config.DefaultConfigPath), "Path to the signer configuration file.")
+	flag.StringVar(&credentialsPath, "credentials", envOrDefault("CREDENTIALS_PATH", credential.DefaultCredentialPath), "Path to the EJBCA credentials file.")
+	overrides := config.NewOverrides(flag.CommandLine)
+	flag.Parse()
+
 	// Serialize configuration
-	serverConfig, err := config.LoadConfig()
+	serverConfig, err := config.LoadConfig(configPath, overrides)
 	if err != nil {
 		mainLog.Fatal(err)
 		return
 	}
-	credentials, err := credential.LoadCredential()
+	credentials, err := loadCredentials(serverConfig, credentialsPath)
 	if err != nil {
 		mainLog.Fatal(err)
 		return
 	}
 
-	// Create a new EJBCA client using config
-	ejbcaConfig := &ejbca.Config{
-		CertificateFile:                 credentials.ClientCertPath,
-		KeyFile:                         credentials.ClientKeyPath,
-		KeyPassword:                     credentials.KeyPassword,
-		DefaultCertificateProfileName:   serverConfig.DefaultCertificateProfileName,
-		DefaultEndEntityProfileName:     serverConfig.DefaultEndEntityProfileName,
-		DefaultCertificateAuthorityName: serverConfig.DefaultCertificateAuthorityName,
-	}
-
-	ejbcaFactory := ejbca.ClientFactory(credentials.Hostname, ejbcaConfig)
-	if err != nil {
-		mainLog.Fatal(err)
-	}
-
-	var ejbcaClient *ejbca.Client
-	if serverConfig.UseEST {
-		mainLog.Debugln("Creating EJBCA EST client")
-		ejbcaClient, err = ejbcaFactory.NewESTClient(credentials.EJBCAUsername, credentials.EJBCAPassword)
-		if err != nil {
-			mainLog.Fatal(err)
-		}
-	} else {
-		mainLog.Debugln("Creating EJBCA client")
-		ejbcaClient, err = ejbcaFactory.NewEJBCAClient()
+	var endpoints *signer.EndpointPool
+	if serverConfig.DryRun {
+		mainLog.Infoln("Running in dry-run mode; CSRs will be evaluated but not enrolled with EJBCA")
+	} else if credentials != nil {
+		endpoints, err = newEndpointPool(serverConfig, credentials)
 		if err != nil {
 			mainLog.Fatal(err)
 		}
+		mainLog.Infof("Created EJBCA clients for %s", endpoints)
 	}
 
-	k8sClient, err := NewInClusterClient()
+	restConfig, err := NewRESTConfig(kubeconfig, kubeContext)
 	if err != nil {
 		mainLog.Fatal(err)
 	}
-	mainLog.Info("Created in-cluster Kubernetes client")
+	restConfig.QPS = serverConfig.KubeClientQPS
+	restConfig.Burst = serverConfig.KubeClientBurst
+
+	k8sClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		mainLog.Fatal(fmt.Errorf("create kubernetes client failed: %v", err))
+	}
+	mainLog.Infof("Created Kubernetes client for %s", restConfig.Host)
 
-	errChan := make(chan error)
+	// Cancel the context on SIGTERM or SIGINT so that in-flight enrollments can drain. A second
+	// signal after stop() is called falls through to the default handler and exits immediately.
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	ctx, cancel := context.WithCancel(signalCtx)
+	defer cancel()
+
+	errChan := make(chan error, 1)
 
 	healthService := &health.ServiceHealthCheck{
-		Addr: serverConfig.HealthCheckPort,
+		Addr:  strconv.Itoa(int(serverConfig.HealthCheckPort)),
+		Ready: endpoints.Ready,
 	}
 
 	go func() {
-		err = healthService.Serve()
+		err := healthService.Serve()
 		if err != nil {
 			mainLog.Errorf("Failed to start health check service: %s", err.Error())
 		}
@@ -87,20 +111,277 @@ func main() {
 		name = "ejbca-csr-signer" // default name
 	}
 
-	ctx := context.Background()
+	auditor, err := newAuditLogger(serverConfig.Audit, name)
+	if err != nil {
+		mainLog.Fatal(err)
+	}
 
-	informerFactory := informers.NewSharedInformerFactory(k8sClient, 0)
+	informerFactory := informers.NewSharedInformerFactory(k8sClient, serverConfig.ResyncPeriod)
 	csrInformer := informerFactory.Certificates().V1().CertificateSigningRequests()
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+
+	var dynamicClient dynamic.Interface
+	if serverConfig.EnableIssuers || serverConfig.EnableCertificates || serverConfig.EnableCertificateRevocations || serverConfig.EnableCertificateInventory {
+		dynamicClient, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			mainLog.Fatalf("create dynamic kubernetes client failed: %v", err)
+		}
+	}
+
+	var issuers *issuer.Controller
+	if serverConfig.EnableIssuers {
+		issuers, err = newIssuerController(k8sClient, dynamicClient, serverConfig)
+		if err != nil {
+			mainLog.Fatal(err)
+		}
+	}
 
-	certificateController := signer.NewCertificateController(name, k8sClient, csrInformer, ejbcaClient)
+	certificateController := signer.NewCertificateController(name, k8sClient, csrInformer, endpoints, signer.ControllerOptions{
+		CacheSyncTimeout: serverConfig.CacheSyncTimeout,
+		RetryBaseDelay:   serverConfig.RetryBaseDelay,
+		RetryMaxDelay:    serverConfig.RetryMaxDelay,
+		RetryQPS:         serverConfig.RetryQPS,
+		RetryBurst:       serverConfig.RetryBurst,
+		SignerNames:      serverConfig.SignerNames,
+		Policies:         signerPolicies(serverConfig.SignerPolicies),
+		Defaults: signer.EnrollmentDefaults{
+			CertificateAuthorityName: serverConfig.DefaultCertificateAuthorityName,
+			CertificateProfileName:   serverConfig.DefaultCertificateProfileName,
+			EndEntityProfileName:     serverConfig.DefaultEndEntityProfileName,
+			ESTAlias:                 serverConfig.DefaultESTAlias,
+		},
+		UseEST:                        serverConfig.UseEST,
+		DryRun:                        serverConfig.DryRun,
+		AuthorizeProfiles:             serverConfig.AuthorizeProfiles,
+		NamespaceInformer:             namespaceInformer,
+		VerifySANOwnership:            serverConfig.VerifySANOwnership,
+		ClusterDomain:                 serverConfig.ClusterDomain,
+		Auditor:                       auditor,
+		EJBCAQPS:                      serverConfig.EJBCAQPS,
+		EJBCABurst:                    serverConfig.EJBCABurst,
+		MaxConcurrentEnrollmentsPerCA: serverConfig.MaxConcurrentEnrollmentsPerCA,
+		ApprovalPollInterval:          serverConfig.ApprovalPollInterval,
+		ApprovalNamespace:             os.Getenv("POD_NAMESPACE"),
+		Issuers:                       issuerResolver(issuers),
+		Inventory:                     inventoryClient(dynamicClient, serverConfig),
+		InventoryRetention:            serverConfig.InventoryRetention,
+	})
 	informerFactory.Start(ctx.Done())
+	go endpoints.Run(ctx)
+	if issuers != nil {
+		go issuers.Run(ctx, 1)
+	}
+	if serverConfig.EnableCertManager {
+		certificateRequests := signer.NewCertificateRequestController(certificateController, dynamicClient, serverConfig.ResyncPeriod)
+		go certificateRequests.Run(ctx, serverConfig.Workers)
+	}
+	if serverConfig.EnableCertificates {
+		managedCertificates := signer.NewManagedCertificateController(certificateController, dynamicClient, serverConfig.ResyncPeriod)
+		go managedCertificates.Run(ctx, serverConfig.Workers)
+	}
+	if serverConfig.EnableCertificateRevocations {
+		certificateRevocations := signer.NewCertificateRevocationController(certificateController, dynamicClient, serverConfig.ResyncPeriod)
+		go certificateRevocations.Run(ctx, 1)
+	}
+
+	if serverConfig.ExpiryMonitor.Enabled {
+		expiryMonitor := signer.NewExpiryMonitor(certificateController, dynamicClient, signer.ExpiryMonitorOptions{
+			Interval: serverConfig.ExpiryMonitor.Interval,
+			Windows:  serverConfig.ExpiryMonitor.Windows,
+			PageSize: serverConfig.ExpiryMonitor.PageSize,
+		})
+		go expiryMonitor.Run(ctx)
+	}
+	if serverConfig.RevocationMonitor.Enabled {
+		revocationMonitor := signer.NewRevocationMonitor(certificateController, dynamicClient, signer.RevocationMonitorOptions{
+			Interval:  serverConfig.RevocationMonitor.Interval,
+			BatchSize: serverConfig.RevocationMonitor.BatchSize,
+			QPS:       serverConfig.RevocationMonitor.QPS,
+		})
+		go revocationMonitor.Run(ctx)
+	}
+
+	controllerDone := make(chan error, 1)
+	go func() {
+		controllerDone <- certificateController.Run(ctx, serverConfig.Workers, serverConfig.ShutdownGracePeriod)
+	}()
+
+	exitCode := 0
+	controllerStopped := false
+	select {
+	case <-ctx.Done():
+		mainLog.Infof("Received shutdown signal; waiting up to %v for in-flight enrollments", serverConfig.ShutdownGracePeriod)
+	case err = <-errChan:
+		mainLog.Errorf("Health check service stopped unexpectedly: %v", err)
+		exitCode = 1
+	case err = <-controllerDone:
+		mainLog.Errorf("EJBCA Certificate Controller stopped unexpectedly: %v", err)
+		exitCode = 1
+		controllerStopped = true
+	}
+	stop()
+	cancel()
+
+	if !controllerStopped {
+		if err = <-controllerDone; err != nil {
+			mainLog.Errorf("EJBCA Certificate Controller did not shut down cleanly: %v", err)
+			exitCode = 1
+		}
+	}
 
-	go certificateController.Run(ctx, 3)
+	if err = auditor.Close(); err != nil {
+		mainLog.Errorf("Failed to close audit log: %v", err)
+		exitCode = 1
+	}
 
-	err = <-errChan
+	if err = healthService.Shutdown(); err != nil {
+		mainLog.Errorf("Failed to shut down health check service: %v", err)
+		exitCode = 1
+	}
 
-	mainLog.Fatal("EJBCA Certificate Controller closed; %s", err.Error())
+	mainLog.Infof("EJBCA Certificate Controller closed with exit code %d", exitCode)
+	os.Exit(exitCode)
 }
+
+// newEndpointPool creates an EJBCA client and circuit breaker for every configured endpoint.
+func newEndpointPool(serverConfig *config.ServerConfig, credentials *credential.EJBCACredential) (*signer.EndpointPool, error) {
+	ejbcaConfig := &ejbca.Config{
+		CertificateFile:                 credentials.ClientCertPath,
+		KeyFile:                         credentials.ClientKeyPath,
+		KeyPassword:                     credentials.KeyPassword,
+		DefaultCertificateProfileName:   serverConfig.DefaultCertificateProfileName,
+		DefaultEndEntityProfileName:     serverConfig.DefaultEndEntityProfileName,
+		DefaultCertificateAuthorityName: serverConfig.DefaultCertificateAuthorityName,
+	}
+
+	var endpoints []*signer.Endpoint
+	for _, endpoint := range credentials.EndpointList() {
+		ejbcaFactory := ejbca.ClientFactory(endpoint.Hostname, ejbcaConfig)
+
+		var client *ejbca.Client
+		var err error
+		if serverConfig.UseEST {
+			mainLog.Debugf("Creating EJBCA EST client for %s", endpoint.Hostname)
+			client, err = ejbcaFactory.NewESTClient(credentials.EJBCAUsername, credentials.EJBCAPassword)
+		} else {
+			mainLog.Debugf("Creating EJBCA client for %s", endpoint.Hostname)
+			client, err = ejbcaFactory.NewEJBCAClient()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create EJBCA client for %s: %v", endpoint.Hostname, err)
+		}
+
+		breaker := circuit.NewBreaker(endpoint.Hostname, serverConfig.CircuitBreaker.FailureThreshold, serverConfig.CircuitBreaker.OpenTimeout)
+		breaker.IsFailure = signer.IsEndpointFailure
+
+		endpoints = append(endpoints, &signer.Endpoint{
+			Hostname: endpoint.Hostname,
+			Weight:   endpoint.Weight,
+			Client:   client,
+			Breaker:  breaker,
+		})
+	}
+	return signer.NewEndpointPool(endpoints, serverConfig.UseEST, serverConfig.DefaultESTAlias, serverConfig.EndpointHealthCheckInterval), nil
+}
+
+// newIssuerController creates the controller of EJBCAIssuer and ClusterEJBCAIssuer resources.
+func newIssuerController(k8sClient kubernetes.Interface, dynamicClient dynamic.Interface, serverConfig *config.ServerConfig) (*issuer.Controller, error) {
+	clusterResourceNamespace := serverConfig.ClusterResourceNamespace
+	if clusterResourceNamespace == "" {
+		clusterResourceNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if clusterResourceNamespace == "" {
+		return nil, errors.New("clusterResourceNamespace must be set when running outside of a pod")
+	}
+	return issuer.NewController(k8sClient, dynamicClient, issuer.Options{
+		ClusterResourceNamespace: clusterResourceNamespace,
+		CheckInterval:            serverConfig.EndpointHealthCheckInterval,
+		FailureThreshold:         serverConfig.CircuitBreaker.FailureThreshold,
+		OpenTimeout:              serverConfig.CircuitBreaker.OpenTimeout,
+		SecretDir:                filepath.Join(os.TempDir(), "ejbca-issuers"),
+	}), nil
+}
+
+// issuerResolver returns the issuer controller as a resolver, or nil if issuers are disabled.
+func issuerResolver(issuers *issuer.Controller) signer.IssuerResolver {
+	if issuers == nil {
+		return nil
+	}
+	return issuers
+}
+
+// inventoryClient returns the client that IssuedCertificates are created with, or nil if the
+// inventory is disabled.
+func inventoryClient(dynamicClient dynamic.Interface, serverConfig *config.ServerConfig) dynamic.Interface {
+	if !serverConfig.EnableCertificateInventory {
+		return nil
+	}
+	return dynamicClient
+}
+
+// signerPolicies converts the configured signer policies for the controller.
+func signerPolicies(policies []config.SignerPolicy) []signer.SignerPolicy {
+	var converted []signer.SignerPolicy
+	for _, policy := range policies {
+		converted = append(converted, signer.SignerPolicy{
+			SignerName: policy.SignerName,
+			Mode:       policy.Mode,
+			Enrollment: signer.EnrollmentDefaults{
+				CertificateAuthorityName: policy.CertificateAuthorityName,
+				CertificateProfileName:   policy.CertificateProfileName,
+				EndEntityProfileName:     policy.EndEntityProfileName,
+				ESTAlias:                 policy.ESTAlias,
+			},
+			SPIFFETrustDomain:       policy.SPIFFE.TrustDomain,
+			ClientGroups:            clientGroupRules(policy.APIServerClient.Groups),
+			AllowedPrivilegedGroups: policy.APIServerClient.AllowedPrivilegedGroups,
+			AutoApprove:             policy.AutoApprove,
+			RevokeOnDelete:          policy.RevokeOnDelete,
+			RevocationReason:        policy.RevocationReason,
+		})
+	}
+	return converted
+}
+
+// clientGroupRules converts the group rules of a kube-apiserver client signer policy.
+func clientGroupRules(groups []config.ClientGroupConfig) []signer.ClientGroupRule {
+	var rules []signer.ClientGroupRule
+	for _, group := range groups {
+		rules = append(rules, signer.ClientGroupRule{
+			Group:         group.Group,
+			Organizations: group.Organizations,
+			MaxDuration:   group.MaxDuration,
+		})
+	}
+	return rules
+}
+
+// newAuditLogger creates the audit logger with every sink enabled in the configuration.
+func newAuditLogger(auditConfig config.AuditConfig, name string) (*audit.Logger, error) {
+	var sinks []audit.Sink
+	if auditConfig.Stdout {
+		sinks = append(sinks, &audit.StdoutSink{})
+	}
+	if auditConfig.File.Path != "" {
+		sink, err := audit.NewFileSink(auditConfig.File.Path, int64(auditConfig.File.MaxSizeMB)*1024*1024, auditConfig.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if auditConfig.Syslog.Address != "" {
+		sink, err := audit.NewSyslogSink(auditConfig.Syslog.Network, auditConfig.Syslog.Address, name)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		mainLog.Warnln("No audit sinks are configured; issuance decisions will not be audited")
+	}
+	return audit.NewLogger(sinks...)
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
@@ -108,17 +389,77 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
-func NewInClusterClient() (*kubernetes.Clientset, error) {
-	conf, err := rest.InClusterConfig()
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// loadCredentials loads the credentials of the signer's own EJBCA connection, and validates them
+// unless the signer runs in dry-run mode, which never contacts EJBCA. With issuer resources
+// enabled the connection is optional, and nil is returned if it can't be used.
+func loadCredentials(serverConfig *config.ServerConfig, path string) (*credential.EJBCACredential, error) {
+	credentials, err := credential.LoadCredential(path)
+	if err == nil && !serverConfig.DryRun {
+		err = credentials.Validate(serverConfig.UseEST)
+	}
+	if err != nil && serverConfig.EnableIssuers {
+		// Issuer resources replace the connection of the credentials file
+		mainLog.Warnf("No default EJBCA connection; CSRs must select an EJBCAIssuer or ClusterEJBCAIssuer: %v", err)
+		return nil, nil
+	}
+	return credentials, err
+}
+
+// NewRESTConfig builds the Kubernetes client configuration. If a kubeconfig path is given it is
+// used with the requested context; otherwise the in-cluster config is used, falling back to
+// ~/.kube/config when the signer is not running inside a pod. A context always selects a
+// kubeconfig, since the in-cluster config has none.
+func NewRESTConfig(kubeconfig string, kubeContext string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		defaultKubeconfig := filepath.Join(homeDir(), ".kube", "config")
+		if kubeContext != "" {
+			if _, err := os.Stat(defaultKubeconfig); err != nil {
+				return nil, fmt.Errorf("context %q requires a kubeconfig, but none was given and %s can't be read: %v", kubeContext, defaultKubeconfig, err)
+			}
+			return NewKubeconfigConfig(defaultKubeconfig, kubeContext)
+		}
+
+		conf, err := NewInClusterConfig()
+		if err == nil || !errors.Is(err, rest.ErrNotInCluster) {
+			return conf, err
+		}
+
+		kubeconfig = defaultKubeconfig
+		if _, statErr := os.Stat(kubeconfig); statErr != nil {
+			return nil, err
+		}
+		mainLog.Infof("Not running in a cluster; falling back to %s", kubeconfig)
+	}
+
+	return NewKubeconfigConfig(kubeconfig, kubeContext)
+}
+
+// NewKubeconfigConfig loads the client configuration from a kubeconfig file, for running the
+// signer outside of a cluster during development.
+func NewKubeconfigConfig(kubeconfig string, kubeContext string) (*rest.Config, error) {
+	conf, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
 	if err != nil {
-		return nil, fmt.Errorf("create config failed: %v", err)
+		return nil, fmt.Errorf("load kubeconfig %s failed: %v", kubeconfig, err)
 	}
-	mainLog.Tracef("Got kubernetes config in cluster: %v", conf)
+	mainLog.Tracef("Got kubernetes config from %s: %v", kubeconfig, conf.Host)
+	return conf, nil
+}
 
-	client, err := kubernetes.NewForConfig(conf)
+func NewInClusterConfig() (*rest.Config, error) {
+	conf, err := rest.InClusterConfig()
 	if err != nil {
-		mainLog.Errorf("Failed to create in-cluster Kubernetes client")
-		return nil, fmt.Errorf("create kubernetes client failed: %v", err)
+		return nil, fmt.Errorf("create config failed: %w", err)
 	}
-	return client, nil
+	mainLog.Tracef("Got kubernetes config in cluster: %v", conf)
+	return conf, nil
 }
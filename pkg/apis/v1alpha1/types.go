@@ -0,0 +1,342 @@
+// Package v1alpha1 contains the custom resources of the EJBCA signer.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the signer's custom resources.
+const GroupName = "ejbca.keyfactor.com"
+
+// SchemeGroupVersion is the group and version of the resources in this package.
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// Resources of the signer's custom resource definitions.
+var (
+	EJBCAIssuerResource        = SchemeGroupVersion.WithResource("ejbcaissuers")
+	ClusterEJBCAIssuerResource = SchemeGroupVersion.WithResource("clusterejbcaissuers")
+)
+
+// Kinds of the signer's custom resources.
+const (
+	EJBCAIssuerKind        = "EJBCAIssuer"
+	ClusterEJBCAIssuerKind = "ClusterEJBCAIssuer"
+)
+
+// EJBCAIssuer is a connection to EJBCA that CSRs can be enrolled with. A namespaced EJBCAIssuer only
+// serves requesters from its own namespace; a ClusterEJBCAIssuer, which has the same spec and
+// status, serves every requester.
+type EJBCAIssuer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EJBCAIssuerSpec   `json:"spec,omitempty"`
+	Status EJBCAIssuerStatus `json:"status,omitempty"`
+}
+
+// EJBCAIssuerSpec describes how to reach EJBCA and what to enroll with by default.
+type EJBCAIssuerSpec struct {
+	// Hostname of the EJBCA server, optionally with a port.
+	Hostname string `json:"hostname"`
+
+	// ClientCertSecretName is a kubernetes.io/tls Secret with the client certificate used to
+	// authenticate to EJBCA. It's required for the REST API and optional for EST. The Secret of a
+	// ClusterEJBCAIssuer lives in the signer's cluster resource namespace.
+	ClientCertSecretName string `json:"clientCertSecretName,omitempty"`
+
+	// CABundle is a PEM bundle of the CAs that EJBCA's server certificate is verified with. The
+	// system roots are used if it's empty.
+	CABundle string `json:"caBundle,omitempty"`
+
+	// UseEST enrolls with the EJBCA EST interface instead of the REST API.
+	UseEST bool `json:"useEST,omitempty"`
+	// ESTAlias is the default EST alias.
+	ESTAlias string `json:"estAlias,omitempty"`
+	// ESTCredentialsSecretName is a Secret with the username and password keys used to
+	// authenticate to the EST interface.
+	ESTCredentialsSecretName string `json:"estCredentialsSecretName,omitempty"`
+
+	// Defaults used when a CSR doesn't select a CA or profile with annotations.
+	CertificateAuthorityName string `json:"certificateAuthorityName,omitempty"`
+	CertificateProfileName   string `json:"certificateProfileName,omitempty"`
+	EndEntityProfileName     string `json:"endEntityProfileName,omitempty"`
+}
+
+// EJBCAIssuerStatus reports whether the issuer can be used.
+type EJBCAIssuerStatus struct {
+	// Conditions include Ready, which is true if the last connectivity check succeeded.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// ConditionReady is the condition type reporting whether an issuer can be used.
+const ConditionReady = "Ready"
+
+// CertificateResource is the resource of Certificates.
+var CertificateResource = SchemeGroupVersion.WithResource("certificates")
+
+// CertificateKind is the kind of Certificates.
+const CertificateKind = "Certificate"
+
+// Certificate is a certificate whose private key the signer generates, enrolls with EJBCA, writes
+// to a Secret of the Certificate's namespace and renews before it expires.
+type Certificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CertificateSpec   `json:"spec,omitempty"`
+	Status CertificateStatus `json:"status,omitempty"`
+}
+
+// CertificateSpec describes the requested certificate and where it's stored.
+type CertificateSpec struct {
+	// SecretName is the Secret that tls.crt, tls.key and ca.crt, and any keystores, are written to.
+	SecretName string `json:"secretName"`
+
+	// CommonName is the CN of the subject, which is also the EJBCA end entity name. When EJBCA
+	// generates the key, it only names the end entity, whose subject and SANs EJBCA uses.
+	CommonName string       `json:"commonName,omitempty"`
+	Subject    *X509Subject `json:"subject,omitempty"`
+
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+
+	// Usages are requested like the usages of a CSR. They default to digital signature and key
+	// encipherment.
+	Usages []string `json:"usages,omitempty"`
+
+	PrivateKey CertificatePrivateKey `json:"privateKey,omitempty"`
+	// EnrollmentCodeSecretRef is the key of a Secret of the Certificate's namespace that holds the
+	// enrollment code of the EJBCA end entity. It's required when EJBCA generates the key.
+	EnrollmentCodeSecretRef *SecretKeySelector `json:"enrollmentCodeSecretRef,omitempty"`
+
+	// Duration is the requested lifetime. The certificate profile decides the lifetime EJBCA issues.
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// RenewBefore is how long before expiry the certificate is renewed. It defaults to a third of
+	// the certificate's lifetime.
+	RenewBefore *metav1.Duration `json:"renewBefore,omitempty"`
+
+	// IssuerRef selects an EJBCAIssuer of the Certificate's namespace or a ClusterEJBCAIssuer. The
+	// signer's own EJBCA connection is used if it's empty.
+	IssuerRef *CertificateIssuerRef `json:"issuerRef,omitempty"`
+
+	// Keystores are written to the Secret in addition to the PEM files.
+	Keystores *CertificateKeystores `json:"keystores,omitempty"`
+}
+
+// X509Subject holds the subject attributes other than the common name.
+type X509Subject struct {
+	Organizations       []string `json:"organizations,omitempty"`
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+	Countries           []string `json:"countries,omitempty"`
+	Provinces           []string `json:"provinces,omitempty"`
+	Localities          []string `json:"localities,omitempty"`
+}
+
+// Private key algorithms of Certificates.
+const (
+	RSAKeyAlgorithm     = "RSA"
+	ECDSAKeyAlgorithm   = "ECDSA"
+	Ed25519KeyAlgorithm = "Ed25519"
+)
+
+// Private key generators of Certificates.
+const (
+	// SignerKeyGenerator generates the key in the signer and enrolls a CSR.
+	SignerKeyGenerator = "Signer"
+	// EJBCAKeyGenerator has EJBCA generate the key with keystore enrollment, so that key generation
+	// and escrow follow the EJBCA end entity profile.
+	EJBCAKeyGenerator = "EJBCA"
+)
+
+// CertificatePrivateKey describes the private key that's generated for every enrollment.
+type CertificatePrivateKey struct {
+	// Generator is Signer or EJBCA. It defaults to Signer.
+	Generator string `json:"generator,omitempty"`
+	// Algorithm is RSA, ECDSA or Ed25519. It defaults to RSA.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Size is the RSA modulus length, 2048 by default, or the ECDSA curve size, 256 by default.
+	Size int `json:"size,omitempty"`
+}
+
+// CertificateIssuerRef names an EJBCAIssuer or ClusterEJBCAIssuer.
+type CertificateIssuerRef struct {
+	Name string `json:"name"`
+	// Kind is EJBCAIssuer or ClusterEJBCAIssuer. It defaults to EJBCAIssuer.
+	Kind string `json:"kind,omitempty"`
+}
+
+// CertificateKeystores selects the keystores that are written for Java workloads.
+type CertificateKeystores struct {
+	// PKCS12 writes keystore.p12.
+	PKCS12 *KeystoreOptions `json:"pkcs12,omitempty"`
+	// JKS writes keystore.jks.
+	JKS *KeystoreOptions `json:"jks,omitempty"`
+}
+
+// KeystoreOptions configure a keystore.
+type KeystoreOptions struct {
+	// PasswordSecretRef is the key of a Secret of the Certificate's namespace that holds the
+	// keystore password.
+	PasswordSecretRef SecretKeySelector `json:"passwordSecretRef"`
+}
+
+// SecretKeySelector selects a key of a Secret.
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// CertificateStatus reports the state of the certificate in the Secret.
+type CertificateStatus struct {
+	// Conditions include Ready, which is true if the Secret holds a valid certificate for the spec.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	NotBefore    *metav1.Time `json:"notBefore,omitempty"`
+	NotAfter     *metav1.Time `json:"notAfter,omitempty"`
+	SerialNumber string       `json:"serialNumber,omitempty"`
+	// RenewalTime is when the certificate will be renewed.
+	RenewalTime *metav1.Time `json:"renewalTime,omitempty"`
+}
+
+// CertificateRevocationResource is the resource of CertificateRevocations.
+var CertificateRevocationResource = SchemeGroupVersion.WithResource("certificaterevocations")
+
+// CertificateRevocationKind is the kind of CertificateRevocations.
+const CertificateRevocationKind = "CertificateRevocation"
+
+// ConditionRevoked is the condition type reporting whether EJBCA revoked the certificate of a
+// CertificateRevocation.
+const ConditionRevoked = "Revoked"
+
+// CertificateRevocation revokes a certificate in EJBCA. It's cluster-scoped, so that RBAC on the
+// resource controls who can revoke certificates.
+type CertificateRevocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CertificateRevocationSpec   `json:"spec,omitempty"`
+	Status CertificateRevocationStatus `json:"status,omitempty"`
+}
+
+// CertificateRevocationSpec names the certificate to revoke by exactly one of a CSR, a serial
+// number and issuer DN, or the certificate itself.
+type CertificateRevocationSpec struct {
+	// CertificateSigningRequestName is a CSR whose issued certificate is revoked.
+	CertificateSigningRequestName string `json:"certificateSigningRequestName,omitempty"`
+
+	// SerialNumber is the hex serial number of the certificate, which is revoked with IssuerDN.
+	SerialNumber string `json:"serialNumber,omitempty"`
+	IssuerDN     string `json:"issuerDN,omitempty"`
+
+	// Certificate is the PEM encoded certificate to revoke.
+	Certificate string `json:"certificate,omitempty"`
+
+	// IssuerRef selects the EJBCAIssuer or ClusterEJBCAIssuer that the certificate is revoked
+	// through. It defaults to the issuer the CSR was enrolled with, or the signer's own connection.
+	IssuerRef *RevocationIssuerRef `json:"issuerRef,omitempty"`
+
+	// Reason is the RFC 5280 revocation reason. It defaults to UNSPECIFIED.
+	Reason string `json:"reason,omitempty"`
+	// RevocationDate backdates the revocation, if the CA allows it.
+	RevocationDate *metav1.Time `json:"revocationDate,omitempty"`
+}
+
+// RevocationIssuerRef names an EJBCAIssuer or ClusterEJBCAIssuer.
+type RevocationIssuerRef struct {
+	Name string `json:"name"`
+	// Kind is EJBCAIssuer or ClusterEJBCAIssuer. It defaults to ClusterEJBCAIssuer.
+	Kind string `json:"kind,omitempty"`
+	// Namespace of an EJBCAIssuer.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// CertificateRevocationStatus reports the revocation status that EJBCA confirmed.
+type CertificateRevocationStatus struct {
+	// Conditions include Revoked, which is true once EJBCA reports the certificate as revoked.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	SerialNumber   string       `json:"serialNumber,omitempty"`
+	IssuerDN       string       `json:"issuerDN,omitempty"`
+	Reason         string       `json:"reason,omitempty"`
+	RevocationDate *metav1.Time `json:"revocationDate,omitempty"`
+}
+
+// IssuedCertificateResource is the resource of IssuedCertificates.
+var IssuedCertificateResource = SchemeGroupVersion.WithResource("issuedcertificates")
+
+// IssuedCertificateKind is the kind of IssuedCertificates.
+const IssuedCertificateKind = "IssuedCertificate"
+
+// Revocation statuses of IssuedCertificates.
+const (
+	CertificateActive  = "Active"
+	CertificateRevoked = "Revoked"
+)
+
+// IssuedCertificate records a certificate that the signer had EJBCA issue. It's cluster-scoped and
+// outlives the CSR or resource it was issued for, so that it forms an inventory of the signer's
+// certificates.
+type IssuedCertificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IssuedCertificateSpec   `json:"spec,omitempty"`
+	Status IssuedCertificateStatus `json:"status,omitempty"`
+}
+
+// IssuedCertificateSpec describes the certificate and how it was issued. It isn't changed after
+// the IssuedCertificate is created.
+type IssuedCertificateSpec struct {
+	SerialNumber string `json:"serialNumber"`
+	IssuerDN     string `json:"issuerDN"`
+	Subject      string `json:"subject"`
+
+	DNSNames       []string `json:"dnsNames,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty"`
+
+	NotBefore metav1.Time `json:"notBefore"`
+	NotAfter  metav1.Time `json:"notAfter"`
+
+	// Issuer is the EJBCAIssuer or ClusterEJBCAIssuer the certificate was enrolled with, if any.
+	Issuer                   string `json:"issuer,omitempty"`
+	CertificateAuthorityName string `json:"certificateAuthorityName,omitempty"`
+	CertificateProfileName   string `json:"certificateProfileName,omitempty"`
+	EndEntityProfileName     string `json:"endEntityProfileName,omitempty"`
+	ESTAlias                 string `json:"estAlias,omitempty"`
+	EndEntityUsername        string `json:"endEntityUsername,omitempty"`
+
+	SignerName string   `json:"signerName"`
+	Requester  string   `json:"requester,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+
+	// Source is the CSR, cert-manager CertificateRequest or Certificate the certificate was
+	// issued for.
+	Source IssuedCertificateSource `json:"source"`
+
+	// Certificate is the PEM encoded certificate.
+	Certificate string `json:"certificate"`
+}
+
+// IssuedCertificateSource names the object a certificate was issued for.
+type IssuedCertificateSource struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+}
+
+// IssuedCertificateStatus reports the last known revocation status of the certificate.
+type IssuedCertificateStatus struct {
+	// Conditions include Revoked, which is true once the certificate is known to be revoked.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// RevocationStatus is Active or Revoked.
+	RevocationStatus string       `json:"revocationStatus,omitempty"`
+	RevocationReason string       `json:"revocationReason,omitempty"`
+	RevocationDate   *metav1.Time `json:"revocationDate,omitempty"`
+}
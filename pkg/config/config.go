@@ -1,29 +1,324 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
 	"gopkg.in/yaml.v3"
+	"io"
 	"io/ioutil"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion and Kind identify the current configuration schema.
+const (
+	APIVersion = "ejbca.keyfactor.com/v1alpha1"
+	Kind       = "SignerConfig"
 )
 
 type ServerConfig struct {
-	HealthCheckPort                 string `yaml:"healthcheckPort"`
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+
+	HealthCheckPort                 Port   `yaml:"healthcheckPort"`
 	DefaultCertificateProfileName   string `yaml:"defaultCertificateProfileName"`
 	DefaultEndEntityProfileName     string `yaml:"defaultEndEntityProfileName"`
 	DefaultCertificateAuthorityName string `yaml:"defaultCertificateAuthorityName"`
 	UseEST                          bool   `yaml:"useEST"`
 	DefaultESTAlias                 string `yaml:"defaultESTAlias"`
+
+	// SignerNames are the CSR signer names handled by this signer. A name ending in "/*"
+	// matches every signer name in that domain.
+	SignerNames []string `yaml:"signerNames"`
+	// SignerPolicies apply a mode with additional checks, and optionally their own CA and
+	// profiles, to the CSRs of individual signer names.
+	SignerPolicies []SignerPolicy `yaml:"signerPolicies"`
+	// DryRun evaluates CSRs and records what would be enrolled without contacting EJBCA or
+	// writing CSR status, so the signer can shadow another signer.
+	DryRun bool `yaml:"dryRun"`
+
+	// AuthorizeProfiles requires CSR requesters to be allowed by RBAC to "use" the CA and profiles
+	// they are enrolled with, as the virtual resources ejbcacas, ejbcaprofiles, ejbcaendentityprofiles
+	// and ejbcaestaliases in the ejbca.keyfactor.com group.
+	AuthorizeProfiles bool `yaml:"authorizeProfiles"`
+
+	// VerifySANOwnership fails CSRs requested by service accounts whose DNS or IP SANs don't
+	// belong to a Service, Ingress, Pod or external domain of the service account's namespace.
+	VerifySANOwnership bool `yaml:"verifySANOwnership"`
+	// ClusterDomain is the DNS domain of the cluster, used to match Service names.
+	ClusterDomain string `yaml:"clusterDomain"`
+
+	// EnableIssuers watches EJBCAIssuer and ClusterEJBCAIssuer resources, which CSRs can select by
+	// annotation or signer name. The connection in the credentials file becomes optional.
+	EnableIssuers bool `yaml:"enableIssuers"`
+	// ClusterResourceNamespace holds the Secrets referenced by ClusterEJBCAIssuers. It defaults
+	// to the namespace the signer runs in.
+	ClusterResourceNamespace string `yaml:"clusterResourceNamespace"`
+	// EnableCertManager signs cert-manager CertificateRequests whose issuerRef is an EJBCAIssuer
+	// or ClusterEJBCAIssuer. It requires enableIssuers.
+	EnableCertManager bool `yaml:"enableCertManager"`
+	// EnableCertificates reconciles Certificate resources, whose keys the signer generates and
+	// whose certificates it writes to Secrets and renews.
+	EnableCertificates bool `yaml:"enableCertificates"`
+	// EnableCertificateRevocations reconciles CertificateRevocation resources, which revoke
+	// certificates in EJBCA.
+	EnableCertificateRevocations bool `yaml:"enableCertificateRevocations"`
+	// EnableCertificateInventory creates an IssuedCertificate for every certificate the signer has
+	// EJBCA issue, which outlives the CSR.
+	EnableCertificateInventory bool `yaml:"enableCertificateInventory"`
+	// InventoryRetention is how long an IssuedCertificate is kept after its certificate expired.
+	InventoryRetention time.Duration `yaml:"inventoryRetention"`
+	// ExpiryMonitor warns about certificates in the inventory that are about to expire.
+	ExpiryMonitor ExpiryMonitorConfig `yaml:"expiryMonitor"`
+	// RevocationMonitor finds certificates in the inventory that were revoked in EJBCA.
+	RevocationMonitor RevocationMonitorConfig `yaml:"revocationMonitor"`
+
+	// ShutdownGracePeriod is how long in-flight enrollments are given to finish after SIGTERM.
+	ShutdownGracePeriod time.Duration `yaml:"shutdownGracePeriod"`
+
+	// Workers is the number of CSRs that are processed concurrently.
+	Workers int `yaml:"workers"`
+	// ResyncPeriod is how often the CSR informer replays every object. Zero disables resync.
+	ResyncPeriod time.Duration `yaml:"resyncPeriod"`
+	// CacheSyncTimeout bounds how long the controller waits for the informer cache on startup.
+	CacheSyncTimeout time.Duration `yaml:"cacheSyncTimeout"`
+
+	// RetryBaseDelay and RetryMaxDelay bound the per-CSR exponential backoff after a failed sync.
+	RetryBaseDelay time.Duration `yaml:"retryBaseDelay"`
+	RetryMaxDelay  time.Duration `yaml:"retryMaxDelay"`
+	// RetryQPS and RetryBurst limit the overall rate at which failed CSRs are retried.
+	RetryQPS   float64 `yaml:"retryQPS"`
+	RetryBurst int     `yaml:"retryBurst"`
+
+	// KubeClientQPS and KubeClientBurst configure the client-side rate limit of the Kubernetes client.
+	KubeClientQPS   float32 `yaml:"kubeClientQPS"`
+	KubeClientBurst int     `yaml:"kubeClientBurst"`
+
+	// CircuitBreaker stops calls to EJBCA after consecutive failures.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+	// EJBCAQPS and EJBCABurst cap the overall rate of calls to EJBCA. Zero disables the limit.
+	EJBCAQPS   float64 `yaml:"ejbcaQPS"`
+	EJBCABurst int     `yaml:"ejbcaBurst"`
+	// EndpointHealthCheckInterval is how often every EJBCA endpoint is health-checked in the
+	// background.
+	EndpointHealthCheckInterval time.Duration `yaml:"endpointHealthCheckInterval"`
+	// MaxConcurrentEnrollmentsPerCA bounds the enrollments in flight for each CA or EST alias.
+	// Zero disables the limit.
+	MaxConcurrentEnrollmentsPerCA int `yaml:"maxConcurrentEnrollmentsPerCA"`
+	// ApprovalPollInterval is how often enrollments waiting for approval by a CA administrator
+	// in EJBCA are finalized.
+	ApprovalPollInterval time.Duration `yaml:"approvalPollInterval"`
+
+	// Audit configures where the audit trail of issuance decisions is written.
+	Audit AuditConfig `yaml:"audit"`
+}
+
+// Port is a TCP port. Legacy configurations quote it, so it's also decoded from a string.
+type Port int
+
+func (p *Port) UnmarshalYAML(value *yaml.Node) error {
+	var port int
+	if err := value.Decode(&port); err == nil {
+		*p = Port(port)
+		return nil
+	}
+	var quoted string
+	if err := value.Decode(&quoted); err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(quoted))
+	if err != nil {
+		return fmt.Errorf("line %d: %q is not a port number", value.Line, quoted)
+	}
+	*p = Port(port)
+	return nil
+}
+
+// CircuitBreakerConfig configures the circuit breaker in front of EJBCA. It opens after
+// FailureThreshold consecutive connection or 5xx errors, and lets a single probe through once
+// OpenTimeout has passed.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold"`
+	OpenTimeout      time.Duration `yaml:"openTimeout"`
+}
+
+// ExpiryMonitorConfig configures the periodic search for expiring certificates with EJBCA's
+// expiring certificates API. It requires enableCertificateInventory.
+type ExpiryMonitorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often EJBCA is searched.
+	Interval time.Duration `yaml:"interval"`
+	// Windows are the days before expiry at which a warning Event is emitted. The largest one is
+	// searched.
+	Windows []int `yaml:"windows"`
+	// PageSize is the number of certificates requested from EJBCA at a time.
+	PageSize int `yaml:"pageSize"`
+}
+
+// RevocationMonitorConfig configures the periodic revocation status check of the certificates in
+// the inventory. It requires enableCertificateInventory.
+type RevocationMonitorConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often every certificate is checked.
+	Interval time.Duration `yaml:"interval"`
+	// BatchSize is the number of IssuedCertificates listed at a time.
+	BatchSize int `yaml:"batchSize"`
+	// QPS caps the rate of revocation status checks sent to EJBCA.
+	QPS float64 `yaml:"qps"`
+}
+
+// Signer policy modes.
+const (
+	// ModeSPIFFE issues SPIFFE X.509-SVIDs to service accounts.
+	ModeSPIFFE = "spiffe"
+	// ModeKubeletServing issues kubelet serving certificates after verifying the node's identity.
+	ModeKubeletServing = "kubelet-serving"
+	// ModeAPIServerClient issues kube-apiserver client certificates to users by group rules.
+	ModeAPIServerClient = "kube-apiserver-client"
+)
+
+// SignerPolicy configures how the CSRs of a single signer name are checked and enrolled. The CA,
+// profiles and EST alias of a policy can't be overridden with annotations.
+type SignerPolicy struct {
+	SignerName string `yaml:"signerName"`
+	// Mode selects additional checks. It is empty for none, or one of the Mode constants.
+	Mode string `yaml:"mode"`
+
+	CertificateAuthorityName string `yaml:"certificateAuthorityName"`
+	CertificateProfileName   string `yaml:"certificateProfileName"`
+	EndEntityProfileName     string `yaml:"endEntityProfileName"`
+	ESTAlias                 string `yaml:"estAlias"`
+
+	// SPIFFE configures ModeSPIFFE.
+	SPIFFE SPIFFEConfig `yaml:"spiffe"`
+	// APIServerClient configures ModeAPIServerClient.
+	APIServerClient APIServerClientConfig `yaml:"kubeAPIServerClient"`
+
+	// AutoApprove approves pending CSRs that pass the checks of the mode, and denies the others,
+	// so that no separate approver is needed.
+	AutoApprove bool `yaml:"autoApprove"`
+
+	// RevokeOnDelete revokes the certificates of deleted CSRs of the signer name in EJBCA, with
+	// RevocationReason, an RFC 5280 reason that defaults to CESSATION_OF_OPERATION.
+	RevokeOnDelete   bool   `yaml:"revokeOnDelete"`
+	RevocationReason string `yaml:"revocationReason"`
 }
 
+// revocationReasons are the RFC 5280 reasons EJBCA can revoke a certificate with.
+var revocationReasons = map[string]bool{
+	"UNSPECIFIED":            true,
+	"KEY_COMPROMISE":         true,
+	"CA_COMPROMISE":          true,
+	"AFFILIATION_CHANGED":    true,
+	"SUPERSEDED":             true,
+	"CESSATION_OF_OPERATION": true,
+	"CERTIFICATE_HOLD":       true,
+	"PRIVILEGES_WITHDRAWN":   true,
+	"AA_COMPROMISE":          true,
+}
+
+// SPIFFEConfig configures the issuance of X.509-SVIDs.
+type SPIFFEConfig struct {
+	// TrustDomain is the trust domain of issued SPIFFE IDs, such as cluster.local.
+	TrustDomain string `yaml:"trustDomain"`
+}
+
+// APIServerClientConfig configures the issuance of kube-apiserver client certificates to users.
+type APIServerClientConfig struct {
+	// Groups grant the members of a group certificates for a set of Kubernetes groups.
+	Groups []ClientGroupConfig `yaml:"groups"`
+	// AllowedPrivilegedGroups are the system: groups, such as system:masters, that may be granted.
+	AllowedPrivilegedGroups []string `yaml:"allowedPrivilegedGroups"`
+}
+
+// ClientGroupConfig grants the members of Group client certificates.
+type ClientGroupConfig struct {
+	Group string `yaml:"group"`
+	// Organizations are the O values, that is the Kubernetes groups, members may request.
+	Organizations []string `yaml:"organizations"`
+	// MaxDuration limits spec.expirationSeconds of the CSR. Zero leaves the lifetime to the
+	// certificate profile.
+	MaxDuration time.Duration `yaml:"maxDuration"`
+}
+
+// AuditConfig selects the sinks that audit records are written to. Any combination may be enabled.
+type AuditConfig struct {
+	// Stdout writes each record as a line of JSON to standard output.
+	Stdout bool `yaml:"stdout"`
+	// File appends records to a file with size based rotation.
+	File AuditFileConfig `yaml:"file"`
+	// Syslog sends records to a syslog server as RFC 5424 messages.
+	Syslog AuditSyslogConfig `yaml:"syslog"`
+}
+
+// AuditFileConfig configures the file audit sink. It is disabled if Path is empty.
+type AuditFileConfig struct {
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"maxSizeMB"`
+	MaxBackups int    `yaml:"maxBackups"`
+}
+
+// AuditSyslogConfig configures the syslog audit sink. It is disabled if Address is empty.
+type AuditSyslogConfig struct {
+	// Network is one of udp, tcp or unix.
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+}
+
+// DefaultSignerNames is used when signerNames isn't configured.
+var DefaultSignerNames = []string{"keyfactor.com/*"}
+
+// DefaultExpiryWindows are the expiry monitor windows, in days, used when none are configured.
+var DefaultExpiryWindows = []int{30, 7, 1}
+
+// Defaults used when the corresponding field isn't configured.
+const (
+	DefaultHealthCheckPort     = 5354
+	DefaultShutdownGracePeriod = 30 * time.Second
+	DefaultWorkers             = 3
+	DefaultCacheSyncTimeout    = 60 * time.Second
+	DefaultRetryBaseDelay      = 200 * time.Millisecond
+	DefaultRetryMaxDelay       = 1000 * time.Second
+	DefaultRetryQPS            = 10
+	DefaultRetryBurst          = 100
+	DefaultKubeClientQPS       = 5
+	DefaultKubeClientBurst     = 10
+	DefaultFailureThreshold    = 5
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultOpenTimeout         = 30 * time.Second
+	DefaultAuditFileMaxSizeMB  = 100
+	DefaultAuditFileMaxBackups = 10
+	DefaultAuditSyslogNetwork  = "udp"
+	DefaultClusterDomain       = "cluster.local"
+	DefaultExpiryInterval      = time.Hour
+	DefaultExpiryPageSize      = 100
+	DefaultRevocationInterval  = 6 * time.Hour
+	DefaultRevocationBatchSize = 100
+	DefaultRevocationQPS       = 2
+	DefaultApprovalPoll        = time.Minute
+	DefaultInventoryRetention  = 30 * 24 * time.Hour
+)
+
 var (
 	configLog = logger.Register("Config")
 )
 
-func LoadConfig() (*ServerConfig, error) {
-	config := &ServerConfig{}
+// DefaultConfigPath is where the Helm chart mounts the ejbca-config configmap.
+const DefaultConfigPath = "./config/config.yaml"
 
-	file := "./config/config.yaml"
+// LoadConfig reads the server configuration from the YAML file at the given path, applies
+// environment and flag overrides, fills in defaults and validates the result. Every problem
+// found is reported in a single aggregate error. An invalid configuration is still returned if it
+// could be read, so that callers can check what depends on it; it must not be used to run.
+func LoadConfig(file string, overrides *Overrides) (*ServerConfig, error) {
+	if file == "" {
+		file = DefaultConfigPath
+	}
 	configLog.Infof("Getting configuration from %s", file)
 
 	buf, err := ioutil.ReadFile(file)
@@ -38,12 +333,325 @@ func LoadConfig() (*ServerConfig, error) {
 
 	configLog.Tracef("%s exists and contains %d bytes", file, len(buf))
 
-	err = yaml.Unmarshal(buf, &config)
-	if err != nil {
-		return nil, err
+	config, errs := decode(buf)
+	if err = overrides.Apply(config); err != nil {
+		errs = append(errs, err)
+	}
+	config.setDefaults()
+	if err = config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return config, fmt.Errorf("invalid configuration in %s: %w", file, aggregate(errs))
 	}
 
 	configLog.Infof("Successfully retrieved configuration: \n %#v\n", config)
 
 	return config, nil
 }
+
+// decode unmarshals a configuration document. Versioned documents are decoded strictly so that
+// unknown or mistyped keys are reported; documents without an apiVersion are treated as the
+// legacy format and decoded leniently.
+func decode(buf []byte) (*ServerConfig, []error) {
+	config := &ServerConfig{}
+
+	var header struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+	}
+	if err := yaml.Unmarshal(buf, &header); err != nil {
+		return config, []error{err}
+	}
+
+	if header.APIVersion == "" && header.Kind == "" {
+		configLog.Warnf("Configuration has no apiVersion; decoding it leniently as a legacy configuration. Set apiVersion: %s and kind: %s to enable strict validation", APIVersion, Kind)
+		if err := yaml.Unmarshal(buf, config); err != nil {
+			return config, []error{err}
+		}
+		config.APIVersion = APIVersion
+		config.Kind = Kind
+		return config, nil
+	}
+
+	var errs []error
+	if header.APIVersion != APIVersion {
+		errs = append(errs, fmt.Errorf("unsupported apiVersion %q, expected %q", header.APIVersion, APIVersion))
+	}
+	if header.Kind != Kind {
+		errs = append(errs, fmt.Errorf("unsupported kind %q, expected %q", header.Kind, Kind))
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, e := range typeErr.Errors {
+				errs = append(errs, errors.New(e))
+			}
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	return config, errs
+}
+
+// setDefaults fills in every unset setting. Negative values are left alone so that Validate
+// can report them.
+func (c *ServerConfig) setDefaults() {
+	if c.HealthCheckPort == 0 {
+		c.HealthCheckPort = DefaultHealthCheckPort
+	}
+	if len(c.SignerNames) == 0 {
+		c.SignerNames = DefaultSignerNames
+	}
+	if c.ClusterDomain == "" {
+		c.ClusterDomain = DefaultClusterDomain
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = DefaultShutdownGracePeriod
+	}
+	if c.Workers == 0 {
+		c.Workers = DefaultWorkers
+	}
+	if c.CacheSyncTimeout == 0 {
+		c.CacheSyncTimeout = DefaultCacheSyncTimeout
+	}
+	if c.RetryBaseDelay == 0 {
+		c.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if c.RetryMaxDelay == 0 {
+		c.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+	if c.RetryQPS == 0 {
+		c.RetryQPS = DefaultRetryQPS
+	}
+	if c.RetryBurst == 0 {
+		c.RetryBurst = DefaultRetryBurst
+	}
+	if c.KubeClientQPS == 0 {
+		c.KubeClientQPS = DefaultKubeClientQPS
+	}
+	if c.KubeClientBurst == 0 {
+		c.KubeClientBurst = DefaultKubeClientBurst
+	}
+	if c.CircuitBreaker.FailureThreshold == 0 {
+		c.CircuitBreaker.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.CircuitBreaker.OpenTimeout == 0 {
+		c.CircuitBreaker.OpenTimeout = DefaultOpenTimeout
+	}
+	if c.EndpointHealthCheckInterval == 0 {
+		c.EndpointHealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if c.EJBCAQPS > 0 && c.EJBCABurst == 0 {
+		c.EJBCABurst = int(math.Ceil(c.EJBCAQPS))
+	}
+	if c.Audit.File.Path != "" {
+		if c.Audit.File.MaxSizeMB == 0 {
+			c.Audit.File.MaxSizeMB = DefaultAuditFileMaxSizeMB
+		}
+		if c.Audit.File.MaxBackups == 0 {
+			c.Audit.File.MaxBackups = DefaultAuditFileMaxBackups
+		}
+	}
+	if c.Audit.Syslog.Address != "" && c.Audit.Syslog.Network == "" {
+		c.Audit.Syslog.Network = DefaultAuditSyslogNetwork
+	}
+	if c.ExpiryMonitor.Enabled {
+		if c.ExpiryMonitor.Interval == 0 {
+			c.ExpiryMonitor.Interval = DefaultExpiryInterval
+		}
+		if len(c.ExpiryMonitor.Windows) == 0 {
+			c.ExpiryMonitor.Windows = DefaultExpiryWindows
+		}
+		if c.ExpiryMonitor.PageSize == 0 {
+			c.ExpiryMonitor.PageSize = DefaultExpiryPageSize
+		}
+	}
+	if c.ApprovalPollInterval == 0 {
+		c.ApprovalPollInterval = DefaultApprovalPoll
+	}
+	if c.EnableCertificateInventory && c.InventoryRetention == 0 {
+		c.InventoryRetention = DefaultInventoryRetention
+	}
+	if c.RevocationMonitor.Enabled {
+		if c.RevocationMonitor.Interval == 0 {
+			c.RevocationMonitor.Interval = DefaultRevocationInterval
+		}
+		if c.RevocationMonitor.BatchSize == 0 {
+			c.RevocationMonitor.BatchSize = DefaultRevocationBatchSize
+		}
+		if c.RevocationMonitor.QPS == 0 {
+			c.RevocationMonitor.QPS = DefaultRevocationQPS
+		}
+	}
+}
+
+// Validate checks the configuration and returns every problem found.
+func (c *ServerConfig) Validate() error {
+	var errs []error
+	if c.HealthCheckPort < 1 || c.HealthCheckPort > 65535 {
+		errs = append(errs, fmt.Errorf("healthcheckPort must be between 1 and 65535, got %d", c.HealthCheckPort))
+	}
+	if c.UseEST && c.DefaultESTAlias == "" {
+		configLog.Warnln("useEST is set without a defaultESTAlias; CSRs without an estAlias annotation will use the EST default alias")
+	}
+	for _, name := range c.SignerNames {
+		if !strings.Contains(name, "/") || (strings.Contains(name, "*") && !strings.HasSuffix(name, "/*")) {
+			errs = append(errs, fmt.Errorf("signerNames entry %q must be a signer name like example.com/name or a domain wildcard like example.com/*", name))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, policy := range c.SignerPolicies {
+		errs = append(errs, policy.validate(fmt.Sprintf("signerPolicies[%d]", i))...)
+		if seen[policy.SignerName] {
+			errs = append(errs, fmt.Errorf("signerPolicies[%d]: duplicate policy for signer name %q", i, policy.SignerName))
+		}
+		seen[policy.SignerName] = true
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("shutdownGracePeriod must not be negative, got %v", c.ShutdownGracePeriod))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1, got %d", c.Workers))
+	}
+	if c.ResyncPeriod < 0 {
+		errs = append(errs, fmt.Errorf("resyncPeriod must not be negative, got %v", c.ResyncPeriod))
+	}
+	if c.CacheSyncTimeout < 0 {
+		errs = append(errs, fmt.Errorf("cacheSyncTimeout must not be negative, got %v", c.CacheSyncTimeout))
+	}
+	if c.RetryBaseDelay < 0 {
+		errs = append(errs, fmt.Errorf("retryBaseDelay must not be negative, got %v", c.RetryBaseDelay))
+	}
+	if c.RetryMaxDelay < c.RetryBaseDelay {
+		errs = append(errs, fmt.Errorf("retryMaxDelay (%v) must not be less than retryBaseDelay (%v)", c.RetryMaxDelay, c.RetryBaseDelay))
+	}
+	if c.RetryQPS < 0 {
+		errs = append(errs, fmt.Errorf("retryQPS must not be negative, got %v", c.RetryQPS))
+	}
+	if c.RetryBurst < 1 {
+		errs = append(errs, fmt.Errorf("retryBurst must be at least 1, got %d", c.RetryBurst))
+	}
+	if c.KubeClientQPS < 0 {
+		errs = append(errs, fmt.Errorf("kubeClientQPS must not be negative, got %v", c.KubeClientQPS))
+	}
+	if c.KubeClientBurst < 1 {
+		errs = append(errs, fmt.Errorf("kubeClientBurst must be at least 1, got %d", c.KubeClientBurst))
+	}
+	if c.CircuitBreaker.FailureThreshold < 1 {
+		errs = append(errs, fmt.Errorf("circuitBreaker.failureThreshold must be at least 1, got %d", c.CircuitBreaker.FailureThreshold))
+	}
+	if c.CircuitBreaker.OpenTimeout < 0 {
+		errs = append(errs, fmt.Errorf("circuitBreaker.openTimeout must not be negative, got %v", c.CircuitBreaker.OpenTimeout))
+	}
+	if c.EJBCAQPS < 0 {
+		errs = append(errs, fmt.Errorf("ejbcaQPS must not be negative, got %v", c.EJBCAQPS))
+	}
+	if c.EJBCABurst < 0 {
+		errs = append(errs, fmt.Errorf("ejbcaBurst must not be negative, got %d", c.EJBCABurst))
+	}
+	if c.EndpointHealthCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("endpointHealthCheckInterval must not be negative, got %v", c.EndpointHealthCheckInterval))
+	}
+	if c.ApprovalPollInterval < 0 {
+		errs = append(errs, fmt.Errorf("approvalPollInterval must not be negative, got %v", c.ApprovalPollInterval))
+	}
+	if c.MaxConcurrentEnrollmentsPerCA < 0 {
+		errs = append(errs, fmt.Errorf("maxConcurrentEnrollmentsPerCA must not be negative, got %d", c.MaxConcurrentEnrollmentsPerCA))
+	}
+	if c.Audit.File.MaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("audit.file.maxSizeMB must not be negative, got %d", c.Audit.File.MaxSizeMB))
+	}
+	if c.Audit.File.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("audit.file.maxBackups must not be negative, got %d", c.Audit.File.MaxBackups))
+	}
+	if c.EnableCertManager && !c.EnableIssuers {
+		errs = append(errs, errors.New("enableCertManager requires enableIssuers"))
+	}
+	if c.InventoryRetention < 0 {
+		errs = append(errs, fmt.Errorf("inventoryRetention must not be negative, got %v", c.InventoryRetention))
+	}
+	if c.ExpiryMonitor.Enabled {
+		if !c.EnableCertificateInventory {
+			errs = append(errs, errors.New("expiryMonitor requires enableCertificateInventory"))
+		}
+		if c.ExpiryMonitor.Interval < 0 {
+			errs = append(errs, fmt.Errorf("expiryMonitor.interval must not be negative, got %v", c.ExpiryMonitor.Interval))
+		}
+		for i, window := range c.ExpiryMonitor.Windows {
+			if window < 1 {
+				errs = append(errs, fmt.Errorf("expiryMonitor.windows[%d] must be at least 1 day, got %d", i, window))
+			}
+		}
+		if c.ExpiryMonitor.PageSize < 1 {
+			errs = append(errs, fmt.Errorf("expiryMonitor.pageSize must be at least 1, got %d", c.ExpiryMonitor.PageSize))
+		}
+	}
+	if c.RevocationMonitor.Enabled {
+		if !c.EnableCertificateInventory {
+			errs = append(errs, errors.New("revocationMonitor requires enableCertificateInventory"))
+		}
+		if c.RevocationMonitor.Interval < 0 {
+			errs = append(errs, fmt.Errorf("revocationMonitor.interval must not be negative, got %v", c.RevocationMonitor.Interval))
+		}
+		if c.RevocationMonitor.BatchSize < 1 {
+			errs = append(errs, fmt.Errorf("revocationMonitor.batchSize must be at least 1, got %d", c.RevocationMonitor.BatchSize))
+		}
+		if c.RevocationMonitor.QPS < 0 {
+			errs = append(errs, fmt.Errorf("revocationMonitor.qps must not be negative, got %v", c.RevocationMonitor.QPS))
+		}
+	}
+	if c.Audit.Syslog.Address != "" {
+		switch c.Audit.Syslog.Network {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			errs = append(errs, fmt.Errorf("audit.syslog.network must be one of udp, tcp, unix or unixgram, got %q", c.Audit.Syslog.Network))
+		}
+	}
+	return aggregate(errs)
+}
+
+// validate checks a signer policy. Errors are prefixed with path.
+func (p *SignerPolicy) validate(path string) []error {
+	var errs []error
+	if !strings.Contains(p.SignerName, "/") || strings.Contains(p.SignerName, "*") {
+		errs = append(errs, fmt.Errorf("%s.signerName must be a signer name like example.com/name, got %q", path, p.SignerName))
+	}
+	switch p.Mode {
+	case "":
+	case ModeSPIFFE:
+		if p.SPIFFE.TrustDomain == "" || strings.ContainsAny(p.SPIFFE.TrustDomain, "/:") {
+			errs = append(errs, fmt.Errorf("%s.spiffe.trustDomain must be a trust domain name like example.org, got %q", path, p.SPIFFE.TrustDomain))
+		}
+	case ModeKubeletServing:
+	case ModeAPIServerClient:
+		if len(p.APIServerClient.Groups) == 0 {
+			errs = append(errs, fmt.Errorf("%s.kubeAPIServerClient.groups must not be empty", path))
+		}
+		for i, group := range p.APIServerClient.Groups {
+			if group.Group == "" {
+				errs = append(errs, fmt.Errorf("%s.kubeAPIServerClient.groups[%d].group must be set", path, i))
+			}
+			if group.MaxDuration < 0 {
+				errs = append(errs, fmt.Errorf("%s.kubeAPIServerClient.groups[%d].maxDuration must not be negative", path, i))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s.mode must be empty, %s, %s or %s, got %q", path, ModeSPIFFE, ModeKubeletServing, ModeAPIServerClient, p.Mode))
+	}
+	if p.AutoApprove && p.Mode == "" {
+		errs = append(errs, fmt.Errorf("%s.autoApprove requires a mode that verifies the requester", path))
+	}
+	if p.RevocationReason != "" && !revocationReasons[p.RevocationReason] {
+		errs = append(errs, fmt.Errorf("%s.revocationReason must be an RFC 5280 reason like CESSATION_OF_OPERATION, got %q", path, p.RevocationReason))
+	}
+	return errs
+}
+
+// aggregate flattens errs into a single error, or nil if there are none.
+func aggregate(errs []error) error {
+	return utilerrors.Flatten(utilerrors.NewAggregate(errs))
+}
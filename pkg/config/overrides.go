@@ -0,0 +1,205 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix is prepended to the environment variable name of every configuration field.
+const EnvPrefix = "SIGNER_"
+
+// Overrides holds configuration values set with environment variables or command line flags.
+// Every field of ServerConfig gets a flag named after its YAML key in kebab case
+// (defaultCertificateProfileName becomes --default-certificate-profile-name) and an environment
+// variable in upper snake case with EnvPrefix (SIGNER_DEFAULT_CERTIFICATE_PROFILE_NAME). Fields
+// of nested sections are prefixed with the section key. Lists of strings or numbers are comma
+// separated, and lists of sections such as signerPolicies are given as YAML, for example
+// '[{signerName: example.com/spiffe, mode: spiffe}]'. Flags take precedence over environment
+// variables, which take precedence over the configuration file.
+type Overrides struct {
+	fields []overrideField
+	flags  map[string]string
+}
+
+type overrideField struct {
+	path []int
+	key  string
+	flag string
+	env  string
+}
+
+// NewOverrides registers a flag for every configuration field on fs. The flags are only read
+// once fs has been parsed.
+func NewOverrides(fs *flag.FlagSet) *Overrides {
+	o := &Overrides{flags: make(map[string]string)}
+	o.collect(reflect.TypeOf(ServerConfig{}), nil, "")
+
+	for _, f := range o.fields {
+		name := f.flag
+		fs.Func(name, fmt.Sprintf("Overrides %s from the configuration file (env %s).", f.key, f.env), func(value string) error {
+			o.flags[name] = value
+			return nil
+		})
+	}
+	return o
+}
+
+func (o *Overrides) collect(t reflect.Type, path []int, keyPrefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" || key == "apiVersion" || key == "kind" {
+			continue
+		}
+		fieldPath := append(append([]int{}, path...), i)
+		if keyPrefix != "" {
+			key = keyPrefix + "." + key
+		}
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			o.collect(field.Type, fieldPath, key)
+			continue
+		}
+		if !overridable(field.Type) {
+			continue
+		}
+
+		words := splitKey(key)
+		o.fields = append(o.fields, overrideField{
+			path: fieldPath,
+			key:  key,
+			flag: strings.Join(words, "-"),
+			env:  EnvPrefix + strings.ToUpper(strings.Join(words, "_")),
+		})
+	}
+}
+
+// Apply sets every field that was overridden by an environment variable or flag.
+func (o *Overrides) Apply(config *ServerConfig) error {
+	if o == nil {
+		return nil
+	}
+
+	var errs []error
+	v := reflect.ValueOf(config).Elem()
+	for _, f := range o.fields {
+		value, source, ok := o.lookup(f)
+		if !ok {
+			continue
+		}
+		if err := setField(v.FieldByIndex(f.path), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q for %s: %v", source, value, f.key, err))
+			continue
+		}
+		configLog.Debugf("%s overridden by %s", f.key, source)
+	}
+	return aggregate(errs)
+}
+
+func (o *Overrides) lookup(f overrideField) (value string, source string, ok bool) {
+	if value, ok = o.flags[f.flag]; ok {
+		return value, "flag --" + f.flag, true
+	}
+	if value, ok = os.LookupEnv(f.env); ok {
+		return value, "environment variable " + f.env, true
+	}
+	return "", "", false
+}
+
+func overridable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return true
+	}
+	return false
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if field.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		switch kind := field.Type().Elem().Kind(); {
+		case (kind == reflect.String || kind == reflect.Int) && !strings.HasPrefix(strings.TrimSpace(value), "["):
+			items := reflect.MakeSlice(field.Type(), 0, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				element := reflect.New(field.Type().Elem()).Elem()
+				if err := setField(element, item); err != nil {
+					return err
+				}
+				items = reflect.Append(items, element)
+			}
+			field.Set(items)
+		default:
+			decoded := reflect.New(field.Type())
+			if err := yaml.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+				return err
+			}
+			field.Set(decoded.Elem())
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// splitKey breaks a camel case YAML key into lower case words, keeping acronyms together:
+// "defaultESTAlias" becomes [default est alias].
+func splitKey(key string) []string {
+	var words []string
+	for _, part := range strings.Split(key, ".") {
+		runes := []rune(part)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			if !unicode.IsUpper(runes[i]) {
+				continue
+			}
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				words = append(words, strings.ToLower(string(runes[start:i])))
+				start = i
+			}
+		}
+		words = append(words, strings.ToLower(string(runes[start:])))
+	}
+	return words
+}
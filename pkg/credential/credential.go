@@ -1,10 +1,12 @@
 package credential
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/logger"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"os"
 )
 
@@ -15,6 +17,9 @@ var (
 type EJBCACredential struct {
 	// Hostname to EJBCA server
 	Hostname string `yaml:"hostname"`
+	// Endpoints lists the EJBCA nodes to enroll with, in order of preference, for clusters
+	// reachable under more than one hostname. Hostname is ignored if Endpoints is set.
+	Endpoints []EJBCAEndpoint `yaml:"endpoints"`
 
 	// Password used to protect key, if it's encrypted according to RFC 1423. Leave blank if private key
 	// is not encrypted.
@@ -25,10 +30,24 @@ type EJBCACredential struct {
 	ClientKeyPath  string
 }
 
-func LoadCredential() (*EJBCACredential, error) {
+// EJBCAEndpoint is a single EJBCA node.
+type EJBCAEndpoint struct {
+	Hostname string `yaml:"hostname"`
+	// Weight is the relative share of enrollments sent to the node. If no endpoint has a
+	// weight, endpoints are tried in the order they are listed.
+	Weight int `yaml:"weight"`
+}
+
+// DefaultCredentialPath is where the Helm chart mounts the ejbca-credentials secret.
+const DefaultCredentialPath = "./credentials/credentials.yaml"
+
+// LoadCredential reads EJBCA credentials from the YAML file at the given path.
+func LoadCredential(file string) (*EJBCACredential, error) {
 	creds := &EJBCACredential{}
 
-	file := "./credentials/credentials.yaml"
+	if file == "" {
+		file = DefaultCredentialPath
+	}
 	credLog.Infof("Getting credentials from %s", file)
 
 	buf, err := ioutil.ReadFile(file)
@@ -41,9 +60,15 @@ func LoadCredential() (*EJBCACredential, error) {
 		return nil, fmt.Errorf("%s is empty. ensure that a secret was created called ejbca-credentials", file)
 	}
 
-	err = yaml.Unmarshal(buf, &creds)
+	err = yaml.Unmarshal(buf, creds)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid credentials in %s: %v", file, err)
+	}
+	// Credential Secrets often carry keys for other tools, so unknown keys are only reported
+	strict := yaml.NewDecoder(bytes.NewReader(buf))
+	strict.KnownFields(true)
+	if err = strict.Decode(&EJBCACredential{}); err != nil {
+		credLog.Warnf("Ignoring unknown keys in %s: %v", file, err)
 	}
 
 	// Directories are configured in deployment.yaml and exported
@@ -77,3 +102,48 @@ func LoadCredential() (*EJBCACredential, error) {
 
 	return creds, nil
 }
+
+// Validate checks that the credentials required by the configured enrollment method are
+// present, and returns every problem found.
+func (c *EJBCACredential) Validate(useEST bool) error {
+	var errs []error
+	if c.Hostname == "" && len(c.Endpoints) == 0 {
+		errs = append(errs, fmt.Errorf("hostname or endpoints is required"))
+	}
+	weighted := 0
+	for i, endpoint := range c.Endpoints {
+		if endpoint.Hostname == "" {
+			errs = append(errs, fmt.Errorf("endpoints[%d].hostname is required", i))
+		}
+		if endpoint.Weight < 0 {
+			errs = append(errs, fmt.Errorf("endpoints[%d].weight must not be negative, got %d", i, endpoint.Weight))
+		}
+		if endpoint.Weight > 0 {
+			weighted++
+		}
+	}
+	if weighted > 0 && weighted < len(c.Endpoints) {
+		errs = append(errs, fmt.Errorf("either every endpoint or none must have a weight"))
+	}
+	if useEST {
+		if c.EJBCAUsername == "" {
+			errs = append(errs, fmt.Errorf("ejbcaUsername is required when useEST is enabled"))
+		}
+		if c.EJBCAPassword == "" {
+			errs = append(errs, fmt.Errorf("ejbcaPassword is required when useEST is enabled"))
+		}
+	} else {
+		if c.ClientCertPath == "" || c.ClientKeyPath == "" {
+			errs = append(errs, fmt.Errorf("a client certificate and key are required for the EJBCA REST API; set CLIENT_CERT_DIR to a directory containing tls.crt and tls.key"))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// EndpointList returns the configured endpoints, or Hostname as the only endpoint.
+func (c *EJBCACredential) EndpointList() []EJBCAEndpoint {
+	if len(c.Endpoints) > 0 {
+		return c.Endpoints
+	}
+	return []EJBCAEndpoint{{Hostname: c.Hostname}}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/internal/audit"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/config"
+	"github.com/Keyfactor/ejbca-k8s-csr-signer/pkg/credential"
+	"io"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"os"
+)
+
+// validateConfig implements the validate-config command. It checks a configuration file and a
+// credentials file offline, without contacting EJBCA or Kubernetes, prints every problem found
+// and returns the process exit code.
+func validateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	configPath := fs.String("config", envOrDefault("CONFIG_PATH", config.DefaultConfigPath), "Path to the signer configuration file.")
+	credentialsPath := fs.String("credentials", envOrDefault("CREDENTIALS_PATH", credential.DefaultCredentialPath), "Path to the EJBCA credentials file.")
+	overrides := config.NewOverrides(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	valid := true
+	report := func(file string, err error) {
+		valid = false
+		var agg utilerrors.Aggregate
+		if errors.As(err, &agg) {
+			for _, e := range agg.Errors() {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, e)
+			}
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+	}
+
+	serverConfig, err := config.LoadConfig(*configPath, overrides)
+	if err != nil {
+		report(*configPath, err)
+	}
+	if serverConfig == nil {
+		// the credentials are still checked, for the REST API
+		serverConfig = &config.ServerConfig{}
+	}
+
+	// the credentials are checked the way the signer loads them at startup
+	if _, err = loadCredentials(serverConfig, *credentialsPath); err != nil {
+		report(*credentialsPath, err)
+	}
+
+	if !valid {
+		return 1
+	}
+	fmt.Printf("%s and %s are valid\n", *configPath, *credentialsPath)
+	return 0
+}
+
+// verifyAuditLog implements the verify-audit-log command. It checks the hash chain across the
+// audit log files given, oldest first (for example audit.log.2 audit.log.1 audit.log), and
+// returns the process exit code.
+func verifyAuditLog(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: verify-audit-log <file> [<file>...]")
+		return 2
+	}
+
+	var readers []io.Reader
+	for _, path := range args {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	count, err := audit.Verify(io.MultiReader(readers...))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log is not intact after %d records: %v\n", count, err)
+		return 1
+	}
+	fmt.Printf("%d records verified\n", count)
+	return 0
+}